@@ -1,36 +1,137 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/arjun/go-message-queue-api/auth"
+	"github.com/arjun/go-message-queue-api/blobstore"
 	"github.com/gorilla/mux"
 )
 
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
 type APIServer struct {
 	listenAddr string
 	store      Storage
+	images     blobstore.Store
+	events     *EventBroker
+	// legacyCreateResponse makes POST /product answer with the message
+	// string of old versions instead of the product, for clients that parse it
+	legacyCreateResponse bool
+	// validator checks product payloads
+	validator *Validator
+	// verifier checks the bearer tokens of authenticated routes; without it
+	// they answer 401
+	verifier *auth.Verifier
+	// limiter limits the rate of requests of each client; nil is no limit
+	limiter *RateLimiter
+	// quotas are the daily limits of users without limits of their own
+	quotas QuotaLimits
+	// shutdownTimeout is how long Run waits for the requests in flight
+	// once asked to stop
+	shutdownTimeout time.Duration
+	// closing is closed when the server shuts down, to end event streams
+	closing chan struct{}
 }
 
-func NewAPIServer(listenAddr string, store Storage) *APIServer {
+func NewAPIServer(listenAddr string, store Storage, images blobstore.Store) *APIServer {
+	validator := NewValidator(nil)
+	// product images may be uploaded ones, kept in the store
+	validator.ImageStore = images
 	return &APIServer{
-		listenAddr: listenAddr,
-		store:      store,
+		listenAddr:      listenAddr,
+		store:           store,
+		images:          images,
+		events:          NewEventBroker(store),
+		validator:       validator,
+		quotas:          defaultQuotaLimits,
+		shutdownTimeout: 30 * time.Second,
+		closing:         make(chan struct{}),
 	}
 }
 
-func (s *APIServer) Run() {
-	router := mux.NewRouter()
-	router.HandleFunc("/product", makeHTTPHandleFunc(s.handleCreateProduct)).Methods("POST")
-	router.HandleFunc("/product/{id}", makeHTTPHandleFunc(s.handleGetProduct)).Methods("GET")
-	router.HandleFunc("/product/{id}", makeHTTPHandleFunc(s.handleUpdateProduct)).Methods("POST")
+// Run serves the API until ctx is done. It then stops accepting connections
+// and waits up to shutdownTimeout for the requests in flight; event streams
+// end at once, and their clients reconnect. An error is returned if the
+// server could not listen or the requests did not finish in time.
+func (s *APIServer) Run(ctx context.Context) error {
+	server := &http.Server{Addr: s.listenAddr, Handler: s.routes()}
+	server.RegisterOnShutdown(func() { close(s.closing) })
+	go s.events.Run(ctx)
+	go pruneIdempotencyKeys(ctx, s.store)
+
+	served := make(chan error, 1)
+	go func() { served <- server.ListenAndServe() }()
 	log.Println("API Server running on port", s.listenAddr)
 
-	http.ListenAndServe(s.listenAddr, router)
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("API Server shutting down, waiting up to %s for requests in flight", s.shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		server.Close()
+		return fmt.Errorf("shutdown: %w", err)
+	}
+	return nil
+}
+
+func (s *APIServer) routes() *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/product", makeHTTPHandleFunc(s.authenticate(s.idempotent(s.handleCreateProduct)))).Methods("POST")
+	router.HandleFunc("/product", makeHTTPHandleFunc(s.handleListProducts)).Methods("GET")
+	router.HandleFunc("/product/bulk", makeHTTPHandleFunc(s.authenticate(s.idempotent(s.handleBulkCreateProducts)))).Methods("POST")
+	router.HandleFunc("/product/{id}", makeHTTPHandleFunc(s.handleGetProduct)).Methods("GET")
+	router.HandleFunc("/product/{id}", makeHTTPHandleFunc(s.authenticate(s.handlePatchProduct))).Methods("PATCH")
+	router.HandleFunc("/product/{id}", makeHTTPHandleFunc(s.authenticate(s.handleDeleteProduct))).Methods("DELETE")
+	router.HandleFunc("/product/{id}/compressed-images", makeHTTPHandleFunc(s.requireRole(s.handleSetCompressedImages, RoleService))).Methods("PUT")
+	router.HandleFunc("/product/{id}/images", makeHTTPHandleFunc(s.authenticate(s.handleUploadImages))).Methods("POST")
+	router.HandleFunc("/product/{id}/status", makeHTTPHandleFunc(s.handleGetProductStatus)).Methods("GET")
+	router.HandleFunc("/product/{id}/status", makeHTTPHandleFunc(s.requireRole(s.handleReportProductStatus, RoleService))).Methods("POST")
+	router.HandleFunc("/product/{id}/events", makeHTTPHandleFunc(s.handleProductEvents)).Methods("GET")
+	router.HandleFunc("/events", makeHTTPHandleFunc(s.authenticate(s.handleEvents))).Methods("GET")
+	router.HandleFunc("/product/{id}/images/{n:[0-9]+}", makeHTTPHandleFunc(s.handleGetImage)).Methods("GET", "HEAD")
+	router.HandleFunc("/product/{id}/images/{n:[0-9]+}/{rendition}", makeHTTPHandleFunc(s.handleGetImage)).Methods("GET", "HEAD")
+	router.HandleFunc("/webhook", makeHTTPHandleFunc(s.authenticate(s.handleCreateWebhook))).Methods("POST")
+	router.HandleFunc("/webhook", makeHTTPHandleFunc(s.authenticate(s.handleListWebhooks))).Methods("GET")
+	router.HandleFunc("/webhook/{id}", makeHTTPHandleFunc(s.authenticate(s.handleGetWebhook))).Methods("GET")
+	router.HandleFunc("/webhook/{id}", makeHTTPHandleFunc(s.authenticate(s.handlePatchWebhook))).Methods("PATCH")
+	router.HandleFunc("/webhook/{id}", makeHTTPHandleFunc(s.authenticate(s.handleDeleteWebhook))).Methods("DELETE")
+	router.HandleFunc("/webhook/{id}/deliveries", makeHTTPHandleFunc(s.authenticate(s.handleListWebhookDeliveries))).Methods("GET")
+	router.HandleFunc("/user", makeHTTPHandleFunc(s.requireRole(s.handleCreateUser, RoleAdmin))).Methods("POST")
+	router.HandleFunc("/user/{id}", makeHTTPHandleFunc(s.authenticate(s.handleGetUser))).Methods("GET")
+	router.HandleFunc("/user/{id}", makeHTTPHandleFunc(s.authenticate(s.handlePatchUser))).Methods("PATCH")
+	router.HandleFunc("/user/{id}", makeHTTPHandleFunc(s.authenticate(s.handleDeleteUser))).Methods("DELETE")
+	router.HandleFunc("/user/{id}/products", makeHTTPHandleFunc(s.handleListUserProducts)).Methods("GET")
+	router.HandleFunc("/user/{id}/quota", makeHTTPHandleFunc(s.authenticate(s.handleGetUserQuota))).Methods("GET")
+	router.HandleFunc("/user/{id}/quota", makeHTTPHandleFunc(s.requireRole(s.handleSetUserQuota, RoleAdmin))).Methods("PUT")
+	router.HandleFunc("/apikey", makeHTTPHandleFunc(s.requireRole(s.handleCreateAPIKey, RoleAdmin))).Methods("POST")
+	router.HandleFunc("/apikey", makeHTTPHandleFunc(s.requireRole(s.handleListAPIKeys, RoleAdmin))).Methods("GET")
+	router.HandleFunc("/apikey/{id}", makeHTTPHandleFunc(s.requireRole(s.handleRevokeAPIKey, RoleAdmin))).Methods("DELETE")
+	router.HandleFunc("/apikey/{id}/rotate", makeHTTPHandleFunc(s.requireRole(s.handleRotateAPIKey, RoleAdmin))).Methods("POST")
+	router.Use(s.authenticateAPIKeys, s.rateLimit)
+	return router
 }
 
 func (s *APIServer) handleCreateProduct(w http.ResponseWriter, r *http.Request) error {
@@ -38,28 +139,42 @@ func (s *APIServer) handleCreateProduct(w http.ResponseWriter, r *http.Request)
 	var productParams CreateProductParams
 
 	// decoding request body to Product object
-	err := json.NewDecoder(r.Body).Decode(&productParams)
-	if err != nil {
-		return WriteJSON(w, http.StatusBadRequest, err)
+	if err := decodePayload(r.Body, &productParams); err != nil {
+		return writeError(w, err)
 	}
-	// check for missing fields
-	if productParams.Name == "" || productParams.Description == "" || len(productParams.Images) == 0 || productParams.Price == "" || productParams.UserID == 0 {
-		return WriteJSON(w, http.StatusBadRequest, ApiError{Error: "missing fields"})
+	// images may also be uploaded later through POST /product/{id}/images
+	if err := s.validator.Validate(productParams); err != nil {
+		return writeError(w, err)
+	}
+	if !principalOf(r).CanActFor(productParams.UserID) {
+		return WriteProblem(w, forbidden("not allowed to create products for user "+strconv.Itoa(productParams.UserID)))
 	}
 	//check if user id present in database
-	err = s.store.CheckUserID(productParams.UserID)
+	err := s.store.CheckUserID(productParams.UserID)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return WriteJSON(w, http.StatusBadRequest, ApiError{Error: "user id not found"})
+			return writeError(w, fieldError("user_id", FieldNotFound, "user id not found"))
 		}
-		return WriteJSON(w, http.StatusBadRequest, ApiError{Error: err.Error()})
+		return writeError(w, err)
+	}
+	if err := s.consumeQuota(w, productParams.UserID, 1, len(productParams.Images)); err != nil {
+		return writeError(w, err)
 	}
-	productid, err := s.store.CreateProduct(productParams)
+	// the product is answered as inserted, as nothing may fail once it is
+	// committed: a retry with the same Idempotency-Key would create it again
+	product, err := s.store.CreateProduct(productParams)
 	if err != nil {
-		return WriteJSON(w, http.StatusBadRequest, ApiError{Error: err.Error()})
+		s.refundQuota(productParams.UserID, 1, len(productParams.Images))
+		return writeError(w, err)
+	}
+	w.Header().Set("Location", "/product/"+strconv.FormatInt(product.ID, 10))
+
+	if s.legacyCreateResponse {
+		return WriteJSON(w, http.StatusCreated, fmt.Sprintf("product added successfully with product id:%d", product.ID))
 	}
 
-	return WriteJSON(w, http.StatusCreated, fmt.Sprintf("product added successfully with product id:%d", productid))
+	w.Header().Set("ETag", productETag(product))
+	return WriteJSON(w, http.StatusCreated, product)
 }
 
 func (s *APIServer) handleGetProduct(w http.ResponseWriter, r *http.Request) error {
@@ -67,65 +182,580 @@ func (s *APIServer) handleGetProduct(w http.ResponseWriter, r *http.Request) err
 	params := mux.Vars(r)
 	productId, err := strconv.Atoi(params["id"])
 	if err != nil {
-		return WriteJSON(w, http.StatusBadRequest, ApiError{Error: "bad product id"})
+		return WriteProblem(w, invalidID("product"))
 	}
 
 	product, err := s.store.GetProduct(productId)
+	if err == sql.ErrNoRows {
+		return WriteProblem(w, productNotFound())
+	}
 	if err != nil {
-		return WriteJSON(w, http.StatusBadRequest, ApiError{Error: "product id not found"})
+		return writeError(w, err)
+	}
+
+	etag := productETag(product)
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
 	}
 
 	return WriteJSON(w, http.StatusOK, product)
 }
-func (s *APIServer) handleUpdateProduct(w http.ResponseWriter, r *http.Request) error {
 
-	params := mux.Vars(r)
-	productId, err := strconv.Atoi(params["id"])
+func (s *APIServer) handlePatchProduct(w http.ResponseWriter, r *http.Request) error {
+
+	productId, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
-		return WriteJSON(w, http.StatusBadRequest, ApiError{Error: "bad product id"})
+		return WriteProblem(w, invalidID("product"))
 	}
 
-	// decoding request body to Product object
-	var imageLocations []string
-	err = json.NewDecoder(r.Body).Decode(&imageLocations)
+	current, err := s.authorizeProduct(r, productId)
+	if err != nil {
+		return writeError(w, err)
+	}
+
+	version, err := requireIfMatch(r)
 	if err != nil {
-		return WriteJSON(w, http.StatusBadRequest, ApiError{Error: "payload decode error " + err.Error()})
+		return writeError(w, err)
 	}
 
-	var productParams AddProductCompressImagesParams
+	var productParams UpdateProductParams
+	if err := decodePayload(r.Body, &productParams); err != nil {
+		return writeError(w, err)
+	}
+	if err := s.validator.Validate(productParams); err != nil {
+		return writeError(w, err)
+	}
 	productParams.ID = productId
-	productParams.CompressedImages = imageLocations
+	productParams.ExpectedVersion = version
+
+	// new images are processed again, so they count against the quota
+	userId, images := int(current.UserID), 0
+	if productParams.Images != nil {
+		images = len(*productParams.Images)
+		if err := s.consumeQuota(w, userId, 0, images); err != nil {
+			return writeError(w, err)
+		}
+	}
+	product, err := s.store.UpdateProduct(productParams)
+	if err != nil {
+		s.refundQuota(userId, 0, images)
+		return writeProductWriteError(w, err)
+	}
+
+	w.Header().Set("ETag", productETag(product))
+	return WriteJSON(w, http.StatusOK, product)
+}
+
+func (s *APIServer) handleDeleteProduct(w http.ResponseWriter, r *http.Request) error {
+
+	productId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return WriteProblem(w, invalidID("product"))
+	}
+
+	if _, err := s.authorizeProduct(r, productId); err != nil {
+		return writeError(w, err)
+	}
+
+	version, err := requireIfMatch(r)
+	if err != nil {
+		return writeError(w, err)
+	}
+
+	if err := s.store.DeleteProduct(productId, version); err != nil {
+		return writeProductWriteError(w, err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (s *APIServer) handleListProducts(w http.ResponseWriter, r *http.Request) error {
+
+	params, err := parseListProductsParams(r)
+	if err != nil {
+		return writeError(w, err)
+	}
+
+	// fetch one extra row to know whether there is a next page
+	limit := params.Limit
+	params.Limit = limit + 1
+	products, err := s.store.ListProducts(params)
+	if err != nil {
+		return writeError(w, err)
+	}
+
+	page := ProductPage{Products: products}
+	if len(products) > limit {
+		page.Products = products[:limit]
+		last := page.Products[limit-1]
+		page.NextCursor = encodeProductCursor(ProductCursor{
+			SortBy: params.SortBy,
+			Value:  productCursorValue(last, params.SortBy),
+			ID:     last.ID,
+		})
+	}
+
+	return WriteJSON(w, http.StatusOK, page)
+}
+
+// parseListProductsParams reads the filters, sort order and cursor of
+// GET /product from the query string.
+func parseListProductsParams(r *http.Request) (ListProductsParams, error) {
+	query := r.URL.Query()
+	params := ListProductsParams{Limit: defaultPageSize, SortBy: "id"}
+
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			return params, parameterProblem(fieldError("limit", FieldOutOfRange, "must be between 1 and %d", maxPageSize))
+		}
+		params.Limit = limit
+	}
+
+	if v := query.Get("sort"); v != "" {
+		params.Descending = strings.HasPrefix(v, "-")
+		params.SortBy = strings.TrimPrefix(v, "-")
+		if _, ok := productSortColumns[params.SortBy]; !ok {
+			return params, parameterProblem(fieldError("sort", FieldInvalid, "must be one of the sortable fields"))
+		}
+	}
+
+	if v := query.Get("user_id"); v != "" {
+		userId, err := strconv.Atoi(v)
+		if err != nil {
+			return params, parameterProblem(fieldError("user_id", FieldInvalid, "must be a user id"))
+		}
+		params.UserID = userId
+	}
+
+	for name, dst := range map[string]**float64{
+		"min_price": &params.MinPrice,
+		"max_price": &params.MaxPrice,
+	} {
+		if v := query.Get(name); v != "" {
+			price, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return params, parameterProblem(fieldError(name, FieldInvalid, "must be a number"))
+			}
+			*dst = &price
+		}
+	}
+
+	for name, dst := range map[string]**time.Time{
+		"created_after":  &params.CreatedAfter,
+		"created_before": &params.CreatedBefore,
+		"updated_after":  &params.UpdatedAfter,
+		"updated_before": &params.UpdatedBefore,
+	} {
+		if v := query.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return params, parameterProblem(fieldError(name, FieldInvalid, "must be an RFC 3339 time"))
+			}
+			*dst = &t
+		}
+	}
+
+	if v := query.Get("cursor"); v != "" {
+		cursor, err := decodeProductCursor(v)
+		if err != nil || cursor.SortBy != params.SortBy {
+			return params, parameterProblem(fieldError("cursor", FieldInvalid, "is not a cursor of this listing"))
+		}
+		params.Cursor = &cursor
+	}
+
+	return params, nil
+}
+
+func encodeProductCursor(c ProductCursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeProductCursor(s string) (ProductCursor, error) {
+	var c ProductCursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(b, &c)
+	return c, err
+}
+
+func (s *APIServer) handleSetCompressedImages(w http.ResponseWriter, r *http.Request) error {
+
+	params := mux.Vars(r)
+	productId, err := strconv.Atoi(params["id"])
+	if err != nil {
+		return WriteProblem(w, invalidID("product"))
+	}
+
+	var req CompressedImagesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return WriteProblem(w, malformedBody(err))
+	}
+	if err := validateCompressedImages(&req); err != nil {
+		return writeError(w, err)
+	}
 
+	// If-Match is optional so that a worker may also append blindly
+	var version int64
+	if r.Header.Get("If-Match") != "" {
+		version, err = requireIfMatch(r)
+		if err != nil {
+			return writeError(w, err)
+		}
+	}
+
+	productParams := AddProductCompressImagesParams{
+		ID:               productId,
+		CompressedImages: req.Images,
+		Sources:          req.Sources,
+		Renditions:       req.Renditions,
+		Append:           req.Mode == CompressedImagesAppend,
+		Worker:           req.Worker,
+		ExpectedVersion:  version,
+	}
 	err = s.store.AddProductCompressImages(productParams)
+	if errors.Is(err, ErrImageCount) {
+		return writeError(w, fieldError("images", FieldInvalid, "must have a location per product image, or per image not compressed yet when appended"))
+	}
 	if err != nil {
-		return WriteJSON(w, http.StatusBadRequest, err)
+		return writeProductWriteError(w, err)
 	}
 
 	product, err := s.store.GetProduct(productId)
 	if err != nil {
-		return WriteJSON(w, http.StatusBadRequest, ApiError{Error: err.Error()})
+		return writeError(w, err)
 	}
 
+	w.Header().Set("ETag", productETag(product))
 	return WriteJSON(w, http.StatusOK, product)
 }
 
+var renditionNamePattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// validateCompressedImages checks the mode, the sources and every image
+// location of a compressed-images write. Locations are either URLs or
+// relative paths, or empty for images that could not be processed.
+func validateCompressedImages(req *CompressedImagesRequest) error {
+	switch req.Mode {
+	case "":
+		req.Mode = CompressedImagesReplace
+	case CompressedImagesReplace, CompressedImagesAppend:
+	default:
+		return fieldError("mode", FieldInvalid, "must be %q or %q", CompressedImagesReplace, CompressedImagesAppend)
+	}
+	if len(req.Images) == 0 && len(req.Renditions) == 0 {
+		return fieldError("images", FieldRequired, "must not be empty")
+	}
+	if len(req.Worker) > 255 {
+		return fieldError("worker", FieldInvalid, "must be at most 255 characters")
+	}
+
+	if err := validateImageLocations("images", req.Images); err != nil {
+		return err
+	}
+	// every list has a location per image, in the same order
+	names := make([]string, 0, len(req.Renditions))
+	for name := range req.Renditions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	count, countField := len(req.Images), "images"
+	for _, name := range names {
+		locations := req.Renditions[name]
+		if !renditionNamePattern.MatchString(name) {
+			return fieldError("renditions."+name, FieldInvalid, "name must be 1 to 32 of a-z, 0-9, _ and -")
+		}
+		if len(locations) == 0 {
+			return fieldError("renditions."+name, FieldRequired, "must not be empty")
+		}
+		if count == 0 {
+			count, countField = len(locations), "renditions."+name
+		} else if len(locations) != count {
+			return fieldError("renditions."+name, FieldInvalid, "must have %d locations like %s", count, countField)
+		}
+		if err := validateImageLocations("renditions."+name, locations); err != nil {
+			return err
+		}
+	}
+	if len(req.Sources) == 0 {
+		req.Sources = nil
+	} else if len(req.Sources) != count {
+		return fieldError("sources", FieldInvalid, "must have %d images like %s", count, countField)
+	}
+	seen := make(map[string]bool, len(req.Sources))
+	for i, source := range req.Sources {
+		if source == "" || seen[source] {
+			return fieldError(fmt.Sprintf("sources[%d]", i), FieldInvalid, "must be a distinct product image")
+		}
+		seen[source] = true
+	}
+	return nil
+}
+
+func validateImageLocations(field string, locations []string) error {
+	seen := make(map[string]bool, len(locations))
+	for i, location := range locations {
+		if location == "" {
+			continue
+		}
+		name := fmt.Sprintf("%s[%d]", field, i)
+		if len(location) > 2048 || strings.TrimSpace(location) != location {
+			return fieldError(name, FieldInvalid, "is not a valid location")
+		}
+		u, err := url.Parse(location)
+		if err != nil {
+			return fieldError(name, FieldInvalid, "is not a valid location")
+		}
+		switch u.Scheme {
+		case "":
+			if strings.Contains(location, "..") {
+				return fieldError(name, FieldInvalid, "must not contain ..")
+			}
+		case "http", "https", "file", "s3":
+			if u.Scheme != "file" && u.Host == "" {
+				return fieldError(name, FieldInvalid, "has no host")
+			}
+		default:
+			return fieldError(name, FieldInvalid, "has unsupported scheme %q", u.Scheme)
+		}
+		if seen[location] {
+			return fieldError(name, FieldDuplicate, "is a duplicate")
+		}
+		seen[location] = true
+	}
+	return nil
+}
+
+func (s *APIServer) handleCreateUser(w http.ResponseWriter, r *http.Request) error {
+
+	var userParams CreateUserParams
+	if err := json.NewDecoder(r.Body).Decode(&userParams); err != nil {
+		return WriteProblem(w, malformedBody(err))
+	}
+	// check for missing fields
+	if missing := requireFields("is required", map[string]bool{
+		"name":      userParams.Name == "",
+		"mobile":    userParams.Mobile == "",
+		"latitude":  userParams.Latitude == "",
+		"longitude": userParams.Longitude == "",
+	}); missing != nil {
+		return writeError(w, missing)
+	}
+	if err := validateUser(&userParams.Mobile, &userParams.Latitude, &userParams.Longitude); err != nil {
+		return writeError(w, err)
+	}
+
+	userId, err := s.store.CreateUser(userParams)
+	if err != nil {
+		return writeError(w, err)
+	}
+
+	user, err := s.store.GetUser(userId)
+	if err != nil {
+		return writeError(w, err)
+	}
+
+	return WriteJSON(w, http.StatusCreated, user)
+}
+
+func (s *APIServer) handleGetUser(w http.ResponseWriter, r *http.Request) error {
+
+	userId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return WriteProblem(w, invalidID("user"))
+	}
+	if err := authorizeUser(r, userId); err != nil {
+		return writeError(w, err)
+	}
+
+	user, err := s.store.GetUser(userId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return WriteProblem(w, userNotFound())
+		}
+		return writeError(w, err)
+	}
+
+	return WriteJSON(w, http.StatusOK, user)
+}
+
+func (s *APIServer) handlePatchUser(w http.ResponseWriter, r *http.Request) error {
+
+	userId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return WriteProblem(w, invalidID("user"))
+	}
+	if err := authorizeUser(r, userId); err != nil {
+		return writeError(w, err)
+	}
+
+	var userParams UpdateUserParams
+	if err := json.NewDecoder(r.Body).Decode(&userParams); err != nil {
+		return WriteProblem(w, malformedBody(err))
+	}
+	if userParams.Name != nil && *userParams.Name == "" {
+		return writeError(w, fieldError("name", FieldRequired, "must not be empty"))
+	}
+	if err := validateUser(userParams.Mobile, userParams.Latitude, userParams.Longitude); err != nil {
+		return writeError(w, err)
+	}
+	userParams.ID = userId
+
+	user, err := s.store.UpdateUser(userParams)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return WriteProblem(w, userNotFound())
+		}
+		return writeError(w, err)
+	}
+
+	return WriteJSON(w, http.StatusOK, user)
+}
+
+func (s *APIServer) handleDeleteUser(w http.ResponseWriter, r *http.Request) error {
+
+	userId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return WriteProblem(w, invalidID("user"))
+	}
+	if err := authorizeUser(r, userId); err != nil {
+		return writeError(w, err)
+	}
+
+	err = s.store.DeleteUser(userId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return WriteProblem(w, userNotFound())
+		}
+		if isForeignKeyViolation(err) {
+			return WriteProblem(w, NewProblem(http.StatusConflict, CodeUserHasProducts, "user still has products"))
+		}
+		return writeError(w, err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (s *APIServer) handleListUserProducts(w http.ResponseWriter, r *http.Request) error {
+
+	userId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return WriteProblem(w, invalidID("user"))
+	}
+
+	err = s.store.CheckUserID(userId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return WriteProblem(w, userNotFound())
+		}
+		return writeError(w, err)
+	}
+
+	// the user in the path always wins over a user_id query parameter
+	query := r.URL.Query()
+	query.Set("user_id", strconv.Itoa(userId))
+	r.URL.RawQuery = query.Encode()
+
+	return s.handleListProducts(w, r)
+}
+
+// requireFields returns a field error with message for each field flagged
+// empty, in alphabetical order, or nil if there are none.
+func requireFields(message string, empty map[string]bool) error {
+	var errs FieldErrors
+	for field, isEmpty := range empty {
+		if isEmpty {
+			errs = append(errs, fieldError(field, FieldRequired, message))
+		}
+	}
+	if errs == nil {
+		return nil
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+	return errs
+}
+
+// productETag is the entity tag of a product, derived from its version.
+func productETag(p Product) string {
+	return fmt.Sprintf(`"%d"`, p.Version)
+}
+
+// requireIfMatch returns the product version named by the If-Match header.
+func requireIfMatch(r *http.Request) (int64, error) {
+	v := strings.TrimSpace(r.Header.Get("If-Match"))
+	if v == "" {
+		return 0, NewProblem(http.StatusPreconditionRequired, CodePreconditionRequired, "If-Match header with the product ETag is required")
+	}
+	version, err := strconv.ParseInt(strings.Trim(strings.TrimPrefix(v, "W/"), `"`), 10, 64)
+	if err != nil || version < 1 {
+		return 0, parameterProblem(fieldError("If-Match", FieldInvalid, "must be a product ETag"))
+	}
+	return version, nil
+}
+
+// writeProductWriteError reports the failure of a version guarded write.
+func writeProductWriteError(w http.ResponseWriter, err error) error {
+	if err == sql.ErrNoRows {
+		return WriteProblem(w, productNotFound())
+	}
+	return writeError(w, err)
+}
+
+// validateUser checks the optional mobile number and coordinates of a user
+// payload. Values are trimmed in place.
+func validateUser(mobile, latitude, longitude *string) error {
+	if mobile != nil {
+		*mobile = strings.TrimSpace(*mobile)
+		if len(*mobile) < 7 || len(*mobile) > 15 || strings.Trim(*mobile, "0123456789") != "" {
+			return fieldError("mobile", FieldInvalid, "must be 7 to 15 digits")
+		}
+	}
+	if latitude != nil {
+		if err := validateCoordinate("latitude", latitude, 90); err != nil {
+			return err
+		}
+	}
+	if longitude != nil {
+		if err := validateCoordinate("longitude", longitude, 180); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateCoordinate(field string, v *string, limit float64) error {
+	*v = strings.TrimSpace(*v)
+	f, err := strconv.ParseFloat(*v, 64)
+	if err != nil || math.IsNaN(f) {
+		return fieldError(field, FieldInvalid, "must be a number")
+	}
+	if f < -limit || f > limit {
+		return fieldError(field, FieldOutOfRange, "must be between %v and %v", -limit, limit)
+	}
+	return nil
+}
+
 // utils
 
 type apiFunc func(http.ResponseWriter, *http.Request) error
-type ApiError struct {
-	Error string
-}
 
 func WriteJSON(w http.ResponseWriter, status int, v any) error {
-	w.WriteHeader(status)
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	return json.NewEncoder(w).Encode(v)
 }
 
 func makeHTTPHandleFunc(f apiFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if err := f(w, r); err != nil {
-			WriteJSON(w, http.StatusBadRequest, ApiError{Error: err.Error()})
+			writeError(w, err)
 		}
 	}
 }
@@ -1,13 +1,26 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"net/http"
+	"net/http/httptest"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
+// createdProductID is the id of the product created by a POST /product.
+func createdProductID(t *testing.T, writer *httptest.ResponseRecorder) string {
+	assert.Equal(t, http.StatusCreated, writer.Code)
+	var product Product
+	assert.NoError(t, json.Unmarshal(writer.Body.Bytes(), &product))
+	return strconv.Itoa(int(product.ID))
+}
+
 func Test_API_HandleCreateProduct(t *testing.T) {
 
 	var body = []byte("")
@@ -22,9 +35,17 @@ func Test_API_HandleCreateProduct(t *testing.T) {
 		"user_id":17
 	  }`)
 	writer = makeRequest("POST", "/product", jsonStr1)
-	msg = writer.Body.String()
-	assert.Equal(t, http.StatusBadRequest, writer.Code)
-	assert.Contains(t, msg, "missing fields")
+	assert.Equal(t, http.StatusUnprocessableEntity, writer.Code)
+	assert.Equal(t, "application/problem+json", writer.Header().Get("Content-Type"))
+	var problem Problem
+	assert.NoError(t, json.Unmarshal(writer.Body.Bytes(), &problem))
+	assert.Equal(t, CodeValidationFailed, problem.Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, problem.Status)
+	assert.Equal(t, "/problems/validation_failed", problem.Type)
+	assert.Equal(t, []FieldError{
+		{Field: "name", Code: FieldRequired, Message: "is required"},
+		{Field: "price", Code: FieldRequired, Message: "is required"},
+	}, problem.Errors)
 
 	var jsonStr2 = []byte(`{
 		"name": "product1", 
@@ -35,8 +56,9 @@ func Test_API_HandleCreateProduct(t *testing.T) {
 	  }`)
 	writer = makeRequest("POST", "/product", jsonStr2)
 	msg = writer.Body.String()
-	assert.Equal(t, http.StatusBadRequest, writer.Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, writer.Code)
 	assert.Contains(t, msg, "user id not found")
+	assert.Contains(t, msg, `"field":"user_id","code":"not_found"`)
 
 	var jsonStr3 = []byte(`{
 		"name": "product1", 
@@ -46,9 +68,42 @@ func Test_API_HandleCreateProduct(t *testing.T) {
 		"user_id":17
 	  }`)
 	writer = makeRequest("POST", "/product", jsonStr3)
-	msg = writer.Body.String()
 	assert.Equal(t, http.StatusCreated, writer.Code)
-	assert.Contains(t, msg, "product added successfully with product id:")
+	var product Product
+	assert.NoError(t, json.Unmarshal(writer.Body.Bytes(), &product))
+	assert.NotZero(t, product.ID)
+	assert.Equal(t, "product1", product.Name)
+	assert.Equal(t, int64(17), product.UserID)
+	assert.Equal(t, "/product/"+strconv.Itoa(int(product.ID)), writer.Header().Get("Location"))
+	assert.Equal(t, productETag(product), writer.Header().Get("ETag"))
+
+	for _, tc := range []struct {
+		body  string
+		field string
+		code  string
+	}{
+		{`{"name":"p","description":"d","price":"125","user_id":17,"colour":"red"}`, "colour", FieldUnknown},
+		{`{"name":"p","description":"d","price":"12.345","user_id":17}`, "price", FieldInvalid},
+		{`{"name":"p","description":"d","price":"125","user_id":17,"images":["file:///etc/passwd"]}`, "images[0]", FieldInvalid},
+		{`{"name":"p","description":"d","price":"125","user_id":17,"images":["/100/1"]}`, "images[0]", FieldInvalid},
+		{`{"name":"` + strings.Repeat("n", 201) + `","description":"d","price":"125","user_id":17}`, "name", FieldOutOfRange},
+	} {
+		writer = makeRequest("POST", "/product", []byte(tc.body))
+		assert.Equal(t, http.StatusUnprocessableEntity, writer.Code, tc.body)
+		problem = Problem{}
+		assert.NoError(t, json.Unmarshal(writer.Body.Bytes(), &problem))
+		assert.Len(t, problem.Errors, 1, tc.body)
+		assert.Equal(t, tc.field, problem.Errors[0].Field, tc.body)
+		assert.Equal(t, tc.code, problem.Errors[0].Code, tc.body)
+	}
+
+	// old clients get the message string
+	testAPIServer.legacyCreateResponse = true
+	defer func() { testAPIServer.legacyCreateResponse = false }()
+	writer = makeRequest("POST", "/product", jsonStr3)
+	assert.Equal(t, http.StatusCreated, writer.Code)
+	assert.Contains(t, writer.Body.String(), "product added successfully with product id:")
+	assert.NotEmpty(t, writer.Header().Get("Location"))
 
 }
 
@@ -60,8 +115,8 @@ func Test_API_HandleGetProduct(t *testing.T) {
 
 	writer = makeRequest("GET", "/product/"+"10000", nil)
 	msg = writer.Body.String()
-	assert.Equal(t, http.StatusBadRequest, writer.Code)
-	assert.Contains(t, msg, "product id not found")
+	assert.Equal(t, http.StatusNotFound, writer.Code)
+	assert.Contains(t, msg, `"code":"product_not_found"`)
 
 	var jsonStr1 = []byte(`{
 		"name": "product1", 
@@ -71,8 +126,7 @@ func Test_API_HandleGetProduct(t *testing.T) {
 		"user_id":17
 	  }`)
 	writer = makeRequest("POST", "/product", jsonStr1)
-	msg = writer.Body.String()
-	productId := strings.Split(strings.ReplaceAll(msg, "\"\n", ""), ":")[1]
+	productId := createdProductID(t, writer)
 
 	writer = makeRequest("GET", "/product/"+productId, nil)
 
@@ -80,12 +134,17 @@ func Test_API_HandleGetProduct(t *testing.T) {
 
 }
 
-func Test_API_HandleUpdateProduct(t *testing.T) {
-	writer := makeRequest("POST", "/product/"+"abcd", nil)
+func Test_API_HandleSetCompressedImages(t *testing.T) {
+	writer := makeRequest("PUT", "/product/"+"abcd"+"/compressed-images", nil)
 	msg := writer.Body.String()
 	assert.Equal(t, http.StatusBadRequest, writer.Code)
 	assert.Contains(t, msg, "bad product id")
 
+	writer = makeRequest("PUT", "/product/"+"10000"+"/compressed-images", []byte(`{"images":["./home/path1"]}`))
+	msg = writer.Body.String()
+	assert.Equal(t, http.StatusNotFound, writer.Code)
+	assert.Contains(t, msg, "product id not found")
+
 	var jsonStr1 = []byte(`{
 		"name": "product1", 
 		"description": "this is product 1",
@@ -94,22 +153,319 @@ func Test_API_HandleUpdateProduct(t *testing.T) {
 		"user_id":17
 	  }`)
 	writer = makeRequest("POST", "/product", jsonStr1)
-	msg = writer.Body.String()
-	productId := strings.Split(strings.ReplaceAll(msg, "\"\n", ""), ":")[1]
+	productId := createdProductID(t, writer)
 
 	var jsonStr2 = []byte("")
-	writer = makeRequest("POST", "/product/"+productId, jsonStr2)
+	writer = makeRequest("PUT", "/product/"+productId+"/compressed-images", jsonStr2)
 	msg = writer.Body.String()
 	assert.Equal(t, http.StatusBadRequest, writer.Code)
 	assert.Contains(t, msg, "payload decode error")
 
-	var jsonStr3 = []byte(`[
-		"./home/path1",
-		"./home/path2"
-	  ]`)
-	writer = makeRequest("POST", "/product/"+productId, jsonStr3)
+	writer = makeRequest("PUT", "/product/"+productId+"/compressed-images", []byte(`{"images":["./home/path1","./home/path1"]}`))
+	msg = writer.Body.String()
+	assert.Equal(t, http.StatusUnprocessableEntity, writer.Code)
+	assert.Contains(t, msg, `"field":"images[1]","code":"duplicate"`)
+
+	writer = makeRequest("PUT", "/product/"+productId+"/compressed-images", []byte(`{"images":["ftp://host/path1"]}`))
+	msg = writer.Body.String()
+	assert.Equal(t, http.StatusUnprocessableEntity, writer.Code)
+	assert.Contains(t, msg, "unsupported scheme")
+
+	writer = makeRequest("PUT", "/product/"+productId+"/compressed-images", []byte(`{"images":["./home/path1"],"mode":"merge"}`))
+	assert.Equal(t, http.StatusUnprocessableEntity, writer.Code)
+
+	var jsonStr3 = []byte(`{
+		"images": ["./home/path1", "./home/path2"],
+		"worker": "worker-1"
+	  }`)
+	writer = makeRequest("PUT", "/product/"+productId+"/compressed-images", jsonStr3)
 	msg = writer.Body.String()
 	assert.Equal(t, http.StatusOK, writer.Code)
 	assert.Contains(t, msg, `"compressed_images":["./home/path1","./home/path2"]`)
+	assert.Contains(t, msg, `"compressed_by":"worker-1"`)
+	assert.Contains(t, msg, `"compressed_at":`)
+
+	// every product image has a location, and no more
+	writer = makeRequest("PUT", "/product/"+productId+"/compressed-images", []byte(`{"images":["./home/path3"],"mode":"append","worker":"worker-2"}`))
+	msg = writer.Body.String()
+	assert.Equal(t, http.StatusUnprocessableEntity, writer.Code)
+	assert.Contains(t, msg, `"field":"images"`)
+
+	writer = makeRequest("PUT", "/product/"+productId+"/compressed-images", []byte(`{"images":["./home/path3"]}`))
+	assert.Equal(t, http.StatusUnprocessableEntity, writer.Code)
+
+	writer = makeRequest("PUT", "/product/"+productId+"/compressed-images", []byte(`{"renditions":{"Thumb":["./home/thumb1"]}}`))
+	msg = writer.Body.String()
+	assert.Equal(t, http.StatusUnprocessableEntity, writer.Code)
+	assert.Contains(t, msg, `"field":"renditions.Thumb"`)
+
+	writer = makeRequest("PUT", "/product/"+productId+"/compressed-images", []byte(`{
+		"images": ["./home/listing1", "./home/listing2"],
+		"renditions": {"listing": ["./home/listing1", "./home/listing2"], "thumb": ["./home/thumb1"]}
+	  }`))
+	msg = writer.Body.String()
+	assert.Equal(t, http.StatusUnprocessableEntity, writer.Code)
+	assert.Contains(t, msg, `"field":"renditions.thumb"`)
+
+	writer = makeRequest("PUT", "/product/"+productId+"/compressed-images", []byte(`{
+		"images": ["./home/listing1", "./home/listing2"],
+		"renditions": {"listing": ["./home/listing1", "./home/listing2"], "thumb": ["./home/thumb1", "./home/thumb2"]}
+	  }`))
+	msg = writer.Body.String()
+	assert.Equal(t, http.StatusOK, writer.Code)
+	assert.Contains(t, msg, `"renditions":{"listing":["./home/listing1","./home/listing2"],"thumb":["./home/thumb1","./home/thumb2"]}`)
+
+	// images not compressed yet are appended to
+	appendedProduct := createRandomProduct(t)
+	appended := strconv.Itoa(int(appendedProduct.ID))
+	writer = makeRequest("PUT", "/product/"+appended+"/compressed-images", []byte(`{
+		"images": ["./home/listing1"],
+		"renditions": {"listing": ["./home/listing1"], "thumb": ["./home/thumb1"]},
+		"mode": "append"
+	  }`))
+	assert.Equal(t, http.StatusOK, writer.Code)
+	writer = makeRequest("PUT", "/product/"+appended+"/compressed-images", []byte(`{
+		"images": ["./home/listing2"],
+		"renditions": {"listing": ["./home/listing2"], "thumb": ["./home/thumb2"]},
+		"mode": "append",
+		"worker": "worker-2"
+	  }`))
+	msg = writer.Body.String()
+	assert.Equal(t, http.StatusOK, writer.Code)
+	assert.Contains(t, msg, `"compressed_images":["./home/listing1","./home/listing2"]`)
+	assert.Contains(t, msg, `"renditions":{"listing":["./home/listing1","./home/listing2"],"thumb":["./home/thumb1","./home/thumb2"]}`)
+	assert.Contains(t, msg, `"compressed_by":"worker-2"`)
+
+	// paths written by source image replace those of that image only
+	writer = makeRequest("PUT", "/product/"+appended+"/compressed-images", []byte(`{
+		"images": ["./home/listing3"],
+		"renditions": {"listing": ["./home/listing3"]},
+		"sources": ["`+appendedProduct.Images[0]+`"]
+	  }`))
+	msg = writer.Body.String()
+	assert.Equal(t, http.StatusOK, writer.Code)
+	assert.Contains(t, msg, `"compressed_images":["./home/listing3","./home/listing2"]`)
+	assert.Contains(t, msg, `"renditions":{"listing":["./home/listing3","./home/listing2"],"thumb":["","./home/thumb2"]}`)
+
+	// as often as they are written, and not for images the product lost
+	writer = makeRequest("PUT", "/product/"+appended+"/compressed-images", []byte(`{
+		"images": ["./home/listing4", "./home/gone"],
+		"sources": ["`+appendedProduct.Images[0]+`", "https://example.com/gone.png"]
+	  }`))
+	msg = writer.Body.String()
+	assert.Equal(t, http.StatusOK, writer.Code)
+	assert.Contains(t, msg, `"compressed_images":["./home/listing4","./home/listing2"]`)
+
+	writer = makeRequest("PUT", "/product/"+appended+"/compressed-images", []byte(`{"images":["./home/listing4"],"sources":["a","b"]}`))
+	assert.Equal(t, http.StatusUnprocessableEntity, writer.Code)
+	assert.Contains(t, writer.Body.String(), `"field":"sources"`)
+
+	// the old POST route is gone
+	writer = makeRequest("POST", "/product/"+productId, []byte(`["./home/path1"]`))
+	assert.Equal(t, http.StatusMethodNotAllowed, writer.Code)
+
+}
+
+func Test_API_HandleListProducts(t *testing.T) {
+	writer := makeRequest("GET", "/product?limit=abcd", nil)
+	msg := writer.Body.String()
+	assert.Equal(t, http.StatusBadRequest, writer.Code)
+	assert.Contains(t, msg, "limit must be between")
+
+	writer = makeRequest("GET", "/product?sort=name", nil)
+	msg = writer.Body.String()
+	assert.Equal(t, http.StatusBadRequest, writer.Code)
+	assert.Contains(t, msg, `"code":"invalid_parameter"`)
+	assert.Contains(t, msg, `"field":"sort"`)
+
+	writer = makeRequest("GET", "/product?cursor=abcd", nil)
+	assert.Equal(t, http.StatusBadRequest, writer.Code)
+
+	var jsonStr1 = []byte(`{
+		"name": "product1", 
+		"description": "this is product 1",
+		"images":["https://via.placeholder.com/100/13234","https://via.placeholder.com/100/5675463"],
+		"price":"125",
+		"user_id":18
+	  }`)
+	for i := 0; i < 3; i++ {
+		writer = makeRequest("POST", "/product", jsonStr1)
+		assert.Equal(t, http.StatusCreated, writer.Code)
+	}
+
+	writer = makeRequest("GET", "/product?user_id=18&limit=2&sort=-created_at", nil)
+	assert.Equal(t, http.StatusOK, writer.Code)
+	var page ProductPage
+	assert.NoError(t, json.Unmarshal(writer.Body.Bytes(), &page))
+	assert.Len(t, page.Products, 2)
+	assert.NotEmpty(t, page.NextCursor)
+
+	writer = makeRequest("GET", "/product?user_id=18&limit=2&sort=-created_at&cursor="+page.NextCursor, nil)
+	assert.Equal(t, http.StatusOK, writer.Code)
+	var next ProductPage
+	assert.NoError(t, json.Unmarshal(writer.Body.Bytes(), &next))
+	assert.NotEmpty(t, next.Products)
+	assert.NotEqual(t, page.Products[0].ID, next.Products[0].ID)
+
+	// a cursor is bound to the sort order it was issued for
+	writer = makeRequest("GET", "/product?user_id=18&sort=price&cursor="+page.NextCursor, nil)
+	msg = writer.Body.String()
+	assert.Equal(t, http.StatusBadRequest, writer.Code)
+	assert.Contains(t, msg, `"field":"cursor"`)
+}
+
+func Test_API_HandleUser(t *testing.T) {
+	writer := makeRequest("POST", "/user", []byte(`{"name":"user1","mobile":"9876543210"}`))
+	msg := writer.Body.String()
+	assert.Equal(t, http.StatusUnprocessableEntity, writer.Code)
+	assert.Contains(t, msg, "latitude is required, longitude is required")
+
+	writer = makeRequest("POST", "/user", []byte(`{"name":"user1","mobile":"98-76","latitude":"12.5","longitude":"77.5"}`))
+	msg = writer.Body.String()
+	assert.Equal(t, http.StatusUnprocessableEntity, writer.Code)
+	assert.Contains(t, msg, "mobile must be")
+
+	writer = makeRequest("POST", "/user", []byte(`{"name":"user1","mobile":"9876543210","latitude":"95","longitude":"77.5"}`))
+	msg = writer.Body.String()
+	assert.Equal(t, http.StatusUnprocessableEntity, writer.Code)
+	assert.Contains(t, msg, "latitude must be between")
+
+	writer = makeRequest("POST", "/user", []byte(`{"name":"user1","mobile":"9876543210","latitude":"12.5","longitude":"-181"}`))
+	msg = writer.Body.String()
+	assert.Equal(t, http.StatusUnprocessableEntity, writer.Code)
+	assert.Contains(t, msg, "longitude must be between")
+
+	writer = makeRequest("POST", "/user", []byte(`{"name":"user1","mobile":"9876543210","latitude":"12.5","longitude":"77.5"}`))
+	assert.Equal(t, http.StatusCreated, writer.Code)
+	var user User
+	assert.NoError(t, json.Unmarshal(writer.Body.Bytes(), &user))
+	assert.NotZero(t, user.ID)
+	userId := strconv.Itoa(int(user.ID))
+
+	writer = makeRequest("GET", "/user/"+userId, nil)
+	assert.Equal(t, http.StatusOK, writer.Code)
+	assert.Contains(t, writer.Body.String(), `"name":"user1"`)
+
+	writer = makeRequest("PATCH", "/user/"+userId, []byte(`{"name":"user2"}`))
+	assert.Equal(t, http.StatusOK, writer.Code)
+	assert.Contains(t, writer.Body.String(), `"name":"user2"`)
+	assert.Contains(t, writer.Body.String(), `"mobile":"9876543210"`)
+
+	writer = makeRequest("PATCH", "/user/"+userId, []byte(`{"latitude":"abc"}`))
+	assert.Equal(t, http.StatusUnprocessableEntity, writer.Code)
+
+	writer = makeRequest("POST", "/product", []byte(`{
+		"name": "product1",
+		"description": "this is product 1",
+		"images":["https://via.placeholder.com/100/13234"],
+		"price":"125",
+		"user_id":`+userId+`
+	  }`))
+	assert.Equal(t, http.StatusCreated, writer.Code)
+
+	writer = makeRequest("GET", "/user/"+userId+"/products", nil)
+	assert.Equal(t, http.StatusOK, writer.Code)
+	var page ProductPage
+	assert.NoError(t, json.Unmarshal(writer.Body.Bytes(), &page))
+	assert.Len(t, page.Products, 1)
+
+	writer = makeRequest("DELETE", "/user/"+userId, nil)
+	assert.Equal(t, http.StatusConflict, writer.Code)
+
+	testPostgresStore.db.Exec("DELETE FROM products WHERE user_id = $1", user.ID)
+	writer = makeRequest("DELETE", "/user/"+userId, nil)
+	assert.Equal(t, http.StatusNoContent, writer.Code)
+
+	writer = makeRequest("GET", "/user/"+userId, nil)
+	assert.Equal(t, http.StatusNotFound, writer.Code)
+
+	writer = makeRequest("GET", "/user/"+userId+"/products", nil)
+	assert.Equal(t, http.StatusNotFound, writer.Code)
+}
+
+func Test_API_HandlePatchDeleteProduct(t *testing.T) {
+	var jsonStr1 = []byte(`{
+		"name": "product1", 
+		"description": "this is product 1",
+		"images":["https://via.placeholder.com/100/13234","https://via.placeholder.com/100/5675463"],
+		"price":"125",
+		"user_id":17
+	  }`)
+	writer := makeRequest("POST", "/product", jsonStr1)
+	productId := createdProductID(t, writer)
+
+	writer = makeRequest("GET", "/product/"+productId, nil)
+	assert.Equal(t, http.StatusOK, writer.Code)
+	etag := writer.Header().Get("ETag")
+	assert.Equal(t, `"1"`, etag)
+
+	writer = makeRequest("PATCH", "/product/"+productId, []byte(`{"name":"product2"}`))
+	assert.Equal(t, http.StatusPreconditionRequired, writer.Code)
+
+	writer = makeRequestWithHeaders("PATCH", "/product/"+productId, []byte(`{"name":""}`), map[string]string{"If-Match": etag})
+	assert.Equal(t, http.StatusUnprocessableEntity, writer.Code)
+
+	writer = makeRequestWithHeaders("PATCH", "/product/"+productId, []byte(`{"price":"1.999","color":"red"}`), map[string]string{"If-Match": etag})
+	assert.Equal(t, http.StatusUnprocessableEntity, writer.Code)
+	assert.Contains(t, writer.Body.String(), `"field":"color","code":"unknown"`)
+
+	writer = makeRequestWithHeaders("PATCH", "/product/"+productId, []byte(`{"name":"product2","price":"150.5"}`), map[string]string{"If-Match": etag})
+	msg := writer.Body.String()
+	assert.Equal(t, http.StatusOK, writer.Code)
+	assert.Contains(t, msg, `"name":"product2"`)
+	assert.Contains(t, msg, `"price":150.5`)
+	assert.Equal(t, `"2"`, writer.Header().Get("ETag"))
+
+	// a second editor still holding the old etag must not clobber the change
+	writer = makeRequestWithHeaders("PATCH", "/product/"+productId, []byte(`{"name":"product3"}`), map[string]string{"If-Match": etag})
+	assert.Equal(t, http.StatusPreconditionFailed, writer.Code)
+
+	writer = makeRequestWithHeaders("PUT", "/product/"+productId+"/compressed-images", []byte(`{"images":["./home/path1"]}`), map[string]string{"If-Match": etag})
+	assert.Equal(t, http.StatusPreconditionFailed, writer.Code)
+
+	writer = makeRequestWithHeaders("DELETE", "/product/"+productId, nil, map[string]string{"If-Match": etag})
+	assert.Equal(t, http.StatusPreconditionFailed, writer.Code)
+
+	writer = makeRequestWithHeaders("DELETE", "/product/"+productId, nil, map[string]string{"If-Match": `"2"`})
+	assert.Equal(t, http.StatusNoContent, writer.Code)
+
+	writer = makeRequestWithHeaders("DELETE", "/product/"+productId, nil, map[string]string{"If-Match": `"2"`})
+	assert.Equal(t, http.StatusNotFound, writer.Code)
+}
+
+func Test_API_Shutdown(t *testing.T) {
+	server := NewAPIServer("localhost:3099", testPostgresStore, testImageStore)
+	server.shutdownTimeout = 5 * time.Second
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopped := make(chan error, 1)
+	go func() { stopped <- server.Run(ctx) }()
+
+	url := "http://localhost:3099"
+	assert.Eventually(t, func() bool {
+		res, err := http.Get(url + "/product/1000000")
+		if err != nil {
+			return false
+		}
+		res.Body.Close()
+		return true
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// an open event stream does not hold up the shutdown
+	product := createRandomProduct(t)
+	events := openEventStream(t, url+"/product/"+strconv.Itoa(int(product.ID))+"/events", nil)
+
+	cancel()
+	select {
+	case err := <-stopped:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server still running 5s after the shutdown")
+	}
+	for range events {
+	}
 
+	// and no more connections are accepted
+	_, err := http.Get(url + "/product/1000000")
+	assert.Error(t, err)
 }
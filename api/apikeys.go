@@ -0,0 +1,469 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Scopes of an API key.
+const (
+	ScopeProductRead  = "product:read"
+	ScopeProductWrite = "product:write"
+	// ScopeImagesWrite writes back processed images and their status
+	ScopeImagesWrite = "images:write"
+	// ScopeAdmin grants everything, including users, webhooks and API keys
+	ScopeAdmin = "admin"
+)
+
+var apiKeyScopes = []string{ScopeProductRead, ScopeProductWrite, ScopeImagesWrite, ScopeAdmin}
+
+// routeScopes are the scopes an API key needs for the routes, by method and
+// path template. Routes missing here need ScopeAdmin.
+var routeScopes = map[string]string{
+	"GET /product":                                     ScopeProductRead,
+	"GET /product/{id}":                                ScopeProductRead,
+	"GET /product/{id}/status":                         ScopeProductRead,
+	"GET /product/{id}/events":                         ScopeProductRead,
+	"GET /product/{id}/images/{n:[0-9]+}":              ScopeProductRead,
+	"HEAD /product/{id}/images/{n:[0-9]+}":             ScopeProductRead,
+	"GET /product/{id}/images/{n:[0-9]+}/{rendition}":  ScopeProductRead,
+	"HEAD /product/{id}/images/{n:[0-9]+}/{rendition}": ScopeProductRead,
+	"GET /events":                                      ScopeProductRead,
+	"GET /user/{id}/products":                          ScopeProductRead,
+	"POST /product":                                    ScopeProductWrite,
+	"POST /product/bulk":                               ScopeProductWrite,
+	"PATCH /product/{id}":                              ScopeProductWrite,
+	"DELETE /product/{id}":                             ScopeProductWrite,
+	"POST /product/{id}/images":                        ScopeProductWrite,
+	"PUT /product/{id}/compressed-images":              ScopeImagesWrite,
+	"POST /product/{id}/status":                        ScopeImagesWrite,
+}
+
+const (
+	// apiKeyPrefix starts every API key, which tells them from JWTs
+	apiKeyPrefix = "mqk_"
+	// maxAPIKeyGrace bounds how long a rotated key keeps working
+	maxAPIKeyGrace = 7 * 24 * time.Hour
+)
+
+// APIKey is a credential of a machine client. Key, the secret itself, is
+// only returned when the key is created or rotated; the database keeps its
+// hash. Prefix is the public part of the key that identifies it. A key with
+// a UserID acts only for that user; a key without one acts for every user,
+// like an admin within its scopes.
+type APIKey struct {
+	ID         int64      `json:"id"`
+	Name       string     `json:"name"`
+	UserID     *int64     `json:"user_id,omitempty"`
+	Prefix     string     `json:"prefix"`
+	Key        string     `json:"key,omitempty"`
+	Hash       string     `json:"-"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// HasScope reports whether the key grants scope.
+func (k APIKey) HasScope(scope string) bool {
+	return contains(k.Scopes, ScopeAdmin) || contains(k.Scopes, scope)
+}
+
+// Active reports whether the key is accepted at t.
+func (k APIKey) Active(t time.Time) bool {
+	return (k.ExpiresAt == nil || t.Before(*k.ExpiresAt)) && (k.RevokedAt == nil || t.Before(*k.RevokedAt))
+}
+
+type CreateAPIKeyParams struct {
+	Name      string     `json:"name"`
+	UserID    *int64     `json:"user_id"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	Prefix    string     `json:"-"`
+	Hash      string     `json:"-"`
+}
+
+// RotateAPIKeyParams replaces key ID by a key with the same name, owner,
+// scopes and expiry; the old key keeps working for Grace.
+type RotateAPIKeyParams struct {
+	ID     int           `json:"-"`
+	Grace  time.Duration `json:"-"`
+	Prefix string        `json:"-"`
+	Hash   string        `json:"-"`
+}
+
+const (
+	apiKeyColumns = `id,name,user_id,prefix,hash,scopes,created_at,expires_at,last_used_at,revoked_at`
+
+	createAPIKeyQuery = `
+	INSERT INTO api_keys (
+	name, user_id, prefix, hash, scopes, expires_at
+	) VALUES (
+	$1, $2, $3, $4, $5, $6
+	)
+	RETURNING ` + apiKeyColumns + `
+	`
+
+	getAPIKeyByPrefixQuery = `
+	SELECT ` + apiKeyColumns + ` FROM api_keys WHERE
+	prefix = $1
+	`
+
+	listAPIKeysQuery = `
+	SELECT ` + apiKeyColumns + ` FROM api_keys
+	ORDER BY id
+	`
+
+	// revokeAPIKeyQuery revokes key $1 at $2, or keeps an earlier revocation
+	revokeAPIKeyQuery = `
+	UPDATE api_keys
+	SET revoked_at = LEAST(COALESCE(revoked_at, $2), $2)
+	WHERE id = $1
+	RETURNING ` + apiKeyColumns + `
+	`
+
+	// lockActiveAPIKeyQuery reads key $1 for a rotation unless it is revoked
+	lockActiveAPIKeyQuery = `
+	SELECT ` + apiKeyColumns + ` FROM api_keys WHERE
+	id = $1 AND (revoked_at IS NULL OR revoked_at > NOW())
+	FOR UPDATE
+	`
+
+	// touchAPIKeyQuery records a use of key $1, at most once a minute
+	touchAPIKeyQuery = `
+	UPDATE api_keys
+	SET last_used_at = NOW()
+	WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')
+	`
+)
+
+func scanAPIKey(row rowScanner) (APIKey, error) {
+	var k APIKey
+	var userID sql.NullInt64
+	var expiresAt, lastUsedAt, revokedAt sql.NullTime
+	err := row.Scan(
+		&k.ID,
+		&k.Name,
+		&userID,
+		&k.Prefix,
+		&k.Hash,
+		pq.Array(&k.Scopes),
+		&k.CreatedAt,
+		&expiresAt,
+		&lastUsedAt,
+		&revokedAt,
+	)
+	if err != nil {
+		return APIKey{}, err
+	}
+	if userID.Valid {
+		k.UserID = &userID.Int64
+	}
+	if expiresAt.Valid {
+		k.ExpiresAt = &expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		k.LastUsedAt = &lastUsedAt.Time
+	}
+	if revokedAt.Valid {
+		k.RevokedAt = &revokedAt.Time
+	}
+	return k, nil
+}
+
+func (s *PostgresStore) CreateAPIKey(arg CreateAPIKeyParams) (APIKey, error) {
+	return scanAPIKey(s.db.QueryRow(createAPIKeyQuery, arg.Name, arg.UserID, arg.Prefix, arg.Hash, pq.Array(arg.Scopes), arg.ExpiresAt))
+}
+
+func (s *PostgresStore) GetAPIKeyByPrefix(prefix string) (APIKey, error) {
+	return scanAPIKey(s.db.QueryRow(getAPIKeyByPrefixQuery, prefix))
+}
+
+func (s *PostgresStore) ListAPIKeys() ([]APIKey, error) {
+	rows, err := s.db.Query(listAPIKeysQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func (s *PostgresStore) RevokeAPIKey(id int, at time.Time) (APIKey, error) {
+	return scanAPIKey(s.db.QueryRow(revokeAPIKeyQuery, id, at))
+}
+
+// RotateAPIKey creates the replacement of an active key and revokes the key
+// after the grace period. It returns sql.ErrNoRows for unknown or revoked
+// keys.
+func (s *PostgresStore) RotateAPIKey(arg RotateAPIKeyParams) (APIKey, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return APIKey{}, err
+	}
+	defer tx.Rollback()
+
+	old, err := scanAPIKey(tx.QueryRow(lockActiveAPIKeyQuery, arg.ID))
+	if err != nil {
+		return APIKey{}, err
+	}
+	key, err := scanAPIKey(tx.QueryRow(createAPIKeyQuery, old.Name, old.UserID, arg.Prefix, arg.Hash, pq.Array(old.Scopes), old.ExpiresAt))
+	if err != nil {
+		return APIKey{}, err
+	}
+	if _, err := tx.Exec(revokeAPIKeyQuery, arg.ID, time.Now().Add(arg.Grace)); err != nil {
+		return APIKey{}, err
+	}
+	return key, tx.Commit()
+}
+
+func (s *PostgresStore) TouchAPIKey(id int64) error {
+	_, err := s.db.Exec(touchAPIKeyQuery, id)
+	return err
+}
+
+// newAPIKey returns a new key, its prefix and the hash stored for it.
+func newAPIKey() (key, prefix, hash string) {
+	b := make([]byte, 6+32)
+	rand.Read(b)
+	prefix = apiKeyPrefix + hex.EncodeToString(b[:6])
+	key = prefix + "_" + hex.EncodeToString(b[6:])
+	return key, prefix, hashAPIKey(key)
+}
+
+// hashAPIKey is the stored hash of a key. Keys are random, so a plain
+// digest cannot be reversed by guessing.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiKeyPrefixOf is the prefix of a key, or "" if key is not an API key.
+func apiKeyPrefixOf(key string) string {
+	rest, ok := strings.CutPrefix(key, apiKeyPrefix)
+	if !ok {
+		return ""
+	}
+	prefix, secret, ok := strings.Cut(rest, "_")
+	if !ok || prefix == "" || secret == "" {
+		return ""
+	}
+	return apiKeyPrefix + prefix
+}
+
+// requiredScope is the scope an API key needs for the route of r.
+func requiredScope(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if tmpl, err := route.GetPathTemplate(); err == nil {
+			if scope, ok := routeScopes[r.Method+" "+tmpl]; ok {
+				return scope
+			}
+		}
+	}
+	return ScopeAdmin
+}
+
+// authenticateAPIKeys is the router middleware that authenticates requests
+// bearing an API key and checks that the key has the scope of the route.
+// Unknown keys are counted against the address of the caller, which is
+// checked before every lookup, so that keys cannot be guessed faster than
+// the rate limit.
+// The caller is then an admin for keys with ScopeAdmin, else RoleAPIKey,
+// acting for the owner of the key, if any. Requests without an API key are
+// left to the handlers.
+func (s *APIServer) authenticateAPIKeys(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scheme, raw, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		raw = strings.TrimSpace(raw)
+		if !strings.EqualFold(scheme, "Bearer") || !strings.HasPrefix(raw, apiKeyPrefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		failures := "apikey-failures:" + remoteHost(r)
+		if s.limiter != nil {
+			if wait := s.limiter.Wait(failures); wait > 0 {
+				tooManyRequests(w, wait)
+				return
+			}
+		}
+		key, err := s.lookupAPIKey(raw)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				if s.limiter != nil {
+					s.limiter.Allow(failures)
+				}
+				unauthenticated(w, "invalid, expired or revoked API key")
+				return
+			}
+			writeError(w, err)
+			return
+		}
+		scope := requiredScope(r)
+		if !key.HasScope(scope) {
+			WriteProblem(w, forbidden("API key lacks the "+scope+" scope"))
+			return
+		}
+		if err := s.store.TouchAPIKey(key.ID); err != nil {
+			log.Printf("api key %d: %s", key.ID, err)
+		}
+
+		principal := Principal{Subject: "apikey:" + strconv.FormatInt(key.ID, 10), Role: RoleAPIKey, Scopes: key.Scopes}
+		if key.UserID != nil {
+			principal.UserID = int(*key.UserID)
+		}
+		if contains(key.Scopes, ScopeAdmin) {
+			principal.Role = RoleAdmin
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, principal)))
+	})
+}
+
+// lookupAPIKey returns the active key raw, or sql.ErrNoRows.
+func (s *APIServer) lookupAPIKey(raw string) (APIKey, error) {
+	prefix := apiKeyPrefixOf(raw)
+	if prefix == "" {
+		return APIKey{}, sql.ErrNoRows
+	}
+	key, err := s.store.GetAPIKeyByPrefix(prefix)
+	if err != nil {
+		return APIKey{}, err
+	}
+	if subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hashAPIKey(raw))) != 1 || !key.Active(time.Now()) {
+		return APIKey{}, sql.ErrNoRows
+	}
+	return key, nil
+}
+
+func validateAPIKey(params *CreateAPIKeyParams) error {
+	var errs FieldErrors
+	if name := strings.TrimSpace(params.Name); name == "" || len(name) > 100 {
+		errs = append(errs, fieldError("name", FieldRequired, "must be 1 to 100 characters"))
+	}
+	if params.UserID != nil && *params.UserID < 1 {
+		errs = append(errs, fieldError("user_id", FieldInvalid, "must be a user id"))
+	}
+	if len(params.Scopes) == 0 {
+		errs = append(errs, fieldError("scopes", FieldRequired, "is required"))
+	}
+	if params.UserID != nil && contains(params.Scopes, ScopeAdmin) {
+		errs = append(errs, fieldError("scopes", FieldInvalid, "an admin key cannot have an owner"))
+	}
+	for i, scope := range params.Scopes {
+		if !contains(apiKeyScopes, scope) {
+			errs = append(errs, fieldError("scopes["+strconv.Itoa(i)+"]", FieldInvalid, "must be one of %s", strings.Join(apiKeyScopes, ", ")))
+		}
+	}
+	if params.ExpiresAt != nil && !params.ExpiresAt.After(time.Now()) {
+		errs = append(errs, fieldError("expires_at", FieldOutOfRange, "must be in the future"))
+	}
+	if errs != nil {
+		return errs
+	}
+	return nil
+}
+
+func (s *APIServer) handleCreateAPIKey(w http.ResponseWriter, r *http.Request) error {
+
+	var params CreateAPIKeyParams
+	if err := decodePayload(r.Body, &params); err != nil {
+		return writeError(w, err)
+	}
+	if err := validateAPIKey(&params); err != nil {
+		return writeError(w, err)
+	}
+
+	var raw string
+	raw, params.Prefix, params.Hash = newAPIKey()
+	key, err := s.store.CreateAPIKey(params)
+	if err != nil {
+		if isForeignKeyViolation(err) {
+			return writeError(w, fieldError("user_id", FieldNotFound, "user id not found"))
+		}
+		return writeError(w, err)
+	}
+	key.Key = raw
+
+	return WriteJSON(w, http.StatusCreated, key)
+}
+
+func (s *APIServer) handleListAPIKeys(w http.ResponseWriter, r *http.Request) error {
+
+	keys, err := s.store.ListAPIKeys()
+	if err != nil {
+		return writeError(w, err)
+	}
+
+	return WriteJSON(w, http.StatusOK, keys)
+}
+
+func (s *APIServer) handleRevokeAPIKey(w http.ResponseWriter, r *http.Request) error {
+
+	keyId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return WriteProblem(w, invalidID("API key"))
+	}
+
+	if _, err := s.store.RevokeAPIKey(keyId, time.Now()); err != nil {
+		if err == sql.ErrNoRows {
+			return WriteProblem(w, apiKeyNotFound())
+		}
+		return writeError(w, err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// handleRotateAPIKey replaces a key by a new one with the same name and
+// scopes. The old key stops working at once, or after ?grace=, a duration
+// of at most a week, so that clients can switch over.
+func (s *APIServer) handleRotateAPIKey(w http.ResponseWriter, r *http.Request) error {
+
+	keyId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return WriteProblem(w, invalidID("API key"))
+	}
+
+	params := RotateAPIKeyParams{ID: keyId}
+	if v := r.URL.Query().Get("grace"); v != "" {
+		params.Grace, err = time.ParseDuration(v)
+		if err != nil || params.Grace < 0 || params.Grace > maxAPIKeyGrace {
+			return WriteProblem(w, parameterProblem(fieldError("grace", FieldInvalid, "must be a duration of at most %s", maxAPIKeyGrace)))
+		}
+	}
+
+	var raw string
+	raw, params.Prefix, params.Hash = newAPIKey()
+	key, err := s.store.RotateAPIKey(params)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return WriteProblem(w, apiKeyNotFound())
+		}
+		return writeError(w, err)
+	}
+	key.Key = raw
+
+	return WriteJSON(w, http.StatusCreated, key)
+}
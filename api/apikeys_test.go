@@ -0,0 +1,276 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_APIKey_Format(t *testing.T) {
+	key, prefix, hash := newAPIKey()
+	assert.True(t, strings.HasPrefix(key, prefix+"_"))
+	assert.Equal(t, prefix, apiKeyPrefixOf(key))
+	assert.Equal(t, hash, hashAPIKey(key))
+	assert.NotContains(t, hash, key)
+
+	other, _, _ := newAPIKey()
+	assert.NotEqual(t, key, other)
+
+	for _, bad := range []string{"", "mqk_", "mqk_abc", "mqk__secret", "abc_def_ghi"} {
+		assert.Empty(t, apiKeyPrefixOf(bad), bad)
+	}
+
+	now := time.Now()
+	past, future := now.Add(-time.Minute), now.Add(time.Minute)
+	assert.True(t, APIKey{}.Active(now))
+	assert.True(t, APIKey{RevokedAt: &future}.Active(now))
+	assert.False(t, APIKey{RevokedAt: &past}.Active(now))
+	assert.False(t, APIKey{ExpiresAt: &past}.Active(now))
+
+	assert.True(t, APIKey{Scopes: []string{ScopeProductRead}}.HasScope(ScopeProductRead))
+	assert.False(t, APIKey{Scopes: []string{ScopeProductRead}}.HasScope(ScopeProductWrite))
+	assert.True(t, APIKey{Scopes: []string{ScopeAdmin}}.HasScope(ScopeImagesWrite))
+}
+
+func Test_APIKey_RouteScopes(t *testing.T) {
+	routes := map[string]bool{}
+	(&APIServer{}).routes().Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		tmpl, _ := route.GetPathTemplate()
+		methods, _ := route.GetMethods()
+		for _, method := range methods {
+			routes[method+" "+tmpl] = true
+		}
+		return nil
+	})
+
+	for route := range routeScopes {
+		assert.True(t, routes[route], "scope of unknown route %s", route)
+	}
+	// only the management of users, webhooks and keys needs the admin scope
+	for route := range routes {
+		_, path, _ := strings.Cut(route, " ")
+		admin := strings.HasPrefix(path, "/webhook") || strings.HasPrefix(path, "/apikey") ||
+			strings.HasPrefix(path, "/user") && path != "/user/{id}/products"
+		_, scoped := routeScopes[route]
+		assert.Equal(t, admin, !scoped, route)
+	}
+}
+
+// apiKeyStore serves API keys from memory; other calls are not expected.
+type apiKeyStore struct {
+	Storage
+	keys map[string]APIKey
+}
+
+func (s *apiKeyStore) GetAPIKeyByPrefix(prefix string) (APIKey, error) {
+	key, ok := s.keys[prefix]
+	if !ok {
+		return APIKey{}, sql.ErrNoRows
+	}
+	return key, nil
+}
+
+func (s *apiKeyStore) TouchAPIKey(id int64) error {
+	return nil
+}
+
+func Test_APIKey_Middleware(t *testing.T) {
+	store := &apiKeyStore{keys: map[string]APIKey{}}
+	addKey := func(id int64, scopes []string, revokedAt *time.Time) string {
+		raw, prefix, hash := newAPIKey()
+		store.keys[prefix] = APIKey{ID: id, Prefix: prefix, Hash: hash, Scopes: scopes, RevokedAt: revokedAt}
+		return raw
+	}
+	past := time.Now().Add(-time.Minute)
+	reader := addKey(1, []string{ScopeProductRead}, nil)
+	consumer := addKey(2, []string{ScopeImagesWrite}, nil)
+	admin := addKey(3, []string{ScopeAdmin}, nil)
+	revoked := addKey(4, []string{ScopeAdmin}, &past)
+	owner := int64(17)
+	owned := addKey(5, []string{ScopeProductRead, ScopeImagesWrite}, nil)
+	for prefix, key := range store.keys {
+		if key.ID == 5 {
+			key.UserID = &owner
+			store.keys[prefix] = key
+		}
+	}
+	forged := reader[:len(reader)-4] + "0000"
+
+	s := &APIServer{store: store}
+	router := mux.NewRouter()
+	whoami := func(w http.ResponseWriter, r *http.Request) error {
+		return WriteJSON(w, http.StatusOK, principalOf(r))
+	}
+	router.HandleFunc("/product/{id}", makeHTTPHandleFunc(whoami)).Methods("GET")
+	router.HandleFunc("/product/{id}/compressed-images", makeHTTPHandleFunc(s.requireRole(whoami, RoleService))).Methods("PUT")
+	router.HandleFunc("/user", makeHTTPHandleFunc(s.requireRole(whoami, RoleAdmin))).Methods("POST")
+	router.Use(s.authenticateAPIKeys)
+
+	for _, tc := range []struct {
+		method, path, key string
+		status            int
+		role              string
+		userID            int
+	}{
+		{"GET", "/product/1", "", http.StatusOK, "", 0},
+		{"GET", "/product/1", reader, http.StatusOK, RoleAPIKey, 0},
+		{"GET", "/product/1", consumer, http.StatusForbidden, "", 0},
+		{"GET", "/product/1", owned, http.StatusOK, RoleAPIKey, 17},
+		{"PUT", "/product/1/compressed-images", consumer, http.StatusOK, RoleAPIKey, 0},
+		{"PUT", "/product/1/compressed-images", reader, http.StatusForbidden, "", 0},
+		{"POST", "/user", consumer, http.StatusForbidden, "", 0},
+		{"POST", "/user", admin, http.StatusOK, RoleAdmin, 0},
+		{"POST", "/user", revoked, http.StatusUnauthorized, "", 0},
+		{"GET", "/product/1", forged, http.StatusUnauthorized, "", 0},
+		{"GET", "/product/1", "mqk_unknown_key", http.StatusUnauthorized, "", 0},
+	} {
+		r := httptest.NewRequest(tc.method, tc.path, nil)
+		if tc.key != "" {
+			r.Header.Set("Authorization", "Bearer "+tc.key)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		assert.Equal(t, tc.status, w.Code, tc.method+" "+tc.path)
+		if tc.role != "" {
+			var p Principal
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &p))
+			assert.Equal(t, tc.role, p.Role)
+			assert.Equal(t, tc.userID, p.UserID)
+		}
+	}
+}
+
+func Test_APIKey_FailuresRateLimited(t *testing.T) {
+	store := &apiKeyStore{keys: map[string]APIKey{}}
+	raw, prefix, hash := newAPIKey()
+	store.keys[prefix] = APIKey{ID: 1, Prefix: prefix, Hash: hash, Scopes: []string{ScopeProductRead}}
+	s := &APIServer{store: store, limiter: NewRateLimiter(1, 2)}
+	router := mux.NewRouter()
+	router.HandleFunc("/product/{id}", func(w http.ResponseWriter, r *http.Request) {}).Methods("GET")
+	router.Use(s.authenticateAPIKeys, s.rateLimit)
+
+	get := func(remoteAddr, key string) int {
+		r := httptest.NewRequest("GET", "/product/1", nil)
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("Authorization", "Bearer "+key)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	forged := raw[:len(raw)-4] + "0000"
+	assert.Equal(t, http.StatusUnauthorized, get("10.0.0.1:1000", forged))
+	assert.Equal(t, http.StatusUnauthorized, get("10.0.0.1:1000", "mqk_unknown_key"))
+	// further guesses are refused before the key is looked up
+	assert.Equal(t, http.StatusTooManyRequests, get("10.0.0.1:1000", forged))
+	assert.Equal(t, http.StatusTooManyRequests, get("10.0.0.1:1000", raw))
+	// other addresses and valid keys elsewhere are not affected
+	assert.Equal(t, http.StatusUnauthorized, get("10.0.0.2:1000", forged))
+	assert.Equal(t, http.StatusOK, get("10.0.0.3:1000", raw))
+}
+
+func Test_API_APIKeys(t *testing.T) {
+	writer := makeRequest("POST", "/apikey", []byte(`{"name":"producer","scopes":["product:write","product:read"]}`))
+	assert.Equal(t, http.StatusCreated, writer.Code)
+	var key APIKey
+	assert.NoError(t, json.Unmarshal(writer.Body.Bytes(), &key))
+	assert.True(t, strings.HasPrefix(key.Key, key.Prefix+"_"))
+	as := func(raw string) map[string]string {
+		return map[string]string{"Authorization": "Bearer " + raw}
+	}
+
+	// the key creates products of any user, but is no admin
+	product := []byte(`{"name":"keyed","description":"d","price":"10","user_id":17}`)
+	writer = makeRequestWithHeaders("POST", "/product", product, as(key.Key))
+	assert.Equal(t, http.StatusCreated, writer.Code)
+	writer = makeRequestWithHeaders("PUT", "/product/1/compressed-images", []byte(`{"images":["./a"]}`), as(key.Key))
+	assert.Equal(t, http.StatusForbidden, writer.Code)
+	writer = makeRequestWithHeaders("GET", "/apikey", nil, as(key.Key))
+	assert.Equal(t, http.StatusForbidden, writer.Code)
+
+	// a key with an owner acts only for that user
+	writer = makeRequest("POST", "/apikey", []byte(`{"name":"shop","user_id":17,"scopes":["product:write"]}`))
+	assert.Equal(t, http.StatusCreated, writer.Code)
+	var owned APIKey
+	assert.NoError(t, json.Unmarshal(writer.Body.Bytes(), &owned))
+	assert.Equal(t, int64(17), *owned.UserID)
+	writer = makeRequestWithHeaders("POST", "/product", product, as(owned.Key))
+	assert.Equal(t, http.StatusCreated, writer.Code)
+	var keyed Product
+	assert.NoError(t, json.Unmarshal(writer.Body.Bytes(), &keyed))
+	other := []byte(`{"name":"keyed","description":"d","price":"10","user_id":18}`)
+	writer = makeRequestWithHeaders("POST", "/product", other, as(owned.Key))
+	assert.Equal(t, http.StatusForbidden, writer.Code)
+	writer = makeRequest("POST", "/product", other)
+	assert.Equal(t, http.StatusCreated, writer.Code)
+	var foreign Product
+	assert.NoError(t, json.Unmarshal(writer.Body.Bytes(), &foreign))
+	writer = makeRequestWithHeaders("PATCH", "/product/"+strconv.FormatInt(foreign.ID, 10), []byte(`{"name":"mine"}`), as(owned.Key))
+	assert.Equal(t, http.StatusForbidden, writer.Code)
+	writer = makeRequestWithHeaders("PATCH", "/product/"+strconv.FormatInt(keyed.ID, 10), []byte(`{"name":"mine"}`), as(owned.Key))
+	assert.Equal(t, http.StatusOK, writer.Code)
+
+	// listed without the secret
+	writer = makeRequest("GET", "/apikey", nil)
+	assert.Equal(t, http.StatusOK, writer.Code)
+	assert.Contains(t, writer.Body.String(), key.Prefix)
+	assert.NotContains(t, writer.Body.String(), key.Key)
+	assert.Contains(t, writer.Body.String(), `"last_used_at"`)
+
+	// a rotated key works during the grace period
+	id := strconv.FormatInt(key.ID, 10)
+	writer = makeRequest("POST", "/apikey/"+id+"/rotate?grace=1h", nil)
+	assert.Equal(t, http.StatusCreated, writer.Code)
+	var rotated APIKey
+	assert.NoError(t, json.Unmarshal(writer.Body.Bytes(), &rotated))
+	assert.Equal(t, key.Scopes, rotated.Scopes)
+	assert.NotEqual(t, key.Key, rotated.Key)
+	writer = makeRequestWithHeaders("GET", "/product", nil, as(key.Key))
+	assert.Equal(t, http.StatusOK, writer.Code)
+
+	writer = makeRequest("DELETE", "/apikey/"+id, nil)
+	assert.Equal(t, http.StatusNoContent, writer.Code)
+	writer = makeRequestWithHeaders("GET", "/product", nil, as(key.Key))
+	assert.Equal(t, http.StatusUnauthorized, writer.Code)
+	writer = makeRequestWithHeaders("GET", "/product", nil, as(rotated.Key))
+	assert.Equal(t, http.StatusOK, writer.Code)
+
+	// rotating a key does not extend its lifetime
+	expiresAt := time.Now().Add(48 * time.Hour).UTC().Truncate(time.Second)
+	writer = makeRequest("POST", "/apikey", []byte(`{"name":"expiring","scopes":["product:read"],"expires_at":"`+expiresAt.Format(time.RFC3339)+`"}`))
+	assert.Equal(t, http.StatusCreated, writer.Code)
+	var expiring APIKey
+	assert.NoError(t, json.Unmarshal(writer.Body.Bytes(), &expiring))
+	writer = makeRequest("POST", "/apikey/"+strconv.FormatInt(expiring.ID, 10)+"/rotate", nil)
+	assert.Equal(t, http.StatusCreated, writer.Code)
+	var rotatedExpiring APIKey
+	assert.NoError(t, json.Unmarshal(writer.Body.Bytes(), &rotatedExpiring))
+	if assert.NotNil(t, rotatedExpiring.ExpiresAt) {
+		assert.True(t, expiresAt.Equal(*rotatedExpiring.ExpiresAt), rotatedExpiring.ExpiresAt)
+	}
+
+	for _, bad := range []string{
+		`{"name":"","scopes":["product:read"]}`,
+		`{"name":"x","scopes":[]}`,
+		`{"name":"x","scopes":["everything"]}`,
+		`{"name":"x","scopes":["product:read"],"expires_at":"2000-01-01T00:00:00Z"}`,
+		`{"name":"x","user_id":0,"scopes":["product:read"]}`,
+		`{"name":"x","user_id":1000000,"scopes":["product:read"]}`,
+		`{"name":"x","user_id":17,"scopes":["admin"]}`,
+	} {
+		writer = makeRequest("POST", "/apikey", []byte(bad))
+		assert.Equal(t, http.StatusUnprocessableEntity, writer.Code, bad)
+	}
+	writer = makeRequest("POST", "/apikey/"+id+"/rotate?grace=1000h", nil)
+	assert.Equal(t, http.StatusBadRequest, writer.Code)
+	writer = makeRequest("POST", "/apikey/1000000/rotate", nil)
+	assert.Equal(t, http.StatusNotFound, writer.Code)
+}
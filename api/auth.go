@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arjun/go-message-queue-api/auth"
+)
+
+// Roles of a token. A user acts for the user whose id is the token subject;
+// the service role is the consumer writing back the results of image
+// processing; an admin may do anything. RoleAPIKey is the caller of an API
+// key, whose scopes were checked for the route by authenticateAPIKeys, and
+// which acts for its owner, or for every user if it has none.
+const (
+	RoleUser    = "user"
+	RoleService = "service"
+	RoleAdmin   = "admin"
+	RoleAPIKey  = "api_key"
+)
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	Subject string
+	Role    string
+	// UserID is the user a user token or an owned API key acts for
+	UserID int
+	// Scopes are the scopes of an API key
+	Scopes []string
+}
+
+// CanActFor reports whether p may create and change the products of, and
+// change, the user userID. API keys without an owner may act for any user.
+func (p Principal) CanActFor(userID int) bool {
+	switch p.Role {
+	case RoleAdmin:
+		return true
+	case RoleAPIKey:
+		return p.UserID == 0 || p.UserID == userID
+	case RoleUser:
+		return p.UserID == userID
+	}
+	return false
+}
+
+// roleScopes are the scopes with which an API key stands in for a role.
+var roleScopes = map[string]string{
+	RoleService: ScopeImagesWrite,
+}
+
+// hasRole reports whether p has one of roles, is an admin, or is an API key
+// with the scope of one of roles.
+func (p Principal) hasRole(roles []string) bool {
+	if p.Role == RoleAdmin || contains(roles, p.Role) {
+		return true
+	}
+	if p.Role != RoleAPIKey {
+		return false
+	}
+	for _, role := range roles {
+		if scope, ok := roleScopes[role]; ok && contains(p.Scopes, scope) {
+			return true
+		}
+	}
+	return false
+}
+
+type principalKey struct{}
+
+// principalOf is the caller authenticated by authenticate.
+func principalOf(r *http.Request) Principal {
+	p, _ := r.Context().Value(principalKey{}).(Principal)
+	return p
+}
+
+// principalFor maps the claims of a verified token to a caller. Tokens
+// without a role are user tokens.
+func principalFor(claims *auth.Claims) (Principal, error) {
+	p := Principal{Subject: claims.Subject, Role: claims.Role}
+	switch p.Role {
+	case "", RoleUser:
+		p.Role = RoleUser
+		id, err := strconv.Atoi(claims.Subject)
+		if err != nil || id < 1 {
+			return Principal{}, errors.New("subject of a user token must be a user id")
+		}
+		p.UserID = id
+	case RoleService, RoleAdmin:
+	default:
+		return Principal{}, errors.New("unknown role " + strconv.Quote(p.Role))
+	}
+	return p, nil
+}
+
+func unauthenticated(w http.ResponseWriter, detail string) error {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="products"`)
+	return WriteProblem(w, NewProblem(http.StatusUnauthorized, CodeUnauthenticated, detail))
+}
+
+func forbidden(detail string) *Problem {
+	return NewProblem(http.StatusForbidden, CodeForbidden, detail)
+}
+
+// authenticate makes a handler require a valid bearer token, whose caller
+// the handler finds with principalOf. Callers already authenticated by an
+// API key, or by a token identify verified, pass.
+func (s *APIServer) authenticate(f apiFunc) apiFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+
+		if principalOf(r).Subject != "" {
+			return f(w, r)
+		}
+		if s.verifier == nil {
+			return unauthenticated(w, "authentication is not configured")
+		}
+		principal, err := s.bearerPrincipal(r)
+		if err != nil {
+			return unauthenticated(w, err.Error())
+		}
+
+		return f(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, principal)))
+	}
+}
+
+// bearerPrincipal verifies the bearer token of r and returns its caller.
+func (s *APIServer) bearerPrincipal(r *http.Request) (Principal, error) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return Principal{}, errors.New("a bearer token is required")
+	}
+	claims, err := s.verifier.Verify(strings.TrimSpace(token))
+	if err != nil {
+		return Principal{}, err
+	}
+	return principalFor(claims)
+}
+
+// requireRole makes a handler require a token of one of roles, or of an
+// admin, or an API key with the scope of one of roles.
+func (s *APIServer) requireRole(f apiFunc, roles ...string) apiFunc {
+	return s.authenticate(func(w http.ResponseWriter, r *http.Request) error {
+		if !principalOf(r).hasRole(roles) {
+			return WriteProblem(w, forbidden("requires the "+strings.Join(roles, " or ")+" role"))
+		}
+		return f(w, r)
+	})
+}
+
+// authorizeProduct returns the product with id if the caller may change it.
+func (s *APIServer) authorizeProduct(r *http.Request, id int) (Product, error) {
+	product, err := s.store.GetProduct(id)
+	if err == sql.ErrNoRows {
+		return Product{}, productNotFound()
+	}
+	if err != nil {
+		return Product{}, err
+	}
+	if !principalOf(r).CanActFor(int(product.UserID)) {
+		return Product{}, forbidden("product belongs to another user")
+	}
+	return product, nil
+}
+
+// issueToken signs a token for who, a user id or the service or admin role,
+// valid for ttl.
+func issueToken(keys *auth.KeySet, who, issuer, audience string, ttl time.Duration) (string, error) {
+	claims := auth.Claims{
+		Subject:   who,
+		Role:      RoleUser,
+		Issuer:    issuer,
+		IssuedAt:  auth.NewNumericDate(time.Now()),
+		ExpiresAt: auth.NewNumericDate(time.Now().Add(ttl)),
+	}
+	if audience != "" {
+		claims.Audience = auth.Audience{audience}
+	}
+	if who == RoleService || who == RoleAdmin {
+		claims.Role = who
+	}
+	if _, err := principalFor(&claims); err != nil {
+		return "", err
+	}
+	return keys.Sign(claims)
+}
+
+// authorizeUser checks that the caller may see and change the user with id.
+func authorizeUser(r *http.Request, id int) error {
+	if !principalOf(r).CanActFor(id) {
+		return forbidden("not allowed to act for user " + strconv.Itoa(id))
+	}
+	return nil
+}
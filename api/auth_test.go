@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/arjun/go-message-queue-api/auth"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Auth_PrincipalFor(t *testing.T) {
+	p, err := principalFor(&auth.Claims{Subject: "17"})
+	assert.NoError(t, err)
+	assert.Equal(t, Principal{Subject: "17", Role: RoleUser, UserID: 17}, p)
+	assert.True(t, p.CanActFor(17))
+	assert.False(t, p.CanActFor(18))
+
+	p, err = principalFor(&auth.Claims{Subject: "image-consumer", Role: RoleService})
+	assert.NoError(t, err)
+	assert.False(t, p.CanActFor(17))
+
+	p, err = principalFor(&auth.Claims{Subject: "ops", Role: RoleAdmin})
+	assert.NoError(t, err)
+	assert.True(t, p.CanActFor(17))
+
+	// API keys act for their owner, or for everyone without one
+	p = Principal{Subject: "apikey:1", Role: RoleAPIKey, UserID: 17, Scopes: []string{ScopeProductWrite}}
+	assert.True(t, p.CanActFor(17))
+	assert.False(t, p.CanActFor(18))
+	p.UserID = 0
+	assert.True(t, p.CanActFor(18))
+	assert.False(t, p.hasRole([]string{RoleService}))
+	p.Scopes = []string{ScopeImagesWrite}
+	assert.True(t, p.hasRole([]string{RoleService}))
+	assert.False(t, p.hasRole([]string{RoleAdmin}))
+
+	for _, claims := range []auth.Claims{
+		{Subject: "alice"},
+		{Subject: "0", Role: RoleUser},
+		{Subject: "17", Role: "root"},
+	} {
+		_, err := principalFor(&claims)
+		assert.Error(t, err, claims)
+	}
+}
+
+func Test_Auth_Middleware(t *testing.T) {
+	keys := testKeys
+	s := &APIServer{verifier: &auth.Verifier{Keys: keys}}
+	handler := makeHTTPHandleFunc(s.requireRole(func(w http.ResponseWriter, r *http.Request) error {
+		return WriteJSON(w, http.StatusOK, principalOf(r))
+	}, RoleService))
+
+	token := func(who string) string {
+		token, err := issueToken(keys, who, "", "", time.Minute)
+		assert.NoError(t, err)
+		return token
+	}
+	expired, err := keys.Sign(auth.Claims{Subject: "service", Role: RoleService, ExpiresAt: auth.NewNumericDate(time.Now().Add(-time.Hour))})
+	assert.NoError(t, err)
+
+	for header, status := range map[string]int{
+		"":                             http.StatusUnauthorized,
+		"Basic dXNlcjpwYXNz":           http.StatusUnauthorized,
+		"Bearer not-a-token":           http.StatusUnauthorized,
+		"Bearer " + expired:            http.StatusUnauthorized,
+		"Bearer " + token("17"):        http.StatusForbidden,
+		"Bearer " + token(RoleService): http.StatusOK,
+		"bearer " + token(RoleService): http.StatusOK,
+		"Bearer " + token(RoleAdmin):   http.StatusOK,
+	} {
+		r := httptest.NewRequest("PUT", "/", nil)
+		if header != "" {
+			r.Header.Set("Authorization", header)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		assert.Equal(t, status, w.Code, header)
+		if status == http.StatusUnauthorized {
+			assert.Contains(t, w.Header().Get("WWW-Authenticate"), "Bearer")
+			assert.Contains(t, w.Body.String(), `"code":"unauthenticated"`)
+		}
+	}
+
+	_, err = issueToken(keys, "alice", "", "", time.Minute)
+	assert.Error(t, err)
+}
+
+func Test_API_Authorization(t *testing.T) {
+	as := func(who string) map[string]string {
+		return map[string]string{"Authorization": "Bearer " + testToken(who)}
+	}
+	product := []byte(`{"name":"owned","description":"d","images":["https://via.placeholder.com/100/1"],"price":"10","user_id":17}`)
+
+	// reads are public, writes need a token
+	writer := makeRequestWithHeaders("POST", "/product", product, map[string]string{"Authorization": ""})
+	assert.Equal(t, http.StatusUnauthorized, writer.Code)
+	writer = makeRequestWithHeaders("POST", "/product", product, as("18"))
+	assert.Equal(t, http.StatusForbidden, writer.Code)
+	writer = makeRequestWithHeaders("POST", "/product", product, as(RoleService))
+	assert.Equal(t, http.StatusForbidden, writer.Code)
+	writer = makeRequestWithHeaders("POST", "/product", product, as("17"))
+	productId := createdProductID(t, writer)
+	writer = makeRequestWithHeaders("GET", "/product/"+productId, nil, map[string]string{"Authorization": ""})
+	assert.Equal(t, http.StatusOK, writer.Code)
+
+	// only the owner changes a product
+	etag := writer.Header().Get("ETag")
+	patch := []byte(`{"name":"renamed"}`)
+	writer = makeRequestWithHeaders("PATCH", "/product/"+productId, patch, map[string]string{"Authorization": "Bearer " + testToken("18"), "If-Match": etag})
+	assert.Equal(t, http.StatusForbidden, writer.Code)
+	writer = makeRequestWithHeaders("PATCH", "/product/"+productId, patch, map[string]string{"Authorization": "Bearer " + testToken("17"), "If-Match": etag})
+	assert.Equal(t, http.StatusOK, writer.Code)
+	writer = makeRequestWithHeaders("DELETE", "/product/"+productId, nil, as("18"))
+	assert.Equal(t, http.StatusForbidden, writer.Code)
+
+	// and only the service writes back the compressed images
+	compressed := []byte(`{"images":["./home/path1"],"worker":"worker-1"}`)
+	writer = makeRequestWithHeaders("PUT", "/product/"+productId+"/compressed-images", compressed, as("17"))
+	assert.Equal(t, http.StatusForbidden, writer.Code)
+	writer = makeRequestWithHeaders("PUT", "/product/"+productId+"/compressed-images", compressed, as(RoleService))
+	assert.Equal(t, http.StatusOK, writer.Code)
+	writer = makeRequestWithHeaders("POST", "/product/"+productId+"/status", []byte(`{"state":"processing","worker":"worker-1"}`), as("17"))
+	assert.Equal(t, http.StatusForbidden, writer.Code)
+
+	// a bulk import for another user is refused as a whole
+	bulk := []byte(`[{"name":"a","description":"d","price":"1","user_id":17},{"name":"b","description":"d","price":"1","user_id":18}]`)
+	writer = makeRequestWithHeaders("POST", "/product/bulk", bulk, as("17"))
+	assert.Equal(t, http.StatusForbidden, writer.Code)
+
+	writer = makeRequestWithHeaders("GET", "/webhook?user_id=18", nil, as("17"))
+	assert.Equal(t, http.StatusForbidden, writer.Code)
+	writer = makeRequestWithHeaders("GET", "/user/18", nil, as("17"))
+	assert.Equal(t, http.StatusForbidden, writer.Code)
+	writer = makeRequestWithHeaders("GET", "/user/17", nil, as("17"))
+	assert.NotEqual(t, http.StatusForbidden, writer.Code)
+
+	// idempotency keys are per caller
+	key := "auth-test-key"
+	writer = makeRequestWithHeaders("POST", "/product", product, map[string]string{"Authorization": "Bearer " + testToken("17"), idempotencyHeader: key})
+	assert.Equal(t, http.StatusCreated, writer.Code)
+	writer = makeRequestWithHeaders("POST", "/product", product, map[string]string{"Authorization": "Bearer " + testToken("18"), idempotencyHeader: key})
+	assert.Equal(t, http.StatusForbidden, writer.Code)
+	assert.Empty(t, writer.Header().Get(idempotencyReplayedHeader))
+}
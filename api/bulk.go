@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/lib/pq"
+)
+
+const (
+	BulkAtomic     = "atomic"
+	BulkBestEffort = "best_effort"
+)
+
+// Results of the items of a bulk import.
+const (
+	BulkCreated = "created"
+	// BulkInvalid items failed validation and were not sent to the database
+	BulkInvalid = "invalid"
+	// BulkFailed items were rejected by the database
+	BulkFailed = "failed"
+	// BulkSkipped items were valid but not created because an atomic import
+	// was rolled back
+	BulkSkipped = "skipped"
+)
+
+const (
+	maxBulkBodySize = 64 << 20
+	maxBulkItems    = 100000
+	maxBulkLineSize = 1 << 20
+	// bulkChunkSize is how many products are inserted per statement
+	bulkChunkSize = 1000
+)
+
+// BulkProductResult is the outcome of the item at Index of a bulk import.
+// Errors lists the invalid fields of an item that failed validation.
+type BulkProductResult struct {
+	Index  int          `json:"index"`
+	Status string       `json:"status"`
+	ID     int          `json:"id,omitempty"`
+	Error  string       `json:"error,omitempty"`
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+type BulkProductResponse struct {
+	Mode    string              `json:"mode"`
+	Created int                 `json:"created"`
+	Failed  int                 `json:"failed"`
+	Results []BulkProductResult `json:"results"`
+}
+
+// bulkItem is a decoded item of a bulk import, or the reason it could not be
+// decoded.
+type bulkItem struct {
+	params CreateProductParams
+	err    error
+}
+
+const (
+	// nextProductIdsQuery reserves $1 product ids, so that the products of a
+	// chunk can be inserted together and matched to their items
+	nextProductIdsQuery = `
+	SELECT nextval(pg_get_serial_sequence('products', 'id')) FROM generate_series(1, $1)
+	`
+
+	createProductsQuery = `
+	INSERT INTO products (
+	id, name, description, images, price, user_id
+	)
+	SELECT id, name, description, images, price, user_id
+	FROM jsonb_to_recordset($1) AS p(id bigint, name text, description text, images text[], price numeric, user_id bigint)
+	`
+
+	enqueueProductJobsQuery = `
+	INSERT INTO outbox (
+	topic, payload
+	)
+	SELECT $1, id::text FROM unnest($2::bigint[]) WITH ORDINALITY AS j(id, n)
+	ORDER BY n
+	`
+
+	createProductStatusesQuery = `
+	INSERT INTO product_status (
+	product_id, state, queued_at
+	)
+	SELECT id, 'queued', NOW() FROM unnest($1::bigint[]) AS id
+	RETURNING ` + statusColumns + `
+	`
+
+	insertProductEventsQuery = `
+	INSERT INTO product_events (
+	product_id, user_id, type, data
+	)
+	SELECT p.id, p.user_id, $1, e.data::jsonb
+	FROM unnest($2::bigint[], $3::text[]) WITH ORDINALITY AS e(id, data, n)
+	JOIN products p ON p.id = e.id
+	ORDER BY e.n
+	`
+
+	existingUserIdsQuery = `
+	SELECT id FROM users WHERE id = ANY($1)
+	`
+)
+
+// CheckUserIDs returns which of ids are users.
+func (s *PostgresStore) CheckUserIDs(ids []int) (map[int]bool, error) {
+	rows, err := s.db.Query(existingUserIdsQuery, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	existing := map[int]bool{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		existing[id] = true
+	}
+	return existing, rows.Err()
+}
+
+// CreateProducts inserts products in one transaction, queueing the image jobs
+// like CreateProduct, and returns one result per product in the same order.
+// Chunks are inserted set-wise; a chunk the database rejects is retried one
+// product at a time to find the products at fault. Products the database
+// rejects fail on their own unless atomic is set, in which case nothing is
+// created and the other products are skipped.
+func (s *PostgresStore) CreateProducts(products []CreateProductParams, atomic bool) ([]BulkProductResult, error) {
+	results := make([]BulkProductResult, len(products))
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	failed := false
+	for start := 0; start < len(products); start += bulkChunkSize {
+		end := min(start+bulkChunkSize, len(products))
+
+		ids, err := insertProductChunk(tx, products[start:end])
+		if err == nil {
+			for i, id := range ids {
+				results[start+i] = BulkProductResult{Index: start + i, Status: BulkCreated, ID: id}
+			}
+			continue
+		}
+		if !isProductDataError(err) {
+			return nil, err
+		}
+
+		for i := start; i < end; i++ {
+			ids, err := insertProductChunk(tx, products[i:i+1])
+			if err == nil {
+				results[i] = BulkProductResult{Index: i, Status: BulkCreated, ID: ids[0]}
+				continue
+			}
+			if !isProductDataError(err) {
+				return nil, err
+			}
+			results[i] = BulkProductResult{Index: i, Status: BulkFailed, Error: err.Error()}
+			failed = true
+		}
+	}
+
+	if atomic && failed {
+		for i := range results {
+			if results[i].Status == BulkCreated {
+				results[i] = BulkProductResult{Index: i, Status: BulkSkipped}
+			}
+		}
+		return results, nil
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// insertProductChunk inserts products under a savepoint, so that on error
+// only the chunk is rolled back, and returns their ids.
+func insertProductChunk(tx *sql.Tx, products []CreateProductParams) ([]int, error) {
+	if _, err := tx.Exec("SAVEPOINT bulk_chunk"); err != nil {
+		return nil, err
+	}
+	ids, err := insertProducts(tx, products)
+	if err != nil {
+		if _, rbErr := tx.Exec("ROLLBACK TO SAVEPOINT bulk_chunk"); rbErr != nil {
+			return nil, rbErr
+		}
+		return nil, err
+	}
+	if _, err := tx.Exec("RELEASE SAVEPOINT bulk_chunk"); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func insertProducts(tx *sql.Tx, products []CreateProductParams) ([]int, error) {
+	rows, err := tx.Query(nextProductIdsQuery, len(products))
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int, 0, len(products))
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	type productRow struct {
+		ID int `json:"id"`
+		CreateProductParams
+	}
+	records := make([]productRow, len(products))
+	var queued []int64
+	for i, p := range products {
+		if p.Images == nil {
+			p.Images = []string{}
+		}
+		records[i] = productRow{ID: ids[i], CreateProductParams: p}
+		// products created without images get them later through uploads
+		if len(p.Images) > 0 {
+			queued = append(queued, int64(ids[i]))
+		}
+	}
+	payload, err := json.Marshal(records)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(createProductsQuery, payload); err != nil {
+		return nil, err
+	}
+
+	if len(queued) == 0 {
+		return ids, nil
+	}
+	if _, err := tx.Exec(enqueueProductJobsQuery, productJobTopic, pq.Array(queued)); err != nil {
+		return nil, err
+	}
+	if err := markQueuedNew(tx, queued); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// markQueuedNew is markQueued for many products just created.
+func markQueuedNew(tx *sql.Tx, productIds []int64) error {
+	rows, err := tx.Query(createProductStatusesQuery, pq.Array(productIds))
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	var data []string
+	for rows.Next() {
+		st, err := scanProductStatus(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		payload, err := json.Marshal(st)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, st.ProductID)
+		data = append(data, string(payload))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	_, err = tx.Exec(insertProductEventsQuery, EventStatus, pq.Array(ids), pq.Array(data))
+	return err
+}
+
+// isProductDataError reports whether err is the database rejecting the
+// values of a product, as opposed to a failure of the database itself.
+func isProductDataError(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	if !ok {
+		return false
+	}
+	switch pqErr.Code.Class() {
+	// data exception, integrity constraint violation
+	case "22", "23":
+		return true
+	}
+	return false
+}
+
+// decodeBulkProducts reads the items of a bulk import, an NDJSON stream if
+// contentType says so and a JSON array otherwise. An item that is not a
+// product is returned with its error; a body that cannot be read further is
+// an error.
+func decodeBulkProducts(body io.Reader, contentType string) ([]bulkItem, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "application/x-ndjson", "application/ndjson", "application/jsonl", "application/x-jsonlines":
+		return decodeNDJSONProducts(body)
+	}
+	return decodeJSONArrayProducts(body)
+}
+
+func decodeNDJSONProducts(body io.Reader) ([]bulkItem, error) {
+	var items []bulkItem
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64<<10), maxBulkLineSize)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if len(items) == maxBulkItems {
+			return nil, fmt.Errorf("at most %d products per import", maxBulkItems)
+		}
+		var item bulkItem
+		item.err = decodePayload(bytes.NewReader(line), &item.params)
+		items = append(items, item)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func decodeJSONArrayProducts(body io.Reader) ([]bulkItem, error) {
+	decoder := json.NewDecoder(body)
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return nil, fmt.Errorf("expected a JSON array of products")
+	}
+
+	var items []bulkItem
+	for decoder.More() {
+		if len(items) == maxBulkItems {
+			return nil, fmt.Errorf("at most %d products per import", maxBulkItems)
+		}
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			return nil, err
+		}
+		var item bulkItem
+		item.err = decodePayload(bytes.NewReader(raw), &item.params)
+		items = append(items, item)
+	}
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// handleBulkCreateProducts creates the products of a JSON array or NDJSON
+// body. In the default atomic mode either every product is created or none
+// is; in best_effort mode the valid products are created and the others
+// reported. Results are in the order of the items.
+func (s *APIServer) handleBulkCreateProducts(w http.ResponseWriter, r *http.Request) error {
+
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = BulkAtomic
+	}
+	if mode != BulkAtomic && mode != BulkBestEffort {
+		return WriteProblem(w, parameterProblem(fieldError("mode", FieldInvalid, "must be atomic or best_effort")))
+	}
+
+	items, err := decodeBulkProducts(http.MaxBytesReader(w, r.Body, maxBulkBodySize), r.Header.Get("Content-Type"))
+	if err != nil {
+		var maxBytes *http.MaxBytesError
+		if errors.As(err, &maxBytes) {
+			return writeError(w, err)
+		}
+		return WriteProblem(w, malformedBody(err))
+	}
+	if len(items) == 0 {
+		return WriteProblem(w, NewProblem(http.StatusBadRequest, CodeBadRequest, "no products"))
+	}
+
+	// an import creating products of someone else is refused as a whole
+	principal := principalOf(r)
+	for _, item := range items {
+		if item.err == nil && item.params.UserID != 0 && !principal.CanActFor(item.params.UserID) {
+			return WriteProblem(w, forbidden("not allowed to create products for user "+strconv.Itoa(item.params.UserID)))
+		}
+	}
+
+	response := BulkProductResponse{Mode: mode, Results: make([]BulkProductResult, len(items))}
+	var userIds []int
+	seen := map[int]bool{}
+	for i, item := range items {
+		if item.err == nil {
+			item.err = s.validator.Validate(item.params)
+			items[i].err = item.err
+		}
+		if item.err == nil && !seen[item.params.UserID] {
+			seen[item.params.UserID] = true
+			userIds = append(userIds, item.params.UserID)
+		}
+	}
+	existing, err := s.store.CheckUserIDs(userIds)
+	if err != nil {
+		return writeError(w, err)
+	}
+
+	// valid holds the products to create and indexes their items
+	var valid []CreateProductParams
+	var indexes []int
+	for i, item := range items {
+		if item.err == nil && !existing[item.params.UserID] {
+			item.err = fieldError("user_id", FieldNotFound, "user id not found")
+		}
+		if item.err != nil {
+			p := problemFor(item.err)
+			response.Results[i] = BulkProductResult{Index: i, Status: BulkInvalid, Error: p.Detail, Errors: p.Errors}
+			response.Failed++
+			continue
+		}
+		valid = append(valid, item.params)
+		indexes = append(indexes, i)
+	}
+
+	if mode == BulkAtomic && response.Failed > 0 {
+		for _, i := range indexes {
+			response.Results[i] = BulkProductResult{Index: i, Status: BulkSkipped}
+		}
+		return WriteJSON(w, http.StatusUnprocessableEntity, response)
+	}
+
+	if len(valid) > 0 {
+		// the quota is taken for every valid product and given back for
+		// those not created
+		demands := map[int]quotaDemand{}
+		for _, p := range valid {
+			d := demands[p.UserID]
+			d.products++
+			d.images += len(p.Images)
+			demands[p.UserID] = d
+		}
+		if err := s.consumeQuotas(w, demands); err != nil {
+			return writeError(w, err)
+		}
+
+		results, err := s.store.CreateProducts(valid, mode == BulkAtomic)
+		if err != nil {
+			for userId, d := range demands {
+				s.refundQuota(userId, d.products, d.images)
+			}
+			return writeError(w, err)
+		}
+		refunds := map[int]quotaDemand{}
+		for n, result := range results {
+			result.Index = indexes[n]
+			response.Results[result.Index] = result
+			switch result.Status {
+			case BulkCreated:
+				response.Created++
+				continue
+			case BulkFailed:
+				response.Failed++
+			}
+			p := valid[n]
+			d := refunds[p.UserID]
+			d.products++
+			d.images += len(p.Images)
+			refunds[p.UserID] = d
+		}
+		for userId, d := range refunds {
+			s.refundQuota(userId, d.products, d.images)
+		}
+	}
+
+	switch {
+	case response.Failed == 0:
+		return WriteJSON(w, http.StatusCreated, response)
+	case mode == BulkAtomic:
+		return WriteJSON(w, http.StatusUnprocessableEntity, response)
+	}
+	return WriteJSON(w, http.StatusOK, response)
+}
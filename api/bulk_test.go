@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_API_HandleBulkCreateProducts(t *testing.T) {
+	body := `[
+		{"name":"bulk1","description":"first","images":["https://via.placeholder.com/100/1"],"price":"10.50","user_id":3},
+		{"name":"bulk2","description":"second","price":"20","user_id":4}
+	]`
+	writer := makeRequest("POST", "/product/bulk", []byte(body))
+	assert.Equal(t, http.StatusCreated, writer.Code)
+	var response BulkProductResponse
+	assert.NoError(t, json.Unmarshal(writer.Body.Bytes(), &response))
+	assert.Equal(t, BulkAtomic, response.Mode)
+	assert.Equal(t, 2, response.Created)
+	assert.Equal(t, 0, response.Failed)
+	assert.Len(t, response.Results, 2)
+
+	product, err := testPostgresStore.GetProduct(response.Results[0].ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "bulk1", product.Name)
+	st, err := testPostgresStore.GetProductStatus(response.Results[0].ID)
+	assert.NoError(t, err)
+	assert.Equal(t, StatusQueued, st.State)
+	// products without images are not queued
+	product, err = testPostgresStore.GetProduct(response.Results[1].ID)
+	assert.NoError(t, err)
+	assert.Empty(t, product.Images)
+
+	// atomic: one bad item and nothing is created
+	body = `[
+		{"name":"bulk3","description":"third","price":"30","user_id":5},
+		{"name":"bulk4","description":"fourth","price":"abc","user_id":5},
+		{"name":"bulk5","description":"fifth","price":"50","user_id":1000000}
+	]`
+	writer = makeRequest("POST", "/product/bulk", []byte(body))
+	assert.Equal(t, http.StatusUnprocessableEntity, writer.Code)
+	response = BulkProductResponse{}
+	assert.NoError(t, json.Unmarshal(writer.Body.Bytes(), &response))
+	assert.Equal(t, 0, response.Created)
+	assert.Equal(t, 2, response.Failed)
+	assert.Equal(t, BulkSkipped, response.Results[0].Status)
+	assert.Equal(t, BulkInvalid, response.Results[1].Status)
+	assert.Equal(t, "price", response.Results[1].Errors[0].Field)
+	assert.Equal(t, FieldNotFound, response.Results[2].Errors[0].Code)
+
+	// best effort over NDJSON: the good items are created
+	ndjson := strings.Join([]string{
+		`{"name":"bulk6","description":"sixth","price":"60","user_id":6}`,
+		`{"name":"bulk7",`,
+		``,
+		`{"name":"bulk8","description":"eighth","price":"80","user_id":7}`,
+	}, "\n")
+	writer = makeRequestWithHeaders("POST", "/product/bulk?mode=best_effort", []byte(ndjson), map[string]string{"Content-Type": "application/x-ndjson"})
+	assert.Equal(t, http.StatusOK, writer.Code)
+	response = BulkProductResponse{}
+	assert.NoError(t, json.Unmarshal(writer.Body.Bytes(), &response))
+	assert.Equal(t, BulkBestEffort, response.Mode)
+	assert.Equal(t, 2, response.Created)
+	assert.Equal(t, 1, response.Failed)
+	assert.Equal(t, BulkCreated, response.Results[0].Status)
+	assert.Equal(t, BulkInvalid, response.Results[1].Status)
+	assert.Equal(t, BulkCreated, response.Results[2].Status)
+	assert.NotZero(t, response.Results[2].ID)
+
+	for _, bad := range []string{`{"name":"x"}`, `[{"name":"x"}`, `[]`} {
+		writer = makeRequest("POST", "/product/bulk", []byte(bad))
+		assert.Equal(t, http.StatusBadRequest, writer.Code, bad)
+	}
+	writer = makeRequest("POST", "/product/bulk?mode=sometimes", []byte(body))
+	assert.Equal(t, http.StatusBadRequest, writer.Code)
+}
+
+func Test_DB_CreateProducts(t *testing.T) {
+	products := make([]CreateProductParams, bulkChunkSize+2)
+	for i := range products {
+		products[i] = CreateProductParams{
+			Name:        RandomString(5),
+			Description: RandomString(10),
+			Images:      []string{RandomString(5)},
+			Price:       "100",
+			UserID:      int(RandomInt(1, 100)),
+		}
+	}
+	// a user deleted since validation fails in the database only
+	products[bulkChunkSize+1].UserID = 1000000
+
+	results, err := testPostgresStore.CreateProducts(products, true)
+	assert.NoError(t, err)
+	assert.Equal(t, BulkFailed, results[bulkChunkSize+1].Status)
+	for _, result := range results[:bulkChunkSize+1] {
+		assert.Equal(t, BulkSkipped, result.Status)
+		assert.Zero(t, result.ID)
+	}
+
+	results, err = testPostgresStore.CreateProducts(products, false)
+	assert.NoError(t, err)
+	assert.Equal(t, BulkFailed, results[bulkChunkSize+1].Status)
+	for i, result := range results[:bulkChunkSize+1] {
+		assert.Equal(t, i, result.Index)
+		assert.Equal(t, BulkCreated, result.Status)
+	}
+	product, err := testPostgresStore.GetProduct(results[bulkChunkSize].ID)
+	assert.NoError(t, err)
+	assert.Equal(t, products[bulkChunkSize].Name, product.Name)
+	st, err := testPostgresStore.GetProductStatus(results[bulkChunkSize].ID)
+	assert.NoError(t, err)
+	assert.Equal(t, StatusQueued, st.State)
+}
+
+func Test_Bulk_DecodeProducts(t *testing.T) {
+	items, err := decodeBulkProducts(strings.NewReader(`[{"name":"a"},{"name":1},{"name":"a","colour":"red"}]`), "application/json")
+	assert.NoError(t, err)
+	assert.Len(t, items, 3)
+	assert.Equal(t, "a", items[0].params.Name)
+	assert.NoError(t, items[0].err)
+	assert.Error(t, items[1].err)
+	assert.Equal(t, FieldError{Field: "colour", Code: FieldUnknown, Message: "is not a known field"}, items[2].err)
+
+	items, err = decodeBulkProducts(strings.NewReader("{\"name\":\"a\"}\n\n{oops\n{\"name\":\"b\"}\n"), "application/x-ndjson; charset=utf-8")
+	assert.NoError(t, err)
+	assert.Len(t, items, 3)
+	assert.Error(t, items[1].err)
+	assert.Equal(t, "b", items[2].params.Name)
+
+	_, err = decodeBulkProducts(strings.NewReader(`{"name":"a"}`), "application/json")
+	assert.Error(t, err)
+	_, err = decodeBulkProducts(strings.NewReader(`[{"name":"a"`), "")
+	assert.Error(t, err)
+}
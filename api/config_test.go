@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Config_Validate(t *testing.T) {
+	cfg := defaultAPIConfig
+	assert.ErrorContains(t, cfg.Validate(), "jwks is required")
+	cfg.JWKS = "jwks.json"
+	assert.NoError(t, cfg.Validate())
+
+	cfg.Database.Port = 0
+	cfg.RateBurst = 0
+	cfg.DailyImageQuota = -1
+	cfg.ShutdownTimeout = 0
+	err := cfg.Validate()
+	assert.ErrorContains(t, err, "database port")
+	assert.ErrorContains(t, err, "rate_burst")
+	assert.ErrorContains(t, err, "daily_image_quota")
+	assert.ErrorContains(t, err, "shutdown_timeout")
+}
+
+func Test_Config_QuoteConnValue(t *testing.T) {
+	assert.Equal(t, `'secret'`, quoteConnValue("secret"))
+	assert.Equal(t, `'it\'s a \\ secret'`, quoteConnValue(`it's a \ secret`))
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Types of product events.
+const (
+	// EventStatus carries a ProductStatus after every status transition
+	EventStatus = "status"
+	// EventImages carries the compressed images of a product once written
+	EventImages = "images"
+)
+
+const (
+	eventPollInterval   = 500 * time.Millisecond
+	eventBatchSize      = 100
+	eventRetention      = 7 * 24 * time.Hour
+	eventHeartbeat      = 15 * time.Second
+	eventSubscriberSize = 64
+	// eventGapWait is how long the broker waits for a missing event id,
+	// which may belong to a transaction that has not committed yet
+	eventGapWait = 2 * time.Second
+	// eventRetryMillis tells EventSource clients how long to wait before
+	// reconnecting
+	eventRetryMillis = 3000
+)
+
+// ProductEvent is a change of a product, persisted so that clients can
+// resume a stream from the id of the last event they saw.
+type ProductEvent struct {
+	ID        int64           `json:"id"`
+	ProductID int64           `json:"product_id"`
+	UserID    int64           `json:"user_id"`
+	Type      string          `json:"type"`
+	Data      json.RawMessage `json:"data"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// imagesEvent is the data of an EventImages event.
+type imagesEvent struct {
+	ProductID        int64               `json:"product_id"`
+	Version          int64               `json:"version"`
+	CompressedImages []string            `json:"compressed_images"`
+	Renditions       map[string][]string `json:"renditions,omitempty"`
+	CompressedBy     string              `json:"compressed_by,omitempty"`
+	CompressedAt     *time.Time          `json:"compressed_at,omitempty"`
+}
+
+// EventFilter selects the events of a product or of the products of a user.
+// Zero fields match everything.
+type EventFilter struct {
+	ProductID int64
+	UserID    int64
+}
+
+func (f EventFilter) matches(e ProductEvent) bool {
+	return (f.ProductID == 0 || f.ProductID == e.ProductID) &&
+		(f.UserID == 0 || f.UserID == e.UserID)
+}
+
+const (
+	eventColumns = `id,product_id,user_id,type,data,created_at`
+
+	// insertProductEventQuery records an event for product $1, taking the
+	// owner from the product
+	insertProductEventQuery = `
+	INSERT INTO product_events (
+	product_id, user_id, type, data
+	)
+	SELECT id, user_id, $2, $3 FROM products WHERE id = $1
+	`
+
+	listProductEventsQuery = `
+	SELECT ` + eventColumns + ` FROM product_events
+	WHERE id > $1
+	AND ($2::bigint = 0 OR product_id = $2)
+	AND ($3::bigint = 0 OR user_id = $3)
+	ORDER BY id
+	LIMIT $4
+	`
+
+	lastProductEventQuery = `
+	SELECT COALESCE(MAX(id), 0) FROM product_events
+	`
+
+	pruneProductEventsQuery = `
+	DELETE FROM product_events
+	WHERE created_at < $1
+	`
+)
+
+// insertProductEvent records an event of a product in tx.
+func insertProductEvent(tx *sql.Tx, productId int, eventType string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(insertProductEventQuery, productId, eventType, payload)
+	return err
+}
+
+// ListProductEvents returns up to limit events after the event with id after
+// that match filter, oldest first.
+func (s *PostgresStore) ListProductEvents(after int64, filter EventFilter, limit int) ([]ProductEvent, error) {
+	rows, err := s.db.Query(listProductEventsQuery, after, filter.ProductID, filter.UserID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []ProductEvent{}
+	for rows.Next() {
+		var e ProductEvent
+		var data []byte
+		if err := rows.Scan(&e.ID, &e.ProductID, &e.UserID, &e.Type, &data, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		e.Data = data
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func (s *PostgresStore) LastProductEventID() (int64, error) {
+	var id int64
+	err := s.db.QueryRow(lastProductEventQuery).Scan(&id)
+	return id, err
+}
+
+func (s *PostgresStore) PruneProductEvents(olderThan time.Duration) (int64, error) {
+	res, err := s.db.Exec(pruneProductEventsQuery, time.Now().Add(-olderThan))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// EventBroker polls the product_events table and fans new events out to the
+// open streams, so that any API instance sees the events written by the
+// others with a single query per poll.
+type EventBroker struct {
+	store Storage
+
+	mu   sync.Mutex
+	subs map[*eventSubscription]struct{}
+	// last is the id of the last event published; every event up to it is
+	// committed
+	last int64
+	// ready is closed once Run has read where the events table ends
+	ready chan struct{}
+}
+
+// eventSubscription receives the events matching its filter. The broker
+// closes C when the subscriber falls behind; it then catches up from the
+// store and subscribes again.
+type eventSubscription struct {
+	C      chan ProductEvent
+	filter EventFilter
+}
+
+func NewEventBroker(store Storage) *EventBroker {
+	return &EventBroker{
+		store: store,
+		subs:  make(map[*eventSubscription]struct{}),
+		ready: make(chan struct{}),
+	}
+}
+
+// Subscribe returns a subscription to the events after the returned id. The
+// events up to that id are read from the store. It waits for Run to start.
+func (b *EventBroker) Subscribe(filter EventFilter) (*eventSubscription, int64) {
+	<-b.ready
+	sub := &eventSubscription{C: make(chan ProductEvent, eventSubscriberSize), filter: filter}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs[sub] = struct{}{}
+	return sub, b.last
+}
+
+func (b *EventBroker) Unsubscribe(sub *eventSubscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[sub]; ok {
+		delete(b.subs, sub)
+		close(sub.C)
+	}
+}
+
+func (b *EventBroker) publish(e ProductEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.last = e.ID
+	for sub := range b.subs {
+		if !sub.filter.matches(e) {
+			continue
+		}
+		select {
+		case sub.C <- e:
+		default:
+			delete(b.subs, sub)
+			close(sub.C)
+		}
+	}
+}
+
+// Run polls for new events until ctx is done and prunes old ones hourly.
+func (b *EventBroker) Run(ctx context.Context) {
+	last, err := b.store.LastProductEventID()
+	if err != nil {
+		log.Printf("event broker: %s", err)
+	}
+	b.mu.Lock()
+	b.last = last
+	b.mu.Unlock()
+	close(b.ready)
+
+	// gapSince is set while the broker waits for a missing id
+	var gapSince time.Time
+
+	poll := time.NewTicker(eventPollInterval)
+	defer poll.Stop()
+	prune := time.NewTicker(time.Hour)
+	defer prune.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-prune.C:
+			if n, err := b.store.PruneProductEvents(eventRetention); err != nil {
+				log.Printf("event broker: prune: %s", err)
+			} else if n > 0 {
+				log.Printf("event broker: pruned %d events", n)
+			}
+		case <-poll.C:
+		batches:
+			for {
+				events, err := b.store.ListProductEvents(last, EventFilter{}, eventBatchSize)
+				if err != nil {
+					log.Printf("event broker: %s", err)
+					break
+				}
+				for _, e := range events {
+					// ids are handed out before commit, a later id may be
+					// visible first; a gap that stays is a rolled back event
+					if e.ID != last+1 {
+						if gapSince.IsZero() {
+							gapSince = time.Now()
+						}
+						if time.Since(gapSince) < eventGapWait {
+							break batches
+						}
+					}
+					gapSince = time.Time{}
+					b.publish(e)
+					last = e.ID
+				}
+				if len(events) < eventBatchSize {
+					break
+				}
+			}
+		}
+	}
+}
+
+func (s *APIServer) handleProductEvents(w http.ResponseWriter, r *http.Request) error {
+
+	productId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return WriteProblem(w, invalidID("product"))
+	}
+	if _, err := s.store.GetProduct(productId); err != nil {
+		if err == sql.ErrNoRows {
+			return WriteProblem(w, productNotFound())
+		}
+		return writeError(w, err)
+	}
+
+	return s.streamEvents(w, r, EventFilter{ProductID: int64(productId)})
+}
+
+// handleEvents streams the events of the products of ?user_id=, or without
+// it of the products of the caller. Only callers that act for every user, an
+// admin or an API key without an owner, get the events of all products.
+func (s *APIServer) handleEvents(w http.ResponseWriter, r *http.Request) error {
+
+	principal := principalOf(r)
+	var filter EventFilter
+	if v := r.URL.Query().Get("user_id"); v != "" {
+		userId, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || userId < 1 {
+			return WriteProblem(w, parameterProblem(fieldError("user_id", FieldInvalid, "must be a user id")))
+		}
+		if err := authorizeUser(r, int(userId)); err != nil {
+			return writeError(w, err)
+		}
+		filter.UserID = userId
+	} else if principal.UserID != 0 {
+		filter.UserID = int64(principal.UserID)
+	} else if principal.Role != RoleAdmin && principal.Role != RoleAPIKey {
+		return WriteProblem(w, forbidden("the events of all products require the admin role"))
+	}
+
+	return s.streamEvents(w, r, filter)
+}
+
+// streamEvents writes the events matching filter as Server-Sent Events until
+// the client goes away or the server shuts down. A Last-Event-ID header, or the last_event_id query
+// parameter for the first connect, replays the events after that id.
+func (s *APIServer) streamEvents(w http.ResponseWriter, r *http.Request, filter EventFilter) error {
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return WriteProblem(w, NewProblem(http.StatusInternalServerError, CodeInternal, "streaming not supported"))
+	}
+
+	lastId := r.Header.Get("Last-Event-ID")
+	if lastId == "" {
+		lastId = r.URL.Query().Get("last_event_id")
+	}
+	// without a resume point the stream starts with the next event
+	last := int64(-1)
+	if lastId != "" {
+		var err error
+		last, err = strconv.ParseInt(strings.TrimSpace(lastId), 10, 64)
+		if err != nil || last < 0 {
+			return WriteProblem(w, parameterProblem(fieldError("Last-Event-ID", FieldInvalid, "must be an event id")))
+		}
+	}
+
+	// subscribe before the response starts, so a client that got the
+	// headers does not miss the events that follow
+	sub, upTo := s.events.Subscribe(filter)
+	defer func() { s.events.Unsubscribe(sub) }()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", eventRetryMillis)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		// the subscription carries the events after upTo, the ones before
+		// are caught up from the store
+		if last < 0 {
+			last = upTo
+		}
+		var err error
+		last, err = s.replayEvents(w, filter, last, upTo)
+		if err != nil {
+			log.Printf("event stream: %s", err)
+			return nil
+		}
+		flusher.Flush()
+
+	live:
+		for {
+			select {
+			case <-r.Context().Done():
+				return nil
+			case <-s.closing:
+				return nil
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": ping\n\n")
+				flusher.Flush()
+			case e, ok := <-sub.C:
+				if !ok {
+					// fell behind, catch up from the store
+					sub, upTo = s.events.Subscribe(filter)
+					break live
+				}
+				if e.ID <= last {
+					continue
+				}
+				writeEvent(w, e)
+				last = e.ID
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// replayEvents writes the stored events after last up to upTo and returns
+// the id the stream continues after.
+func (s *APIServer) replayEvents(w http.ResponseWriter, filter EventFilter, last, upTo int64) (int64, error) {
+	for last < upTo {
+		events, err := s.store.ListProductEvents(last, filter, eventBatchSize)
+		if err != nil {
+			return last, err
+		}
+		for _, e := range events {
+			if e.ID > upTo {
+				return upTo, nil
+			}
+			writeEvent(w, e)
+			last = e.ID
+		}
+		if len(events) < eventBatchSize {
+			break
+		}
+	}
+	if last < upTo {
+		last = upTo
+	}
+	return last, nil
+}
+
+func writeEvent(w http.ResponseWriter, e ProductEvent) {
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, e.Data)
+}
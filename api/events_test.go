@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type sseEvent struct {
+	ID    string
+	Event string
+	Data  string
+}
+
+// openEventStream connects to an event stream of the test server and returns
+// the events read from it. The stream is closed with the test.
+func openEventStream(t *testing.T, url string, headers map[string]string) <-chan sseEvent {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	events := make(chan sseEvent, 16)
+	go func() {
+		defer res.Body.Close()
+		defer close(events)
+		var e sseEvent
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				if e.Event != "" {
+					events <- e
+				}
+				e = sseEvent{}
+			case strings.HasPrefix(line, "id: "):
+				e.ID = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				e.Event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				e.Data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+	}()
+	return events
+}
+
+func nextEvent(t *testing.T, events <-chan sseEvent) sseEvent {
+	select {
+	case e, ok := <-events:
+		if !ok {
+			t.Fatal("event stream closed")
+		}
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event within 5s")
+	}
+	return sseEvent{}
+}
+
+func Test_API_ProductEvents(t *testing.T) {
+	server := httptest.NewServer(router())
+	defer server.Close()
+
+	product := createRandomProduct(t)
+	productId := strconv.Itoa(int(product.ID))
+
+	// the product was queued on create
+	events := openEventStream(t, server.URL+"/product/"+productId+"/events", map[string]string{"Last-Event-ID": "0"})
+	queued := nextEvent(t, events)
+	assert.Equal(t, EventStatus, queued.Event)
+	var status ProductStatus
+	assert.NoError(t, json.Unmarshal([]byte(queued.Data), &status))
+	assert.Equal(t, StatusQueued, status.State)
+
+	owner := map[string]string{"Authorization": "Bearer " + testToken(strconv.Itoa(int(product.UserID)))}
+	userEvents := openEventStream(t, server.URL+"/events?user_id="+strconv.Itoa(int(product.UserID)), owner)
+	// without user_id a user follows their own products
+	ownEvents := openEventStream(t, server.URL+"/events", owner)
+
+	writer := makeRequest("POST", "/product/"+productId+"/status", []byte(`{"state":"processing","worker":"worker-1"}`))
+	assert.Equal(t, http.StatusOK, writer.Code)
+	processing := nextEvent(t, events)
+	assert.Equal(t, EventStatus, processing.Event)
+	assert.Contains(t, processing.Data, `"state":"processing"`)
+
+	writer = makeRequest("PUT", "/product/"+productId+"/compressed-images", []byte(`{"images":["./home/path1","./home/path2"]}`))
+	assert.Equal(t, http.StatusOK, writer.Code)
+	images := nextEvent(t, events)
+	assert.Equal(t, EventImages, images.Event)
+	assert.Contains(t, images.Data, `"compressed_images":["./home/path1","./home/path2"]`)
+
+	// the user feeds see the same events
+	for _, feed := range []<-chan sseEvent{userEvents, ownEvents} {
+		for _, want := range []sseEvent{processing, images} {
+			e := nextEvent(t, feed)
+			for e.ID != want.ID {
+				e = nextEvent(t, feed)
+			}
+			assert.Equal(t, want, e)
+		}
+	}
+
+	// a reconnect resumes after the last event seen
+	resumed := openEventStream(t, server.URL+"/product/"+productId+"/events", map[string]string{"Last-Event-ID": processing.ID})
+	assert.Equal(t, images, nextEvent(t, resumed))
+
+	resumed = openEventStream(t, server.URL+"/product/"+productId+"/events?last_event_id="+queued.ID, nil)
+	assert.Equal(t, processing, nextEvent(t, resumed))
+}
+
+func Test_API_ProductEventsBadRequest(t *testing.T) {
+	writer := makeRequest("GET", "/product/abcd/events", nil)
+	assert.Equal(t, http.StatusBadRequest, writer.Code)
+
+	writer = makeRequest("GET", "/product/1000000/events", nil)
+	assert.Equal(t, http.StatusNotFound, writer.Code)
+
+	writer = makeRequest("GET", "/events?user_id=abc", nil)
+	assert.Equal(t, http.StatusBadRequest, writer.Code)
+
+	// the events of all products or of other users are not for everyone
+	writer = makeRequestWithHeaders("GET", "/events", nil, map[string]string{"Authorization": ""})
+	assert.Equal(t, http.StatusUnauthorized, writer.Code)
+	writer = makeRequestWithHeaders("GET", "/events?user_id=18", nil, map[string]string{"Authorization": "Bearer " + testToken("17")})
+	assert.Equal(t, http.StatusForbidden, writer.Code)
+	writer = makeRequestWithHeaders("GET", "/events", nil, map[string]string{"Authorization": "Bearer " + testToken(RoleService)})
+	assert.Equal(t, http.StatusForbidden, writer.Code)
+
+	product := createRandomProduct(t)
+	writer = makeRequestWithHeaders("GET", "/product/"+strconv.Itoa(int(product.ID))+"/events", nil, map[string]string{"Last-Event-ID": "x"})
+	assert.Equal(t, http.StatusBadRequest, writer.Code)
+}
+
+func Test_Events_FilterMatches(t *testing.T) {
+	e := ProductEvent{ID: 1, ProductID: 2, UserID: 3}
+	assert.True(t, EventFilter{}.matches(e))
+	assert.True(t, EventFilter{ProductID: 2}.matches(e))
+	assert.True(t, EventFilter{UserID: 3}.matches(e))
+	assert.False(t, EventFilter{ProductID: 4}.matches(e))
+	assert.False(t, EventFilter{ProductID: 2, UserID: 4}.matches(e))
+}
+
+func Test_Events_BrokerDropsSlowSubscriber(t *testing.T) {
+	broker := NewEventBroker(nil)
+	close(broker.ready)
+
+	fast, _ := broker.Subscribe(EventFilter{ProductID: 1})
+	slow, _ := broker.Subscribe(EventFilter{})
+	for i := 1; i <= eventSubscriberSize+1; i++ {
+		broker.publish(ProductEvent{ID: int64(i), ProductID: 2})
+	}
+	_, upTo := broker.Subscribe(EventFilter{})
+	assert.Equal(t, int64(eventSubscriberSize+1), upTo)
+
+	// the slow subscriber got a full buffer and then its channel closed
+	n := 0
+	for range slow.C {
+		n++
+	}
+	assert.Equal(t, eventSubscriberSize, n)
+	assert.Len(t, fast.C, 0)
+
+	broker.Unsubscribe(slow)
+	broker.Unsubscribe(fast)
+	_, ok := <-fast.C
+	assert.False(t, ok)
+}
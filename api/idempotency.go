@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	idempotencyHeader = "Idempotency-Key"
+	// idempotencyReplayedHeader marks a response replayed from the store
+	idempotencyReplayedHeader = "Idempotent-Replayed"
+	idempotencyRetention      = 24 * time.Hour
+	// idempotencyLockTimeout is after how long a key whose request never
+	// completed, say because the server died, may be used again
+	idempotencyLockTimeout  = time.Minute
+	maxIdempotencyKeyLength = 255
+	// maxIdempotentBodySize fits a bulk import
+	maxIdempotentBodySize = maxBulkBodySize
+)
+
+// idempotencyStoredHeaders are the response headers replayed with the body.
+var idempotencyStoredHeaders = []string{"Content-Type", "Location", "ETag"}
+
+// IdempotencyRecord is the request fingerprint and response stored for an
+// Idempotency-Key. StatusCode is 0 while the first request is in progress.
+type IdempotencyRecord struct {
+	Fingerprint string
+	StatusCode  int
+	Header      map[string]string
+	Body        []byte
+}
+
+const (
+	// claimIdempotencyKeyQuery takes a new key, or one whose record expired
+	// after $4 seconds or whose request did not complete within $5 seconds
+	claimIdempotencyKeyQuery = `
+	INSERT INTO idempotency_keys (
+	scope, key, fingerprint
+	) VALUES (
+	$1, $2, $3
+	)
+	ON CONFLICT (scope, key) DO UPDATE
+	SET fingerprint = EXCLUDED.fingerprint,
+	status_code = NULL,
+	header = NULL,
+	body = NULL,
+	created_at = NOW(),
+	completed_at = NULL
+	WHERE idempotency_keys.created_at < NOW() - make_interval(secs => $4)
+	OR (idempotency_keys.completed_at IS NULL AND idempotency_keys.created_at < NOW() - make_interval(secs => $5))
+	RETURNING scope
+	`
+
+	getIdempotencyKeyQuery = `
+	SELECT fingerprint, status_code, header, body FROM idempotency_keys
+	WHERE scope = $1 AND key = $2
+	`
+
+	completeIdempotencyKeyQuery = `
+	UPDATE idempotency_keys
+	SET status_code = $3,
+	header = $4,
+	body = $5,
+	completed_at = NOW()
+	WHERE scope = $1 AND key = $2
+	`
+
+	releaseIdempotencyKeyQuery = `
+	DELETE FROM idempotency_keys
+	WHERE scope = $1 AND key = $2 AND completed_at IS NULL
+	`
+
+	pruneIdempotencyKeysQuery = `
+	DELETE FROM idempotency_keys
+	WHERE created_at < $1
+	`
+)
+
+// ClaimIdempotencyKey reserves key for a request with fingerprint. If the key
+// is taken it returns false and the record of the request that took it.
+func (s *PostgresStore) ClaimIdempotencyKey(scope, key, fingerprint string) (bool, IdempotencyRecord, error) {
+	var claimed string
+	err := s.db.QueryRow(claimIdempotencyKeyQuery, scope, key, fingerprint,
+		idempotencyRetention.Seconds(), idempotencyLockTimeout.Seconds()).Scan(&claimed)
+	if err == nil {
+		return true, IdempotencyRecord{}, nil
+	}
+	if err != sql.ErrNoRows {
+		return false, IdempotencyRecord{}, err
+	}
+
+	var rec IdempotencyRecord
+	var statusCode sql.NullInt64
+	var header []byte
+	err = s.db.QueryRow(getIdempotencyKeyQuery, scope, key).Scan(&rec.Fingerprint, &statusCode, &header, &rec.Body)
+	if err != nil {
+		return false, IdempotencyRecord{}, err
+	}
+	rec.StatusCode = int(statusCode.Int64)
+	if header != nil {
+		if err := json.Unmarshal(header, &rec.Header); err != nil {
+			return false, IdempotencyRecord{}, err
+		}
+	}
+	return false, rec, nil
+}
+
+// CompleteIdempotencyKey stores the response of the request that claimed key.
+func (s *PostgresStore) CompleteIdempotencyKey(scope, key string, rec IdempotencyRecord) error {
+	header, err := json.Marshal(rec.Header)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(completeIdempotencyKeyQuery, scope, key, rec.StatusCode, header, rec.Body)
+	return err
+}
+
+// ReleaseIdempotencyKey frees a claimed key whose request failed, so that
+// it can be retried.
+func (s *PostgresStore) ReleaseIdempotencyKey(scope, key string) error {
+	_, err := s.db.Exec(releaseIdempotencyKeyQuery, scope, key)
+	return err
+}
+
+func (s *PostgresStore) PruneIdempotencyKeys(olderThan time.Duration) (int64, error) {
+	res, err := s.db.Exec(pruneIdempotencyKeysQuery, time.Now().Add(-olderThan))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// responseCapture passes a response through and keeps a copy of it.
+type responseCapture struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (c *responseCapture) WriteHeader(status int) {
+	c.status = status
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *responseCapture) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	c.body.Write(b)
+	return c.ResponseWriter.Write(b)
+}
+
+// idempotent makes a handler honour the Idempotency-Key header. The first
+// request with a key runs f and its response is stored; a retry with the
+// same key and body gets the stored response, one with another body a 409.
+// Responses of 5xx and 429 and handler errors are not stored, so that the
+// request can be retried. Requests without the header run f as before. Keys are
+// scoped to the caller, so that no one is replayed another caller's response.
+func (s *APIServer) idempotent(f apiFunc) apiFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+
+		key := r.Header.Get(idempotencyHeader)
+		if key == "" {
+			return f(w, r)
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			return WriteProblem(w, parameterProblem(fieldError(idempotencyHeader, FieldInvalid, "must be at most 255 characters")))
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBodySize))
+		if err != nil {
+			return writeError(w, err)
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(body)
+		fingerprint := hex.EncodeToString(sum[:])
+
+		scope := r.Method + " " + r.URL.Path
+		if route := mux.CurrentRoute(r); route != nil {
+			if tmpl, err := route.GetPathTemplate(); err == nil {
+				scope = r.Method + " " + tmpl
+			}
+		}
+		if p := principalOf(r); p.Subject != "" {
+			scope += " " + p.Role + ":" + p.Subject
+		}
+
+		claimed, rec, err := s.store.ClaimIdempotencyKey(scope, key, fingerprint)
+		if err == sql.ErrNoRows {
+			// released between the claim and the read, the first request failed
+			return WriteProblem(w, NewProblem(http.StatusConflict, CodeIdempotencyKeyInUse, "a request with this Idempotency-Key is in progress, retry later"))
+		}
+		if err != nil {
+			return writeError(w, err)
+		}
+		if !claimed {
+			if rec.Fingerprint != fingerprint {
+				return WriteProblem(w, NewProblem(http.StatusConflict, CodeIdempotencyKeyReused, "Idempotency-Key was already used with a different request"))
+			}
+			if rec.StatusCode == 0 {
+				return WriteProblem(w, NewProblem(http.StatusConflict, CodeIdempotencyKeyInUse, "a request with this Idempotency-Key is in progress, retry later"))
+			}
+			for name, value := range rec.Header {
+				w.Header().Set(name, value)
+			}
+			w.Header().Set(idempotencyReplayedHeader, "true")
+			w.WriteHeader(rec.StatusCode)
+			_, err := w.Write(rec.Body)
+			return err
+		}
+
+		capture := &responseCapture{ResponseWriter: w}
+		err = f(capture, r)
+		if err != nil || capture.status == 0 || capture.status >= 500 || capture.status == http.StatusTooManyRequests {
+			if err := s.store.ReleaseIdempotencyKey(scope, key); err != nil {
+				log.Printf("idempotency key %q: %s", key, err)
+			}
+			return err
+		}
+
+		rec = IdempotencyRecord{
+			Fingerprint: fingerprint,
+			StatusCode:  capture.status,
+			Header:      map[string]string{},
+			Body:        capture.body.Bytes(),
+		}
+		for _, name := range idempotencyStoredHeaders {
+			if value := capture.Header().Get(name); value != "" {
+				rec.Header[name] = value
+			}
+		}
+		if err := s.store.CompleteIdempotencyKey(scope, key, rec); err != nil {
+			log.Printf("idempotency key %q: %s", key, err)
+		}
+		return nil
+	}
+}
+
+// pruneIdempotencyKeys drops expired idempotency keys hourly until ctx is
+// done.
+func pruneIdempotencyKeys(ctx context.Context, store Storage) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if n, err := store.PruneIdempotencyKeys(idempotencyRetention); err != nil {
+				log.Printf("idempotency keys: prune: %s", err)
+			} else if n > 0 {
+				log.Printf("idempotency keys: pruned %d", n)
+			}
+		}
+	}
+}
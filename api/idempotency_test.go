@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_API_CreateProductIdempotencyKey(t *testing.T) {
+	name := RandomString(8)
+	payload := []byte(`{
+		"name": "` + name + `",
+		"description": "this is product 1",
+		"images":["https://via.placeholder.com/100/13234"],
+		"price":"125",
+		"user_id":17
+	  }`)
+	key := map[string]string{idempotencyHeader: RandomString(20)}
+
+	first := makeRequestWithHeaders("POST", "/product", payload, key)
+	assert.Equal(t, http.StatusCreated, first.Code)
+	assert.Empty(t, first.Header().Get(idempotencyReplayedHeader))
+
+	replay := makeRequestWithHeaders("POST", "/product", payload, key)
+	assert.Equal(t, http.StatusCreated, replay.Code)
+	assert.Equal(t, first.Body.String(), replay.Body.String())
+	assert.Equal(t, "true", replay.Header().Get(idempotencyReplayedHeader))
+	assert.Equal(t, first.Header().Get("Content-Type"), replay.Header().Get("Content-Type"))
+
+	var count int
+	err := testPostgresStore.db.QueryRow(`SELECT COUNT(*) FROM products WHERE name = $1`, name).Scan(&count)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	// the same key with another body
+	other := makeRequestWithHeaders("POST", "/product", []byte(strings.Replace(string(payload), "125", "126", 1)), key)
+	assert.Equal(t, http.StatusConflict, other.Code)
+
+	// other routes ignore the key, and requests without one are not deduplicated
+	writer := makeRequestWithHeaders("POST", "/webhook", []byte(`{"url":"https://hooks.example.com"}`), key)
+	assert.Equal(t, http.StatusCreated, writer.Code)
+	writer = makeRequest("POST", "/product", payload)
+	assert.Equal(t, http.StatusCreated, writer.Code)
+
+	// client errors are stored too
+	bad := map[string]string{idempotencyHeader: RandomString(20)}
+	writer = makeRequestWithHeaders("POST", "/product", []byte(`{"name":"x"}`), bad)
+	assert.Equal(t, http.StatusUnprocessableEntity, writer.Code)
+	writer = makeRequestWithHeaders("POST", "/product", []byte(`{"name":"x"}`), bad)
+	assert.Equal(t, http.StatusUnprocessableEntity, writer.Code)
+	assert.Equal(t, "application/problem+json", writer.Header().Get("Content-Type"))
+	assert.Equal(t, "true", writer.Header().Get(idempotencyReplayedHeader))
+
+	writer = makeRequestWithHeaders("POST", "/product", payload, map[string]string{idempotencyHeader: strings.Repeat("k", 256)})
+	assert.Equal(t, http.StatusBadRequest, writer.Code)
+}
+
+func Test_DB_IdempotencyKey(t *testing.T) {
+	scope, key := "POST /test", RandomString(20)
+
+	claimed, _, err := testPostgresStore.ClaimIdempotencyKey(scope, key, "a")
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+
+	// in progress
+	claimed, rec, err := testPostgresStore.ClaimIdempotencyKey(scope, key, "a")
+	assert.NoError(t, err)
+	assert.False(t, claimed)
+	assert.Equal(t, 0, rec.StatusCode)
+
+	// a failed request frees the key
+	assert.NoError(t, testPostgresStore.ReleaseIdempotencyKey(scope, key))
+	claimed, _, err = testPostgresStore.ClaimIdempotencyKey(scope, key, "a")
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+
+	err = testPostgresStore.CompleteIdempotencyKey(scope, key, IdempotencyRecord{
+		StatusCode: http.StatusCreated,
+		Header:     map[string]string{"Content-Type": "application/json"},
+		Body:       []byte(`{"id":1}`),
+	})
+	assert.NoError(t, err)
+	claimed, rec, err = testPostgresStore.ClaimIdempotencyKey(scope, key, "b")
+	assert.NoError(t, err)
+	assert.False(t, claimed)
+	assert.Equal(t, "a", rec.Fingerprint)
+	assert.Equal(t, http.StatusCreated, rec.StatusCode)
+	assert.Equal(t, "application/json", rec.Header["Content-Type"])
+	assert.Equal(t, `{"id":1}`, string(rec.Body))
+
+	// completed keys stay until they expire
+	assert.NoError(t, testPostgresStore.ReleaseIdempotencyKey(scope, key))
+	_, err = testPostgresStore.db.Exec(`UPDATE idempotency_keys SET created_at = NOW() - interval '2 days' WHERE key = $1`, key)
+	assert.NoError(t, err)
+	claimed, _, err = testPostgresStore.ClaimIdempotencyKey(scope, key, "b")
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/arjun/go-message-queue-api/blobstore"
+	"github.com/gorilla/mux"
+)
+
+// imageCacheControl lets clients and proxies reuse an image for an hour and
+// revalidate it with its ETag afterwards. Reprocessing a product writes the
+// same object names again, so images are not cached as immutable.
+const imageCacheControl = "public, max-age=3600"
+
+// maxBufferedImage bounds the size of images that are read into memory to
+// serve range requests from stores whose objects cannot seek.
+const maxBufferedImage = 32 << 20
+
+const (
+	maxUploadFiles    = 20
+	maxUploadFileSize = 10 << 20
+	// uploadMemory is the part of a multipart upload kept in memory, the
+	// rest is spooled to temporary files
+	uploadMemory = 8 << 20
+)
+
+// uploadContentTypes are the sniffed content types accepted for uploads and
+// the extension the original is stored with.
+var uploadContentTypes = map[string]string{
+	"image/png":  "png",
+	"image/jpeg": "jpg",
+	"image/gif":  "gif",
+	"image/webp": "webp",
+}
+
+// handleUploadImages stores the files of the "images" field of a multipart
+// upload as originals in the image store, appends them to the product images
+// and queues a job that compresses only the new images.
+func (s *APIServer) handleUploadImages(w http.ResponseWriter, r *http.Request) error {
+
+	productId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return WriteProblem(w, invalidID("product"))
+	}
+	current, err := s.authorizeProduct(r, productId)
+	if err != nil {
+		return writeError(w, err)
+	}
+	if s.images == nil {
+		return WriteProblem(w, NewProblem(http.StatusServiceUnavailable, CodeUnavailable, "no image store configured"))
+	}
+
+	var version int64
+	if r.Header.Get("If-Match") != "" {
+		version, err = requireIfMatch(r)
+		if err != nil {
+			return writeError(w, err)
+		}
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadFiles*maxUploadFileSize)
+	if err := r.ParseMultipartForm(uploadMemory); err != nil {
+		var maxBytes *http.MaxBytesError
+		if errors.As(err, &maxBytes) {
+			return writeError(w, err)
+		}
+		return WriteProblem(w, NewProblem(http.StatusBadRequest, CodeMalformedBody, "multipart decode error "+err.Error()))
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	files := r.MultipartForm.File["images"]
+	if len(files) == 0 {
+		return writeError(w, fieldError("images", FieldRequired, "has no files"))
+	}
+	if len(files) > maxUploadFiles {
+		return writeError(w, fieldError("images", FieldOutOfRange, "must be at most %d files", maxUploadFiles))
+	}
+
+	// check every file before storing any of them
+	extensions := make([]string, len(files))
+	for i, fh := range files {
+		if fh.Size > maxUploadFileSize {
+			return WriteProblem(w, NewProblem(http.StatusRequestEntityTooLarge, CodePayloadTooLarge, fmt.Sprintf("%s is larger than %d bytes", fh.Filename, maxUploadFileSize)))
+		}
+		contentType, err := sniffUpload(fh)
+		if err != nil {
+			return writeError(w, err)
+		}
+		ext, ok := uploadContentTypes[contentType]
+		if !ok {
+			return WriteProblem(w, NewProblem(http.StatusUnsupportedMediaType, CodeUnsupportedMediaType, fmt.Sprintf("%s is %s, not a PNG, JPEG, GIF or WebP image", fh.Filename, contentType)))
+		}
+		extensions[i] = ext
+	}
+
+	if len(current.Images)+len(files) > maxProductImages {
+		return writeError(w, tooManyImages())
+	}
+
+	userId := int(current.UserID)
+	if err := s.consumeQuota(w, userId, 0, len(files)); err != nil {
+		return writeError(w, err)
+	}
+	locations := make([]string, 0, len(files))
+	// a failed upload leaves none of its originals behind
+	fail := func() {
+		s.refundQuota(userId, 0, len(files))
+		s.deleteImages(locations)
+	}
+	for i, fh := range files {
+		file, err := fh.Open()
+		if err != nil {
+			fail()
+			return writeError(w, err)
+		}
+		key := fmt.Sprintf("originals/product_%d_%s.%s", productId, randomKey(), extensions[i])
+		location, err := s.images.Put(r.Context(), key, file, blobstore.ContentTypeOf(key))
+		file.Close()
+		if err != nil {
+			fail()
+			return writeImageStoreError(w, err)
+		}
+		locations = append(locations, location)
+	}
+
+	product, err := s.store.AddProductImages(productId, locations, version)
+	if err != nil {
+		fail()
+		if errors.Is(err, ErrTooManyImages) {
+			return writeError(w, tooManyImages())
+		}
+		return writeProductWriteError(w, err)
+	}
+
+	w.Header().Set("ETag", productETag(product))
+	return WriteJSON(w, http.StatusCreated, product)
+}
+
+func tooManyImages() FieldError {
+	return fieldError("images", FieldOutOfRange, "the product may have at most %d images", maxProductImages)
+}
+
+// deleteImages removes stored images that are no longer referenced, logging
+// the ones that could not be removed.
+func (s *APIServer) deleteImages(locations []string) {
+	for _, location := range locations {
+		if err := s.images.Delete(context.Background(), location); err != nil {
+			log.Printf("image store: delete %s: %s", location, err)
+		}
+	}
+}
+
+// sniffUpload detects the content type of an uploaded file from its content.
+func sniffUpload(fh *multipart.FileHeader) (string, error) {
+	file, err := fh.Open()
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	return http.DetectContentType(head[:n]), nil
+}
+
+func randomKey() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// handleGetImage streams the n-th compressed image of a product, or the n-th
+// image of a rendition, from the image store. Images kept outside of the
+// store are redirected to when they have an http(s) URL; images that could
+// not be processed have an empty location and are not found.
+func (s *APIServer) handleGetImage(w http.ResponseWriter, r *http.Request) error {
+
+	params := mux.Vars(r)
+	productId, err := strconv.Atoi(params["id"])
+	if err != nil {
+		return WriteProblem(w, invalidID("product"))
+	}
+	n, err := strconv.Atoi(params["n"])
+	if err != nil {
+		return WriteProblem(w, NewProblem(http.StatusBadRequest, CodeInvalidID, "bad image number"))
+	}
+
+	product, err := s.store.GetProduct(productId)
+	if err == sql.ErrNoRows {
+		return WriteProblem(w, productNotFound())
+	}
+	if err != nil {
+		return writeError(w, err)
+	}
+
+	locations := product.CompressedImages
+	if rendition, ok := params["rendition"]; ok {
+		locations, ok = product.Renditions[rendition]
+		if !ok {
+			return WriteProblem(w, NewProblem(http.StatusNotFound, CodeImageNotFound, "rendition not found"))
+		}
+	}
+	if n >= len(locations) {
+		return WriteProblem(w, NewProblem(http.StatusNotFound, CodeImageNotFound, "image not found"))
+	}
+	location := locations[n]
+	if location == "" {
+		return WriteProblem(w, NewProblem(http.StatusNotFound, CodeImageNotFound, "image could not be processed"))
+	}
+
+	if s.images == nil || !s.images.Owns(location) {
+		if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+			http.Redirect(w, r, location, http.StatusFound)
+			return nil
+		}
+		return WriteProblem(w, NewProblem(http.StatusNotFound, CodeImageNotFound, "image not available"))
+	}
+
+	obj, err := s.images.Get(r.Context(), location)
+	if err == blobstore.ErrNotFound {
+		return WriteProblem(w, NewProblem(http.StatusNotFound, CodeImageNotFound, "image not found"))
+	}
+	if err != nil {
+		return writeImageStoreError(w, err)
+	}
+	defer obj.Body.Close()
+
+	content, ok := obj.Body.(io.ReadSeeker)
+	if !ok {
+		data, err := io.ReadAll(io.LimitReader(obj.Body, maxBufferedImage+1))
+		if err != nil {
+			return writeImageStoreError(w, err)
+		}
+		if len(data) > maxBufferedImage {
+			return WriteProblem(w, NewProblem(http.StatusBadGateway, CodeImageStoreError, "image too large"))
+		}
+		content = bytes.NewReader(data)
+	}
+
+	w.Header().Set("Content-Type", obj.ContentType)
+	w.Header().Set("Cache-Control", imageCacheControl)
+	if obj.ETag != "" {
+		w.Header().Set("ETag", obj.ETag)
+	}
+	// ServeContent answers conditional and range requests
+	http.ServeContent(w, r, "", obj.ModTime, content)
+	return nil
+}
+
+// writeImageStoreError reports a failure of the image store, logging the
+// cause.
+func writeImageStoreError(w http.ResponseWriter, err error) error {
+	log.Printf("image store: %s", err)
+	return WriteProblem(w, NewProblem(http.StatusBadGateway, CodeImageStoreError, "the image store failed, retry later"))
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_API_HandleGetImage(t *testing.T) {
+	product := createRandomProduct(t)
+	productId := strconv.Itoa(int(product.ID))
+
+	writer := makeRequest("GET", "/product/"+productId+"/images/0", nil)
+	assert.Equal(t, http.StatusNotFound, writer.Code)
+
+	listing, err := testImageStore.Put(context.Background(), "p_"+productId+"_listing.png", strings.NewReader("0123456789"), "image/png")
+	assert.NoError(t, err)
+	thumb, err := testImageStore.Put(context.Background(), "p_"+productId+"_thumb.jpg", strings.NewReader("thumb"), "image/jpeg")
+	assert.NoError(t, err)
+
+	payload, _ := json.Marshal(CompressedImagesRequest{
+		Images: []string{listing, "https://cdn.example.com/a.png"},
+		Renditions: map[string][]string{
+			"listing": {listing, "https://cdn.example.com/a.png"},
+			"thumb":   {thumb, "./images/old_thumb.jpg"},
+		},
+	})
+	writer = makeRequest("PUT", "/product/"+productId+"/compressed-images", payload)
+	assert.Equal(t, http.StatusOK, writer.Code)
+
+	writer = makeRequest("GET", "/product/"+productId+"/images/0", nil)
+	assert.Equal(t, http.StatusOK, writer.Code)
+	assert.Equal(t, "0123456789", writer.Body.String())
+	assert.Equal(t, "image/png", writer.Header().Get("Content-Type"))
+	assert.Equal(t, imageCacheControl, writer.Header().Get("Cache-Control"))
+	etag := writer.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	writer = makeRequestWithHeaders("GET", "/product/"+productId+"/images/0", nil, map[string]string{"If-None-Match": etag})
+	assert.Equal(t, http.StatusNotModified, writer.Code)
+
+	writer = makeRequestWithHeaders("GET", "/product/"+productId+"/images/0", nil, map[string]string{"Range": "bytes=2-5"})
+	assert.Equal(t, http.StatusPartialContent, writer.Code)
+	assert.Equal(t, "2345", writer.Body.String())
+	assert.Equal(t, "bytes 2-5/10", writer.Header().Get("Content-Range"))
+
+	writer = makeRequest("GET", "/product/"+productId+"/images/0/thumb", nil)
+	assert.Equal(t, http.StatusOK, writer.Code)
+	assert.Equal(t, "thumb", writer.Body.String())
+	assert.Equal(t, "image/jpeg", writer.Header().Get("Content-Type"))
+
+	// images outside of the store are redirected to or unavailable
+	writer = makeRequest("GET", "/product/"+productId+"/images/1", nil)
+	assert.Equal(t, http.StatusFound, writer.Code)
+	assert.Equal(t, "https://cdn.example.com/a.png", writer.Header().Get("Location"))
+
+	writer = makeRequest("GET", "/product/"+productId+"/images/1/thumb", nil)
+	assert.Equal(t, http.StatusNotFound, writer.Code)
+
+	writer = makeRequest("GET", "/product/"+productId+"/images/2", nil)
+	assert.Equal(t, http.StatusNotFound, writer.Code)
+
+	writer = makeRequest("GET", "/product/"+productId+"/images/0/zoom", nil)
+	assert.Equal(t, http.StatusNotFound, writer.Code)
+	assert.Contains(t, writer.Body.String(), "rendition not found")
+
+	// an image that could not be processed keeps its place
+	payload, _ = json.Marshal(CompressedImagesRequest{Images: []string{"", listing}})
+	writer = makeRequest("PUT", "/product/"+productId+"/compressed-images", payload)
+	assert.Equal(t, http.StatusOK, writer.Code)
+
+	writer = makeRequest("GET", "/product/"+productId+"/images/0", nil)
+	assert.Equal(t, http.StatusNotFound, writer.Code)
+	assert.Contains(t, writer.Body.String(), "could not be processed")
+
+	writer = makeRequest("GET", "/product/"+productId+"/images/1", nil)
+	assert.Equal(t, http.StatusOK, writer.Code)
+	assert.Equal(t, "0123456789", writer.Body.String())
+}
+
+func uploadBody(t *testing.T, files map[string][]byte) ([]byte, string) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	for name, data := range files {
+		part, err := w.CreateFormFile("images", name)
+		assert.NoError(t, err)
+		part.Write(data)
+	}
+	assert.NoError(t, w.Close())
+	return buf.Bytes(), w.FormDataContentType()
+}
+
+func Test_API_HandleUploadImages(t *testing.T) {
+	product := createRandomProduct(t)
+	productId := strconv.Itoa(int(product.ID))
+
+	var img bytes.Buffer
+	assert.NoError(t, png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 2, 2))))
+
+	body, contentType := uploadBody(t, map[string][]byte{"a.png": img.Bytes()})
+	writer := makeRequestWithHeaders("POST", "/product/"+productId+"/images", body, map[string]string{
+		"Content-Type": contentType,
+		"If-Match":     productETag(product),
+	})
+	assert.Equal(t, http.StatusCreated, writer.Code)
+	var updated Product
+	assert.NoError(t, json.Unmarshal(writer.Body.Bytes(), &updated))
+	assert.Len(t, updated.Images, len(product.Images)+1)
+	assert.Equal(t, product.Version+1, updated.Version)
+	assert.Equal(t, productETag(updated), writer.Header().Get("ETag"))
+
+	uploaded := updated.Images[len(updated.Images)-1]
+	assert.True(t, testImageStore.Owns(uploaded))
+	obj, err := testImageStore.Get(context.Background(), uploaded)
+	assert.NoError(t, err)
+	obj.Body.Close()
+	assert.Equal(t, "image/png", obj.ContentType)
+
+	// stale version
+	writer = makeRequestWithHeaders("POST", "/product/"+productId+"/images", body, map[string]string{
+		"Content-Type": contentType,
+		"If-Match":     productETag(product),
+	})
+	assert.Equal(t, http.StatusPreconditionFailed, writer.Code)
+
+	body, contentType = uploadBody(t, map[string][]byte{"a.txt": []byte("not an image")})
+	writer = makeRequestWithHeaders("POST", "/product/"+productId+"/images", body, map[string]string{"Content-Type": contentType})
+	assert.Equal(t, http.StatusUnsupportedMediaType, writer.Code)
+
+	body, contentType = uploadBody(t, map[string][]byte{})
+	writer = makeRequestWithHeaders("POST", "/product/"+productId+"/images", body, map[string]string{"Content-Type": contentType})
+	assert.Equal(t, http.StatusUnprocessableEntity, writer.Code)
+
+	writer = makeRequest("POST", "/product/"+productId+"/images", []byte(`{}`))
+	assert.Equal(t, http.StatusBadRequest, writer.Code)
+
+	body, contentType = uploadBody(t, map[string][]byte{"a.png": img.Bytes()})
+	writer = makeRequestWithHeaders("POST", "/product/1000000/images", body, map[string]string{"Content-Type": contentType})
+	assert.Equal(t, http.StatusNotFound, writer.Code)
+
+	// a product may not grow past maxProductImages
+	full := make([]string, maxProductImages-len(updated.Images))
+	for i := range full {
+		full[i] = RandomString(5)
+	}
+	_, err = testPostgresStore.AddProductImages(int(product.ID), full, 0)
+	assert.NoError(t, err)
+	writer = makeRequestWithHeaders("POST", "/product/"+productId+"/images", body, map[string]string{"Content-Type": contentType})
+	assert.Equal(t, http.StatusUnprocessableEntity, writer.Code)
+	_, err = testPostgresStore.AddProductImages(int(product.ID), []string{RandomString(5)}, 0)
+	assert.ErrorIs(t, err, ErrTooManyImages)
+}
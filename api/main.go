@@ -1,20 +1,70 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/arjun/go-message-queue-api/auth"
+	"github.com/arjun/go-message-queue-api/blobstore"
+	"github.com/arjun/go-message-queue-api/config"
 	_ "github.com/lib/pq"
 )
 
 func main() {
-	postgres, err := NewPostgresStore(&Config{
-		"root", "secret", "user_db", "disable",
-	})
+	issue := flag.String("issue-token", "", "print a token signed with the first secret or private key of -jwks and exit: a user id, \"service\" or \"admin\"")
+	tokenTTL := flag.Duration("token-ttl", 24*time.Hour, "lifetime of the token printed by -issue-token")
+	cfg := defaultAPIConfig
+	config.MustLoad(&cfg, "API_CONFIG")
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	keys, err := auth.LoadKeySet(cfg.JWKS)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *issue != "" {
+		token, err := issueToken(keys, *issue, cfg.JWTIssuer, cfg.JWTAudience, *tokenTTL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(token)
+		return
+	}
+
+	postgres, err := NewPostgresStore(&cfg.Database)
 	if err != nil {
 		log.Fatal(err)
 	}
 	log.Println("db connection succesfull")
 
-	server := NewAPIServer(":3000", postgres)
-	server.Run()
+	relay := NewOutboxRelay(postgres, cfg.AMQPURL, cfg.Queue)
+	go relay.Run(ctx)
+
+	webhooks := NewWebhookDispatcher(postgres)
+	go webhooks.Run(ctx)
+
+	images, err := blobstore.Open(cfg.ImageStore)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	server := NewAPIServer(cfg.Listen, postgres, images)
+	server.legacyCreateResponse = cfg.LegacyCreateResponse
+	server.verifier = &auth.Verifier{Keys: keys, Issuer: cfg.JWTIssuer, Audience: cfg.JWTAudience, Leeway: time.Minute}
+	server.shutdownTimeout = cfg.ShutdownTimeout
+	server.quotas = QuotaLimits{Products: cfg.DailyProductQuota, Images: cfg.DailyImageQuota}
+	if cfg.RateLimit > 0 {
+		server.limiter = NewRateLimiter(cfg.RateLimit, cfg.RateBurst)
+	}
+	server.validator.ImageHosts = cfg.ImageHosts
+	if err := server.Run(ctx); err != nil {
+		log.Fatal(err)
+	}
+	log.Println("API Server stopped")
 }
@@ -2,12 +2,19 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/arjun/go-message-queue-api/auth"
+	"github.com/arjun/go-message-queue-api/blobstore"
 	"github.com/gorilla/mux"
 )
 
@@ -15,6 +22,10 @@ import (
 
 var testPostgresStore *PostgresStore
 var testAPIServer *APIServer
+var testImageStore *blobstore.LocalStore
+var testKeys *auth.KeySet
+
+const test_image_dir = "test_images"
 
 func TestMain(m *testing.M) {
 
@@ -25,33 +36,74 @@ func TestMain(m *testing.M) {
 }
 
 func setup() {
-	db, err := NewPostgresStore(&Config{
-		"root", "secret", "user_db", "disable",
-	})
+	db, err := NewPostgresStore(&defaultDatabaseConfig)
 	if err != nil {
 		log.Fatal("cannot connect to db", err)
 	}
 	testPostgresStore = db
-	testAPIServer = NewAPIServer(":3000", testPostgresStore)
+	testImageStore, err = blobstore.NewLocalStore(test_image_dir)
+	if err != nil {
+		log.Fatal("cannot create image store", err)
+	}
+	testAPIServer = NewAPIServer(":3000", testPostgresStore, testImageStore)
+	testKeys, err = newTestKeySet()
+	if err != nil {
+		log.Fatal("cannot generate keys", err)
+	}
+	testAPIServer.verifier = &auth.Verifier{Keys: testKeys}
+	go testAPIServer.events.Run(context.Background())
 }
 
 func teardown() {
-	testPostgresStore.db.Exec("TRUNCATE TABLE products")
+	testPostgresStore.db.Exec("TRUNCATE TABLE products, product_status")
+	testPostgresStore.db.Exec("TRUNCATE TABLE outbox")
+	testPostgresStore.db.Exec("TRUNCATE TABLE product_events")
+	testPostgresStore.db.Exec("TRUNCATE TABLE webhooks, webhook_deliveries")
+	testPostgresStore.db.Exec("TRUNCATE TABLE idempotency_keys")
+	testPostgresStore.db.Exec("TRUNCATE TABLE api_keys")
+	testPostgresStore.db.Exec("TRUNCATE TABLE user_quotas, daily_usage")
 	testPostgresStore.db.Exec("ALTER TABLE products AUTO_INCREMENT = 1")
+	os.RemoveAll(test_image_dir)
 }
 
 func makeRequest(method, url string, body []byte) *httptest.ResponseRecorder {
+	return makeRequestWithHeaders(method, url, body, nil)
+}
+
+// makeRequestWithHeaders sends a request as an admin unless headers has an
+// Authorization header.
+func makeRequestWithHeaders(method, url string, body []byte, headers map[string]string) *httptest.ResponseRecorder {
 	request, _ := http.NewRequest(method, url, bytes.NewBuffer(body))
+	request.Header.Set("Authorization", "Bearer "+testToken(RoleAdmin))
+	for k, v := range headers {
+		request.Header.Set(k, v)
+	}
 	writer := httptest.NewRecorder()
 	writer.Header().Set("Content-Type", "application/json")
 	router().ServeHTTP(writer, request)
 	return writer
 }
 
+// newTestKeySet returns a key set with a random HS256 secret, so that the
+// tests need no key from the tree.
+func newTestKeySet() (*auth.KeySet, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	jwks := fmt.Sprintf(`{"keys":[{"kty":"oct","kid":"test","alg":"HS256","use":"sig","k":%q}]}`, base64.RawURLEncoding.EncodeToString(secret))
+	return auth.ParseKeySet([]byte(jwks))
+}
+
+// testToken is a token of who, a user id or a role.
+func testToken(who string) string {
+	token, err := issueToken(testKeys, who, "", "", time.Hour)
+	if err != nil {
+		log.Fatal("cannot issue token", err)
+	}
+	return token
+}
+
 func router() *mux.Router {
-	router := mux.NewRouter()
-	router.HandleFunc("/product", makeHTTPHandleFunc(testAPIServer.handleCreateProduct)).Methods("POST")
-	router.HandleFunc("/product/{id}", makeHTTPHandleFunc(testAPIServer.handleGetProduct)).Methods("GET")
-	router.HandleFunc("/product/{id}", makeHTTPHandleFunc(testAPIServer.handleUpdateProduct)).Methods("POST")
-	return router
+	return testAPIServer.routes()
 }
@@ -5,15 +5,47 @@ import (
 )
 
 type Product struct {
-	ID               int64     `json:"id"`
-	Name             string    `json:"name"`
-	Description      string    `json:"description"`
-	Images           []string  `json:"images"`
-	Price            float64   `json:"price"`
-	UserID           int64     `json:"user_id"`
-	CompressedImages []string  `json:"compressed_images"`
-	CreatedAt        time.Time `json:"created_at"`
-	UpdatedAt        time.Time `json:"updated_at"`
+	ID               int64               `json:"id"`
+	Name             string              `json:"name"`
+	Description      string              `json:"description"`
+	Images           []string            `json:"images"`
+	Price            float64             `json:"price"`
+	UserID           int64               `json:"user_id"`
+	CompressedImages []string            `json:"compressed_images"`
+	Renditions       map[string][]string `json:"renditions,omitempty"`
+	CompressedBy     string              `json:"compressed_by,omitempty"`
+	CompressedAt     *time.Time          `json:"compressed_at,omitempty"`
+	Version          int64               `json:"version"`
+	CreatedAt        time.Time           `json:"created_at"`
+	UpdatedAt        time.Time           `json:"updated_at"`
+}
+
+// ProductPage is one page of GET /product. NextCursor is empty on the last page.
+type ProductPage struct {
+	Products   []Product `json:"products"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+}
+
+const (
+	CompressedImagesReplace = "replace"
+	CompressedImagesAppend  = "append"
+)
+
+// CompressedImagesRequest is the body of PUT /product/{id}/compressed-images.
+// Renditions maps a rendition name such as "thumb" to the paths of that
+// rendition; Images holds the paths of the primary rendition for clients
+// that do not know renditions. Sources are the product images the paths are
+// for, in the same order: their paths are set, and written again rather
+// than added to, whatever the mode. Without Sources the paths are in the
+// order of the product images and Mode is either replace (the default), for
+// all of them, or append, for those not compressed yet. Worker names the
+// writer.
+type CompressedImagesRequest struct {
+	Images     []string            `json:"images"`
+	Renditions map[string][]string `json:"renditions"`
+	Sources    []string            `json:"sources"`
+	Mode       string              `json:"mode"`
+	Worker     string              `json:"worker"`
 }
 
 type User struct {
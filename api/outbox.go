@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// productJobTopic is the outbox topic of product image processing jobs. The
+// payload is the product id, which is what the consumer expects on its queue.
+const productJobTopic = "product.process"
+
+// productImagesJobTopic is the outbox topic of jobs that process only some
+// images of a product. The payload is a ProductImagesJob as JSON.
+const productImagesJobTopic = "product.images.process"
+
+// ProductImagesJob asks the consumer to process the given images of a
+// product and append them to its compressed images.
+type ProductImagesJob struct {
+	ProductID int      `json:"product_id"`
+	Images    []string `json:"images"`
+}
+
+// outboxContentTypes maps the known outbox topics to the content type of
+// their payload.
+var outboxContentTypes = map[string]string{
+	productJobTopic:       "text/plain",
+	productImagesJobTopic: "application/json",
+}
+
+const (
+	outboxBatchSize    = 100
+	outboxPollInterval = time.Second
+	// outboxPublishTimeout bounds the wait for the broker to confirm a
+	// message
+	outboxPublishTimeout = 10 * time.Second
+	// outboxLease is how long claimed messages are hidden from other relays;
+	// messages a relay did not get to publish by then are left to the others
+	outboxLease         = time.Minute
+	outboxRetention     = 7 * 24 * time.Hour
+	outboxReconnectWait = 5 * time.Second
+)
+
+// OutboxMessage is a job written to the outbox table together with the row
+// it refers to, waiting to be published to the queue.
+type OutboxMessage struct {
+	ID       int64
+	Topic    string
+	Payload  string
+	Attempts int
+}
+
+const (
+	enqueueOutboxQuery = `
+	INSERT INTO outbox (
+	topic, payload
+	) VALUES (
+	$1, $2
+	)
+	`
+
+	// claimOutboxQuery hides up to $1 unpublished messages from the other
+	// relays for $2 seconds and returns them
+	claimOutboxQuery = `
+	UPDATE outbox
+	SET claimed_until = NOW() + make_interval(secs => $2)
+	WHERE id IN (
+		SELECT id FROM outbox
+		WHERE published_at IS NULL AND (claimed_until IS NULL OR claimed_until <= NOW())
+		ORDER BY id
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED
+	)
+	RETURNING id, topic, payload, attempts
+	`
+
+	markOutboxPublishedQuery = `
+	UPDATE outbox
+	SET published_at = (SELECT NOW()), attempts = attempts + 1, last_error = NULL, claimed_until = NULL
+	WHERE id = $1
+	`
+
+	markOutboxFailedQuery = `
+	UPDATE outbox
+	SET attempts = attempts + 1, last_error = $2, claimed_until = NULL
+	WHERE id = $1
+	`
+
+	// releaseOutboxQuery hands claimed messages that were not published back
+	// to the relays
+	releaseOutboxQuery = `
+	UPDATE outbox
+	SET claimed_until = NULL
+	WHERE id = ANY($1) AND published_at IS NULL
+	`
+
+	pruneOutboxQuery = `
+	DELETE FROM outbox
+	WHERE published_at < $1
+	`
+)
+
+func enqueueOutbox(tx *sql.Tx, topic, payload string) error {
+	_, err := tx.Exec(enqueueOutboxQuery, topic, payload)
+	return err
+}
+
+// RelayOutbox claims up to limit unpublished messages for lease, hands them
+// to publish in order, outside of any transaction, and marks the ones that
+// were published. It stops at the first failed message, which is retried by
+// the next call, or when the lease runs out, and hands the rest back. Messages
+// claimed by another relay are skipped, so several API instances can drain
+// the outbox concurrently.
+func (s *PostgresStore) RelayOutbox(limit int, lease time.Duration, publish func(OutboxMessage) error) (int, error) {
+	deadline := time.Now().Add(lease)
+	messages, err := s.claimOutbox(limit, lease)
+	if err != nil {
+		return 0, err
+	}
+
+	published := 0
+	var publishErr error
+	for _, m := range messages {
+		if time.Now().After(deadline) {
+			break
+		}
+		if publishErr = publish(m); publishErr != nil {
+			if _, err := s.db.Exec(markOutboxFailedQuery, m.ID, publishErr.Error()); err != nil {
+				return published, err
+			}
+			break
+		}
+		if _, err := s.db.Exec(markOutboxPublishedQuery, m.ID); err != nil {
+			return published, err
+		}
+		published++
+	}
+
+	// hand back what was not published
+	if rest := messages[published:]; len(rest) > 0 {
+		ids := make([]int64, len(rest))
+		for i, m := range rest {
+			ids[i] = m.ID
+		}
+		if _, err := s.db.Exec(releaseOutboxQuery, pq.Array(ids)); err != nil {
+			return published, err
+		}
+	}
+
+	return published, publishErr
+}
+
+func (s *PostgresStore) claimOutbox(limit int, lease time.Duration) ([]OutboxMessage, error) {
+	rows, err := s.db.Query(claimOutboxQuery, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := make([]OutboxMessage, 0)
+	for rows.Next() {
+		var m OutboxMessage
+		if err := rows.Scan(&m.ID, &m.Topic, &m.Payload, &m.Attempts); err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// RETURNING does not keep the order of the claim
+	sort.Slice(messages, func(i, j int) bool { return messages[i].ID < messages[j].ID })
+	return messages, nil
+}
+
+// PruneOutbox deletes messages published more than olderThan ago.
+func (s *PostgresStore) PruneOutbox(olderThan time.Duration) (int64, error) {
+	res, err := s.db.Exec(pruneOutboxQuery, time.Now().Add(-olderThan))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// OutboxRelay publishes outbox messages to the processing queue. A message is
+// only marked as published after the broker confirmed it, so delivery is at
+// least once: a crash between confirm and marking, or a lease that runs out,
+// publishes it again.
+type OutboxRelay struct {
+	store     Storage
+	amqpURL   string
+	queueName string
+}
+
+func NewOutboxRelay(store Storage, amqpURL, queueName string) *OutboxRelay {
+	return &OutboxRelay{
+		store:     store,
+		amqpURL:   amqpURL,
+		queueName: queueName,
+	}
+}
+
+// Run relays messages until ctx is cancelled, reconnecting to the broker
+// whenever the connection is lost.
+func (r *OutboxRelay) Run(ctx context.Context) {
+	for {
+		err := r.relay(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("outbox relay: %s, reconnecting in %s", err, outboxReconnectWait)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(outboxReconnectWait):
+		}
+	}
+}
+
+func (r *OutboxRelay) relay(ctx context.Context) error {
+	conn, err := amqp.Dial(r.amqpURL)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	queue, err := ch.QueueDeclare(
+		r.queueName, // name
+		true,        // durable
+		false,       // delete when unused
+		false,       // exclusive
+		false,       // no-wait
+		nil,         // arguments
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := ch.Confirm(false); err != nil {
+		return err
+	}
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+
+	publish := func(m OutboxMessage) error {
+		contentType, ok := outboxContentTypes[m.Topic]
+		if !ok {
+			return fmt.Errorf("unknown outbox topic %q", m.Topic)
+		}
+		ctx, cancel := context.WithTimeout(ctx, outboxPublishTimeout)
+		defer cancel()
+		confirm, err := ch.PublishWithDeferredConfirmWithContext(ctx,
+			"",         // exchange
+			queue.Name, // routing key
+			false,      // mandatory
+			false,      // immediate
+			amqp.Publishing{
+				ContentType:  contentType,
+				DeliveryMode: amqp.Persistent,
+				MessageId:    fmt.Sprintf("outbox-%d", m.ID),
+				Body:         []byte(m.Payload),
+			})
+		if err != nil {
+			return err
+		}
+		acked, err := confirm.WaitContext(ctx)
+		if err != nil {
+			return err
+		}
+		if !acked {
+			return errors.New("message nacked by broker")
+		}
+		return nil
+	}
+
+	prune := time.NewTicker(time.Hour)
+	defer prune.Stop()
+	poll := time.NewTimer(0)
+	defer poll.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case amqpErr := <-closed:
+			return fmt.Errorf("channel closed: %v", amqpErr)
+		case <-prune.C:
+			if _, err := r.store.PruneOutbox(outboxRetention); err != nil {
+				log.Printf("outbox relay: prune: %s", err)
+			}
+		case <-poll.C:
+			n, err := r.store.RelayOutbox(outboxBatchSize, outboxLease, publish)
+			if n > 0 {
+				log.Printf("outbox relay: published %d messages", n)
+			}
+			if err != nil {
+				return err
+			}
+			// keep draining without waiting while there is a backlog
+			if n == outboxBatchSize {
+				poll.Reset(0)
+			} else {
+				poll.Reset(outboxPollInterval)
+			}
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_DB_RelayOutbox(t *testing.T) {
+	product := createRandomProduct(t)
+	productId := strconv.Itoa(int(product.ID))
+
+	// a failed publish keeps the message pending
+	_, err := testPostgresStore.RelayOutbox(1000, time.Minute, func(m OutboxMessage) error {
+		return errors.New("broker down")
+	})
+	assert.Error(t, err)
+
+	// a claimed message is hidden from other relays while it is published,
+	// and handed back when the publish fails
+	published := make([]string, 0)
+	_, err = testPostgresStore.RelayOutbox(1, time.Minute, func(m OutboxMessage) error {
+		_, err := testPostgresStore.RelayOutbox(1000, time.Minute, func(other OutboxMessage) error {
+			assert.NotEqual(t, m.ID, other.ID)
+			published = append(published, other.Payload)
+			return nil
+		})
+		assert.NoError(t, err)
+		return errors.New("broker down")
+	})
+	assert.Error(t, err)
+
+	for {
+		n, err := testPostgresStore.RelayOutbox(1000, time.Minute, func(m OutboxMessage) error {
+			assert.Equal(t, productJobTopic, m.Topic)
+			published = append(published, m.Payload)
+			return nil
+		})
+		assert.NoError(t, err)
+		if n == 0 {
+			break
+		}
+	}
+	assert.Contains(t, published, productId)
+
+	// published messages are not handed out again
+	_, err = testPostgresStore.RelayOutbox(1000, time.Minute, func(m OutboxMessage) error {
+		assert.NotEqual(t, productId, m.Payload)
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func Test_DB_UpdateProductImagesEnqueuesJob(t *testing.T) {
+	product := createRandomProduct(t)
+	images := []string{RandomString(5)}
+	_, err := testPostgresStore.UpdateProduct(UpdateProductParams{
+		ID:              int(product.ID),
+		ExpectedVersion: product.Version,
+		Images:          &images,
+	})
+	assert.NoError(t, err)
+
+	var jobs int
+	err = testPostgresStore.db.QueryRow(`SELECT COUNT(*) FROM outbox WHERE payload = $1`, strconv.Itoa(int(product.ID))).Scan(&jobs)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, jobs)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Error codes of a Problem. They are part of the API: clients branch on them,
+// so an existing code must not change meaning.
+const (
+	CodeBadRequest           = "bad_request"
+	CodeUnauthenticated      = "unauthenticated"
+	CodeForbidden            = "forbidden"
+	CodeInvalidID            = "invalid_id"
+	CodeInvalidParameter     = "invalid_parameter"
+	CodeMalformedBody        = "malformed_body"
+	CodeValidationFailed     = "validation_failed"
+	CodePayloadTooLarge      = "payload_too_large"
+	CodeUnsupportedMediaType = "unsupported_media_type"
+	CodeProductNotFound      = "product_not_found"
+	CodeUserNotFound         = "user_not_found"
+	CodeWebhookNotFound      = "webhook_not_found"
+	CodeAPIKeyNotFound       = "api_key_not_found"
+	CodeImageNotFound        = "image_not_found"
+	CodePreconditionRequired = "precondition_required"
+	CodeVersionMismatch      = "version_mismatch"
+	CodeConflict             = "conflict"
+	CodeUserHasProducts      = "user_has_products"
+	CodeInvalidTransition    = "invalid_transition"
+	CodeIdempotencyKeyReused = "idempotency_key_reused"
+	CodeIdempotencyKeyInUse  = "idempotency_key_in_use"
+	CodeImageStoreError      = "image_store_error"
+	CodeRateLimited          = "rate_limited"
+	CodeQuotaExceeded        = "quota_exceeded"
+	CodeInternal             = "internal_error"
+	CodeUnavailable          = "service_unavailable"
+)
+
+// Codes of a FieldError.
+const (
+	FieldRequired   = "required"
+	FieldInvalid    = "invalid"
+	FieldOutOfRange = "out_of_range"
+	FieldDuplicate  = "duplicate"
+	FieldNotFound   = "not_found"
+	FieldUnknown    = "unknown"
+)
+
+// problemTypeBase prefixes the code of a problem to make its type URI.
+const problemTypeBase = "/problems/"
+
+// Problem is an RFC 7807 problem details object, the body of every error
+// response. Code is the stable, machine-readable reason; Errors lists the
+// offending fields of a request that failed validation.
+type Problem struct {
+	Type   string       `json:"type"`
+	Title  string       `json:"title"`
+	Status int          `json:"status"`
+	Detail string       `json:"detail,omitempty"`
+	Code   string       `json:"code"`
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+func NewProblem(status int, code, detail string) *Problem {
+	return &Problem{
+		Type:   problemTypeBase + code,
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	}
+}
+
+func (p *Problem) Error() string {
+	if p.Detail != "" {
+		return p.Detail
+	}
+	return p.Title
+}
+
+// FieldError is the reason a request field is invalid. Field is the path of
+// the field in the payload, like "images[2]" or "renditions.zoom".
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e FieldError) Error() string {
+	return e.Field + " " + e.Message
+}
+
+func fieldError(field, code, format string, a ...any) FieldError {
+	return FieldError{Field: field, Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// FieldErrors are all the invalid fields of a request.
+type FieldErrors []FieldError
+
+func (e FieldErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, fe := range e {
+		msgs[i] = fe.Error()
+	}
+	return strings.Join(msgs, ", ")
+}
+
+// validationProblem is the 422 answer to a payload with invalid fields.
+func validationProblem(errs ...FieldError) *Problem {
+	p := NewProblem(http.StatusUnprocessableEntity, CodeValidationFailed, FieldErrors(errs).Error())
+	p.Errors = errs
+	return p
+}
+
+// parameterProblem is the 400 answer to a bad query parameter or header.
+func parameterProblem(errs ...FieldError) *Problem {
+	p := NewProblem(http.StatusBadRequest, CodeInvalidParameter, FieldErrors(errs).Error())
+	p.Errors = errs
+	return p
+}
+
+func malformedBody(err error) *Problem {
+	return NewProblem(http.StatusBadRequest, CodeMalformedBody, "payload decode error "+err.Error())
+}
+
+func invalidID(what string) *Problem {
+	return NewProblem(http.StatusBadRequest, CodeInvalidID, "bad "+what+" id")
+}
+
+func productNotFound() *Problem {
+	return NewProblem(http.StatusNotFound, CodeProductNotFound, "product id not found")
+}
+
+func userNotFound() *Problem {
+	return NewProblem(http.StatusNotFound, CodeUserNotFound, "user id not found")
+}
+
+func webhookNotFound() *Problem {
+	return NewProblem(http.StatusNotFound, CodeWebhookNotFound, "webhook id not found")
+}
+
+func apiKeyNotFound() *Problem {
+	return NewProblem(http.StatusNotFound, CodeAPIKeyNotFound, "API key id not found")
+}
+
+// problemFor maps an error to the problem reported for it. Problems and
+// field errors keep their meaning; any other error is a failure of the
+// server, whose details are logged rather than shown to the client.
+func problemFor(err error) *Problem {
+	var p *Problem
+	if errors.As(err, &p) {
+		return p
+	}
+	var fes FieldErrors
+	if errors.As(err, &fes) {
+		return validationProblem(fes...)
+	}
+	var fe FieldError
+	if errors.As(err, &fe) {
+		return validationProblem(fe)
+	}
+	var maxBytes *http.MaxBytesError
+	if errors.As(err, &maxBytes) {
+		return NewProblem(http.StatusRequestEntityTooLarge, CodePayloadTooLarge, err.Error())
+	}
+	if errors.Is(err, ErrVersionMismatch) {
+		return NewProblem(http.StatusPreconditionFailed, CodeVersionMismatch, "product was modified, fetch it again")
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code.Class() {
+		// data exception: a value the database cannot store
+		case "22":
+			return NewProblem(http.StatusUnprocessableEntity, CodeValidationFailed, pqErr.Message)
+		// integrity constraint violation
+		case "23":
+			return NewProblem(http.StatusConflict, CodeConflict, pqErr.Message)
+		}
+	}
+
+	log.Printf("internal error: %s", err)
+	if isUnavailable(err) {
+		return NewProblem(http.StatusServiceUnavailable, CodeUnavailable, "the service is temporarily unavailable, retry later")
+	}
+	return NewProblem(http.StatusInternalServerError, CodeInternal, "internal server error")
+}
+
+// isUnavailable reports whether err is the database being unreachable or
+// overloaded, a condition a retry may get past.
+func isUnavailable(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code.Class() {
+		// connection exception, insufficient resources, operator intervention
+		case "08", "53", "57":
+			return true
+		}
+	}
+	return false
+}
+
+// WriteProblem writes p as an application/problem+json response.
+func WriteProblem(w http.ResponseWriter, p *Problem) error {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	return json.NewEncoder(w).Encode(p)
+}
+
+// writeError writes the problem for err, see problemFor.
+func writeError(w http.ResponseWriter, err error) error {
+	return WriteProblem(w, problemFor(err))
+}
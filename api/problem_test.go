@@ -0,0 +1,71 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Problem_For(t *testing.T) {
+	for _, tc := range []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{productNotFound(), http.StatusNotFound, CodeProductNotFound},
+		{fmt.Errorf("wrapped: %w", userNotFound()), http.StatusNotFound, CodeUserNotFound},
+		{fieldError("name", FieldRequired, "is required"), http.StatusUnprocessableEntity, CodeValidationFailed},
+		{FieldErrors{fieldError("a", FieldRequired, "is required")}, http.StatusUnprocessableEntity, CodeValidationFailed},
+		{ErrVersionMismatch, http.StatusPreconditionFailed, CodeVersionMismatch},
+		{&http.MaxBytesError{Limit: 10}, http.StatusRequestEntityTooLarge, CodePayloadTooLarge},
+		{&pq.Error{Code: "22P02", Message: "invalid input syntax for type numeric"}, http.StatusUnprocessableEntity, CodeValidationFailed},
+		{&pq.Error{Code: "23505", Message: "duplicate key"}, http.StatusConflict, CodeConflict},
+		{&pq.Error{Code: "57P01", Message: "terminating connection"}, http.StatusServiceUnavailable, CodeUnavailable},
+		{driver.ErrBadConn, http.StatusServiceUnavailable, CodeUnavailable},
+		{errors.New("boom"), http.StatusInternalServerError, CodeInternal},
+	} {
+		p := problemFor(tc.err)
+		assert.Equal(t, tc.status, p.Status, tc.err.Error())
+		assert.Equal(t, tc.code, p.Code, tc.err.Error())
+		assert.Equal(t, problemTypeBase+tc.code, p.Type)
+		assert.Equal(t, http.StatusText(tc.status), p.Title)
+	}
+
+	// internal errors are not shown to the client
+	assert.NotContains(t, problemFor(errors.New("password=secret")).Detail, "secret")
+}
+
+func Test_Problem_Write(t *testing.T) {
+	writer := httptest.NewRecorder()
+	assert.NoError(t, writeError(writer, FieldErrors{
+		fieldError("images[0]", FieldInvalid, "has no host"),
+		fieldError("price", FieldRequired, "is required"),
+	}))
+	assert.Equal(t, http.StatusUnprocessableEntity, writer.Code)
+	assert.Equal(t, "application/problem+json", writer.Header().Get("Content-Type"))
+
+	var p Problem
+	assert.NoError(t, json.Unmarshal(writer.Body.Bytes(), &p))
+	assert.Equal(t, "images[0] has no host, price is required", p.Detail)
+	assert.Len(t, p.Errors, 2)
+	assert.Equal(t, "images[0]", p.Errors[0].Field)
+}
+
+func Test_Problem_RequireFields(t *testing.T) {
+	assert.NoError(t, requireFields("is required", map[string]bool{"name": false}))
+
+	err := requireFields("is required", map[string]bool{"price": true, "name": true, "description": false})
+	var errs FieldErrors
+	assert.True(t, errors.As(err, &errs))
+	assert.Equal(t, FieldErrors{
+		{Field: "name", Code: FieldRequired, Message: "is required"},
+		{Field: "price", Code: FieldRequired, Message: "is required"},
+	}, errs)
+}
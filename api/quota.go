@@ -0,0 +1,262 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// QuotaLimits are the products and images a user may submit per UTC day.
+// Zero is unlimited.
+type QuotaLimits struct {
+	Products int `json:"daily_products"`
+	Images   int `json:"daily_images"`
+}
+
+var defaultQuotaLimits = QuotaLimits{Products: 10000, Images: 100000}
+
+// QuotaUsage is what a user submitted on Day against their limits.
+type QuotaUsage struct {
+	UserID   int         `json:"user_id"`
+	Day      time.Time   `json:"day"`
+	Products int         `json:"products"`
+	Images   int         `json:"images"`
+	Limits   QuotaLimits `json:"limits"`
+}
+
+// ErrQuotaExceeded is returned by ConsumeQuota when the usage would pass a
+// limit; nothing is consumed then.
+var ErrQuotaExceeded = errors.New("daily quota exceeded")
+
+const (
+	// consumeQuotaQuery adds $2 products and $3 images to the usage of user
+	// $1 today, unless that passes their limits, else the defaults $4 and $5.
+	// Negative amounts refund. No row is returned when a limit would pass.
+	consumeQuotaQuery = `
+	WITH limits AS (
+	SELECT COALESCE(q.daily_products, $4) AS products, COALESCE(q.daily_images, $5) AS images
+	FROM (SELECT 1) AS one LEFT JOIN user_quotas q ON q.user_id = $1
+	)
+	INSERT INTO daily_usage AS u (user_id, day, products, images)
+	SELECT $1, (NOW() AT TIME ZONE 'UTC')::date, GREATEST($2, 0), GREATEST($3, 0) FROM limits
+	WHERE (limits.products = 0 OR $2 <= limits.products)
+	AND (limits.images = 0 OR $3 <= limits.images)
+	ON CONFLICT (user_id, day) DO UPDATE
+	SET products = GREATEST(u.products + $2, 0),
+	images = GREATEST(u.images + $3, 0)
+	WHERE ((SELECT products FROM limits) = 0 OR $2 <= 0 OR u.products + $2 <= (SELECT products FROM limits))
+	AND ((SELECT images FROM limits) = 0 OR $3 <= 0 OR u.images + $3 <= (SELECT images FROM limits))
+	RETURNING u.day, u.products, u.images, (SELECT products FROM limits), (SELECT images FROM limits)
+	`
+
+	getQuotaUsageQuery = `
+	SELECT (NOW() AT TIME ZONE 'UTC')::date, COALESCE(u.products, 0), COALESCE(u.images, 0),
+	COALESCE(q.daily_products, $2), COALESCE(q.daily_images, $3)
+	FROM (SELECT 1) AS one
+	LEFT JOIN user_quotas q ON q.user_id = $1
+	LEFT JOIN daily_usage u ON u.user_id = $1 AND u.day = (NOW() AT TIME ZONE 'UTC')::date
+	`
+
+	setUserQuotaQuery = `
+	INSERT INTO user_quotas (
+	user_id, daily_products, daily_images
+	) VALUES (
+	$1, $2, $3
+	)
+	ON CONFLICT (user_id) DO UPDATE
+	SET daily_products = EXCLUDED.daily_products,
+	daily_images = EXCLUDED.daily_images
+	`
+)
+
+func scanQuotaUsage(row rowScanner, userId int) (QuotaUsage, error) {
+	u := QuotaUsage{UserID: userId}
+	err := row.Scan(&u.Day, &u.Products, &u.Images, &u.Limits.Products, &u.Limits.Images)
+	return u, err
+}
+
+// ConsumeQuota adds products and images to today's usage of a user, or
+// returns the usage and ErrQuotaExceeded if that would pass a limit. The
+// limits of the user apply, or else defaults.
+func (s *PostgresStore) ConsumeQuota(userId, products, images int, defaults QuotaLimits) (QuotaUsage, error) {
+	usage, err := scanQuotaUsage(s.db.QueryRow(consumeQuotaQuery, userId, products, images, defaults.Products, defaults.Images), userId)
+	if err == sql.ErrNoRows {
+		usage, err = s.GetQuotaUsage(userId, defaults)
+		if err != nil {
+			return QuotaUsage{}, err
+		}
+		return usage, ErrQuotaExceeded
+	}
+	return usage, err
+}
+
+func (s *PostgresStore) GetQuotaUsage(userId int, defaults QuotaLimits) (QuotaUsage, error) {
+	return scanQuotaUsage(s.db.QueryRow(getQuotaUsageQuery, userId, defaults.Products, defaults.Images), userId)
+}
+
+func (s *PostgresStore) SetUserQuota(userId int, limits QuotaLimits) error {
+	_, err := s.db.Exec(setUserQuotaQuery, userId, limits.Products, limits.Images)
+	return err
+}
+
+// nextQuotaReset is when the daily quotas start over, the next UTC midnight.
+func nextQuotaReset(now time.Time) time.Time {
+	return now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+}
+
+// writeQuotaHeaders reports the quota of a user in the response.
+func writeQuotaHeaders(w http.ResponseWriter, usage QuotaUsage) {
+	remaining := func(limit, used int) string {
+		if limit == 0 {
+			return "unlimited"
+		}
+		return strconv.Itoa(max(limit-used, 0))
+	}
+	w.Header().Set("X-Quota-Products-Limit", strconv.Itoa(usage.Limits.Products))
+	w.Header().Set("X-Quota-Products-Remaining", remaining(usage.Limits.Products, usage.Products))
+	w.Header().Set("X-Quota-Images-Limit", strconv.Itoa(usage.Limits.Images))
+	w.Header().Set("X-Quota-Images-Remaining", remaining(usage.Limits.Images, usage.Images))
+	w.Header().Set("X-Quota-Reset", nextQuotaReset(time.Now()).Format(http.TimeFormat))
+}
+
+// consumeQuota takes products and images from the daily quota of a user and
+// reports it in the response. The error is a 429 problem if the quota is
+// used up.
+func (s *APIServer) consumeQuota(w http.ResponseWriter, userId, products, images int) error {
+	usage, err := s.store.ConsumeQuota(userId, products, images, s.quotas)
+	if err != nil && !errors.Is(err, ErrQuotaExceeded) {
+		return err
+	}
+	writeQuotaHeaders(w, usage)
+	if err != nil {
+		return quotaExceeded(w, userId)
+	}
+	return nil
+}
+
+// quotaExceeded is the 429 problem of a user whose quota is used up, who may
+// retry once the quotas reset.
+func quotaExceeded(w http.ResponseWriter, userId int) *Problem {
+	retryAfter := time.Until(nextQuotaReset(time.Now()))
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	return NewProblem(http.StatusTooManyRequests, CodeQuotaExceeded, "daily quota of user "+strconv.Itoa(userId)+" exceeded")
+}
+
+// quotaDemand is what a request takes from the daily quota of a user.
+type quotaDemand struct {
+	products, images int
+}
+
+// consumeQuotas is consumeQuota for many users at once: if the quota of any
+// is used up, nothing is consumed. The headers report the quota only when
+// there is one user.
+func (s *APIServer) consumeQuotas(w http.ResponseWriter, demands map[int]quotaDemand) error {
+	if len(demands) == 1 {
+		for userId, d := range demands {
+			return s.consumeQuota(w, userId, d.products, d.images)
+		}
+	}
+
+	userIds := make([]int, 0, len(demands))
+	for userId := range demands {
+		userIds = append(userIds, userId)
+	}
+	sort.Ints(userIds)
+	for n, userId := range userIds {
+		d := demands[userId]
+		_, err := s.store.ConsumeQuota(userId, d.products, d.images, s.quotas)
+		if err == nil {
+			continue
+		}
+		for _, consumed := range userIds[:n] {
+			s.refundQuota(consumed, demands[consumed].products, demands[consumed].images)
+		}
+		if errors.Is(err, ErrQuotaExceeded) {
+			return quotaExceeded(w, userId)
+		}
+		return err
+	}
+	return nil
+}
+
+// refundQuota gives back quota consumed for work that was not done. A
+// failed refund is only logged: it errs in favour of the limits.
+func (s *APIServer) refundQuota(userId, products, images int) {
+	if products == 0 && images == 0 {
+		return
+	}
+	if _, err := s.store.ConsumeQuota(userId, -products, -images, s.quotas); err != nil {
+		log.Printf("quota of user %d: refund: %s", userId, err)
+	}
+}
+
+func (s *APIServer) handleGetUserQuota(w http.ResponseWriter, r *http.Request) error {
+
+	userId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return WriteProblem(w, invalidID("user"))
+	}
+	if err := authorizeUser(r, userId); err != nil {
+		return writeError(w, err)
+	}
+	if err := s.store.CheckUserID(userId); err != nil {
+		if err == sql.ErrNoRows {
+			return WriteProblem(w, userNotFound())
+		}
+		return writeError(w, err)
+	}
+
+	usage, err := s.store.GetQuotaUsage(userId, s.quotas)
+	if err != nil {
+		return writeError(w, err)
+	}
+	writeQuotaHeaders(w, usage)
+
+	return WriteJSON(w, http.StatusOK, usage)
+}
+
+// handleSetUserQuota sets the daily limits of a user, in place of the
+// defaults of the server.
+func (s *APIServer) handleSetUserQuota(w http.ResponseWriter, r *http.Request) error {
+
+	userId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return WriteProblem(w, invalidID("user"))
+	}
+
+	var limits QuotaLimits
+	if err := decodePayload(r.Body, &limits); err != nil {
+		return writeError(w, err)
+	}
+	var errs FieldErrors
+	if limits.Products < 0 {
+		errs = append(errs, fieldError("daily_products", FieldOutOfRange, "must not be negative"))
+	}
+	if limits.Images < 0 {
+		errs = append(errs, fieldError("daily_images", FieldOutOfRange, "must not be negative"))
+	}
+	if errs != nil {
+		return writeError(w, errs)
+	}
+
+	if err := s.store.SetUserQuota(userId, limits); err != nil {
+		if isForeignKeyViolation(err) {
+			return WriteProblem(w, userNotFound())
+		}
+		return writeError(w, err)
+	}
+	usage, err := s.store.GetQuotaUsage(userId, s.quotas)
+	if err != nil {
+		return writeError(w, err)
+	}
+	writeQuotaHeaders(w, usage)
+
+	return WriteJSON(w, http.StatusOK, usage)
+}
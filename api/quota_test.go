@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Quota_NextReset(t *testing.T) {
+	now := time.Date(2024, 3, 1, 23, 30, 0, 0, time.FixedZone("", 2*60*60))
+	assert.Equal(t, time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC), nextQuotaReset(now))
+}
+
+func Test_DB_Quota(t *testing.T) {
+	user := createRandomUser(t)
+	userId := int(user.ID)
+	defaults := QuotaLimits{Products: 2, Images: 3}
+
+	usage, err := testPostgresStore.ConsumeQuota(userId, 1, 3, defaults)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, usage.Products)
+	assert.Equal(t, 3, usage.Images)
+	assert.Equal(t, defaults, usage.Limits)
+
+	// nothing is consumed past a limit
+	usage, err = testPostgresStore.ConsumeQuota(userId, 1, 1, defaults)
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+	assert.Equal(t, 1, usage.Products)
+	assert.Equal(t, 3, usage.Images)
+
+	usage, err = testPostgresStore.ConsumeQuota(userId, -1, -3, defaults)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, usage.Products)
+	assert.Equal(t, 0, usage.Images)
+
+	// the limits of the user replace the defaults, 0 is unlimited
+	assert.NoError(t, testPostgresStore.SetUserQuota(userId, QuotaLimits{Products: 0, Images: 1}))
+	usage, err = testPostgresStore.ConsumeQuota(userId, 100, 1, defaults)
+	assert.NoError(t, err)
+	assert.Equal(t, QuotaLimits{Products: 0, Images: 1}, usage.Limits)
+	_, err = testPostgresStore.ConsumeQuota(userId, 0, 1, defaults)
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+
+	usage, err = testPostgresStore.GetQuotaUsage(userId, defaults)
+	assert.NoError(t, err)
+	assert.Equal(t, 100, usage.Products)
+	assert.Equal(t, 1, usage.Images)
+}
+
+func Test_API_Quota(t *testing.T) {
+	user := createRandomUser(t)
+	id := strconv.FormatInt(user.ID, 10)
+	as := map[string]string{"Authorization": "Bearer " + testToken(id)}
+
+	writer := makeRequestWithHeaders("PUT", "/user/"+id+"/quota", []byte(`{"daily_products":1,"daily_images":2}`), as)
+	assert.Equal(t, http.StatusForbidden, writer.Code)
+	writer = makeRequest("PUT", "/user/"+id+"/quota", []byte(`{"daily_products":-1,"daily_images":2}`))
+	assert.Equal(t, http.StatusUnprocessableEntity, writer.Code)
+	writer = makeRequest("PUT", "/user/"+id+"/quota", []byte(`{"daily_products":1,"daily_images":2}`))
+	assert.Equal(t, http.StatusOK, writer.Code)
+	writer = makeRequest("PUT", "/user/1000000/quota", []byte(`{"daily_products":1,"daily_images":2}`))
+	assert.Equal(t, http.StatusNotFound, writer.Code)
+
+	product := []byte(`{"name":"quota","description":"d","images":["http://example.com/a.png"],"price":"10","user_id":` + id + `}`)
+	writer = makeRequestWithHeaders("POST", "/product", product, as)
+	assert.Equal(t, http.StatusCreated, writer.Code)
+	assert.Equal(t, "1", writer.Header().Get("X-Quota-Products-Limit"))
+	assert.Equal(t, "0", writer.Header().Get("X-Quota-Products-Remaining"))
+	assert.Equal(t, "1", writer.Header().Get("X-Quota-Images-Remaining"))
+	assert.NotEmpty(t, writer.Header().Get("X-Quota-Reset"))
+
+	writer = makeRequestWithHeaders("POST", "/product", product, as)
+	assert.Equal(t, http.StatusTooManyRequests, writer.Code)
+	assert.Contains(t, writer.Body.String(), CodeQuotaExceeded)
+	assert.NotEmpty(t, writer.Header().Get("Retry-After"))
+
+	// a bulk import over the quota creates nothing
+	writer = makeRequestWithHeaders("POST", "/product/bulk", []byte(`[`+string(product)+`]`), as)
+	assert.Equal(t, http.StatusTooManyRequests, writer.Code)
+
+	writer = makeRequestWithHeaders("GET", "/user/"+id+"/quota", nil, as)
+	assert.Equal(t, http.StatusOK, writer.Code)
+	var usage QuotaUsage
+	assert.NoError(t, json.Unmarshal(writer.Body.Bytes(), &usage))
+	assert.Equal(t, 1, usage.Products)
+	assert.Equal(t, 1, usage.Images)
+	writer = makeRequestWithHeaders("GET", "/user/"+id+"/quota", nil, map[string]string{"Authorization": "Bearer " + testToken("17")})
+	assert.Equal(t, http.StatusForbidden, writer.Code)
+}
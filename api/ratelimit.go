@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// bucket is the token bucket of one client.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter is a token bucket per client: each holds up to burst tokens
+// and gains rate tokens a second, and every request takes one.
+type RateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		rate:    rate,
+		burst:   float64(max(burst, 1)),
+		buckets: map[string]*bucket{},
+		now:     time.Now,
+	}
+}
+
+// Allow takes a token from the bucket of key. It returns whether there was
+// one, the whole tokens left and, if there was none, how long until there is.
+func (l *RateLimiter) Allow(key string) (ok bool, remaining int, wait time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := l.fill(key)
+	if b.tokens < 1 {
+		return false, 0, l.wait(b)
+	}
+	b.tokens--
+	return true, int(b.tokens), 0
+}
+
+// Wait returns how long until the bucket of key has a token, without taking
+// it, or 0 if it has one.
+func (l *RateLimiter) Wait(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := l.fill(key)
+	if b.tokens < 1 {
+		return l.wait(b)
+	}
+	return 0
+}
+
+// fill returns the bucket of key with the tokens gained since its last use.
+func (l *RateLimiter) fill(key string) *bucket {
+	now := l.now()
+	l.sweep(now)
+	b, found := l.buckets[key]
+	if !found {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	return b
+}
+
+func (l *RateLimiter) wait(b *bucket) time.Duration {
+	return time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// sweep drops, once a minute, the buckets that have filled up again, which
+// are no different from new ones.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Limit is the number of requests a client may make at once.
+func (l *RateLimiter) Limit() int {
+	return int(l.burst)
+}
+
+// remoteHost is the address of the caller of r, without the port.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return host
+}
+
+// identify returns r with the caller of a valid bearer token, which
+// authenticate then takes as it is instead of verifying the token again.
+// Invalid tokens are left to the handlers to reject.
+func (s *APIServer) identify(r *http.Request) *http.Request {
+	if principalOf(r).Subject != "" || s.verifier == nil {
+		return r
+	}
+	if p, err := s.bearerPrincipal(r); err == nil {
+		return r.WithContext(context.WithValue(r.Context(), principalKey{}, p))
+	}
+	return r
+}
+
+// clientKey identifies the caller of r for rate limiting: the caller of an
+// API key or a valid bearer token, see identify, else the remote address.
+func clientKey(r *http.Request) string {
+	if p := principalOf(r); p.Subject != "" {
+		return p.Role + ":" + p.Subject
+	}
+	return "ip:" + remoteHost(r)
+}
+
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(max(int(math.Ceil(wait.Seconds())), 1)))
+	WriteProblem(w, NewProblem(http.StatusTooManyRequests, CodeRateLimited, "too many requests, retry later"))
+}
+
+// rateLimit is the router middleware that limits the rate of requests of
+// each client, see clientKey. The limit and what is left of it are reported
+// in headers; a client over it gets a 429 with Retry-After.
+func (s *APIServer) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.limiter == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		r = s.identify(r)
+		ok, remaining, wait := s.limiter.Allow(clientKey(r))
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(s.limiter.Limit()))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		if !ok {
+			tooManyRequests(w, wait)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/arjun/go-message-queue-api/auth"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_RateLimit_Allow(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	l := NewRateLimiter(2, 3)
+	l.now = func() time.Time { return now }
+
+	for want := 2; want >= 0; want-- {
+		ok, remaining, _ := l.Allow("a")
+		assert.True(t, ok)
+		assert.Equal(t, want, remaining)
+	}
+	ok, _, wait := l.Allow("a")
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+	assert.Equal(t, 500*time.Millisecond, l.Wait("a"))
+	assert.Zero(t, l.Wait("c"))
+
+	// other clients have buckets of their own
+	ok, _, _ = l.Allow("b")
+	assert.True(t, ok)
+
+	now = now.Add(500 * time.Millisecond)
+	ok, remaining, _ := l.Allow("a")
+	assert.True(t, ok)
+	assert.Equal(t, 0, remaining)
+
+	// buckets refill up to burst only, and full ones are swept
+	now = now.Add(time.Hour)
+	ok, remaining, _ = l.Allow("a")
+	assert.True(t, ok)
+	assert.Equal(t, 2, remaining)
+	assert.Len(t, l.buckets, 1)
+}
+
+func Test_RateLimit_Middleware(t *testing.T) {
+	keys, err := auth.ParseKeySet([]byte(`{"keys":[{"kty":"oct","kid":"k","alg":"HS256","k":"c2VjcmV0LXNlY3JldC1zZWNyZXQtc2VjcmV0LXNlY3JldA"}]}`))
+	assert.NoError(t, err)
+	s := &APIServer{verifier: &auth.Verifier{Keys: keys}, limiter: NewRateLimiter(1, 1)}
+	router := mux.NewRouter()
+	var seen Principal
+	router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) { seen = principalOf(r) }).Methods("GET")
+	router.Use(s.rateLimit)
+	user, err := issueToken(keys, "7", "", "", time.Hour)
+	assert.NoError(t, err)
+
+	get := func(remoteAddr, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remoteAddr
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("10.0.0.1:1000", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "1", w.Header().Get("X-RateLimit-Limit"))
+	assert.Equal(t, "0", w.Header().Get("X-RateLimit-Remaining"))
+
+	// another port of the same address is the same client
+	w = get("10.0.0.1:2000", "")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	assert.Contains(t, w.Body.String(), CodeRateLimited)
+
+	// a token identifies its caller from any address, a bad one does not
+	assert.Equal(t, http.StatusOK, get("10.0.0.1:1000", user).Code)
+	assert.Equal(t, 7, seen.UserID, "the verified caller is passed on")
+	assert.Equal(t, http.StatusTooManyRequests, get("10.0.0.2:1000", user).Code)
+	assert.Equal(t, http.StatusOK, get("10.0.0.3:1000", "bad").Code)
+
+	s.limiter = nil
+	assert.Equal(t, http.StatusOK, get("10.0.0.1:1000", "").Code)
+}
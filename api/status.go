@@ -0,0 +1,365 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Processing states of a product. A product starts out idle until a job is
+// queued for it, a worker moves it to processing and reports the outcome.
+const (
+	StatusIdle            = "idle"
+	StatusQueued          = "queued"
+	StatusProcessing      = "processing"
+	StatusSucceeded       = "succeeded"
+	StatusPartiallyFailed = "partially_failed"
+	StatusFailed          = "failed"
+)
+
+// statusTransitions lists the states each state may move to. Processing may
+// repeat because a worker that died mid job leaves the message to another,
+// and queued follows processing when a job is scheduled for a retry.
+var statusTransitions = map[string][]string{
+	StatusIdle:            {StatusQueued, StatusProcessing},
+	StatusQueued:          {StatusQueued, StatusProcessing, StatusFailed},
+	StatusProcessing:      {StatusProcessing, StatusQueued, StatusSucceeded, StatusPartiallyFailed, StatusFailed},
+	StatusSucceeded:       {StatusQueued, StatusProcessing},
+	StatusPartiallyFailed: {StatusQueued, StatusProcessing},
+	StatusFailed:          {StatusQueued, StatusProcessing},
+}
+
+var ErrInvalidTransition = errors.New("invalid status transition")
+
+func canTransition(from, to string) bool {
+	for _, next := range statusTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// ProductStatus is the processing status of a product. Attempts counts the
+// times a worker picked up the current job.
+type ProductStatus struct {
+	ProductID  int64         `json:"product_id"`
+	State      string        `json:"state"`
+	Attempts   int           `json:"attempts"`
+	Error      string        `json:"error,omitempty"`
+	Worker     string        `json:"worker,omitempty"`
+	Images     []ImageStatus `json:"images"`
+	QueuedAt   *time.Time    `json:"queued_at,omitempty"`
+	StartedAt  *time.Time    `json:"started_at,omitempty"`
+	FinishedAt *time.Time    `json:"finished_at,omitempty"`
+	UpdatedAt  *time.Time    `json:"updated_at,omitempty"`
+}
+
+// ImageStatus is the outcome of the last attempt at one source image and the
+// number of attempts made at it.
+type ImageStatus struct {
+	URL      string `json:"url"`
+	State    string `json:"state"`
+	Error    string `json:"error,omitempty"`
+	Attempts int    `json:"attempts"`
+}
+
+// StatusReport is the body of POST /product/{id}/status, sent by workers on
+// every transition. Images holds the outcome of the images processed so far.
+type StatusReport struct {
+	State  string        `json:"state"`
+	Worker string        `json:"worker"`
+	Error  string        `json:"error"`
+	Images []ImageStatus `json:"images"`
+}
+
+const (
+	statusColumns = `product_id,state,attempts,error,worker,images,queued_at,started_at,finished_at,updated_at`
+
+	getProductStatusQuery = `
+	SELECT p.id, COALESCE(s.state, 'idle'), COALESCE(s.attempts, 0), s.error, s.worker,
+	COALESCE(s.images, '[]'), s.queued_at, s.started_at, s.finished_at, s.updated_at
+	FROM products p LEFT JOIN product_status s ON s.product_id = p.id
+	WHERE p.id = $1
+	`
+
+	lockProductStatusQuery = `
+	SELECT p.id, COALESCE(s.state, 'idle'), COALESCE(s.attempts, 0), s.error, s.worker,
+	COALESCE(s.images, '[]'), s.queued_at, s.started_at, s.finished_at, s.updated_at
+	FROM products p LEFT JOIN product_status s ON s.product_id = p.id
+	WHERE p.id = $1
+	FOR UPDATE OF p
+	`
+
+	// a new job starts over; only a job for all images forgets the
+	// outcome of the previous images
+	markQueuedQuery = `
+	INSERT INTO product_status (
+	product_id, state, queued_at
+	) VALUES (
+	$1, 'queued', NOW()
+	)
+	ON CONFLICT (product_id) DO UPDATE
+	SET state = 'queued',
+	attempts = 0,
+	error = NULL,
+	worker = NULL,
+	images = CASE WHEN $2 THEN '[]'::jsonb ELSE product_status.images END,
+	queued_at = NOW(),
+	started_at = NULL,
+	finished_at = NULL,
+	updated_at = NOW()
+	RETURNING ` + statusColumns + `
+	`
+
+	saveProductStatusQuery = `
+	INSERT INTO product_status (
+	` + statusColumns + `
+	) VALUES (
+	$1, $2, $3, $4, $5, $6, $7, $8, $9, NOW()
+	)
+	ON CONFLICT (product_id) DO UPDATE
+	SET state = $2,
+	attempts = $3,
+	error = $4,
+	worker = $5,
+	images = $6,
+	queued_at = $7,
+	started_at = $8,
+	finished_at = $9,
+	updated_at = NOW()
+	RETURNING ` + statusColumns + `
+	`
+)
+
+// markQueued records that a job for a product was queued in tx. allImages is
+// set for jobs that process every image of the product.
+func markQueued(tx *sql.Tx, productId int, allImages bool) error {
+	st, err := scanProductStatus(tx.QueryRow(markQueuedQuery, productId, allImages))
+	if err != nil {
+		return err
+	}
+	return insertProductEvent(tx, productId, EventStatus, st)
+}
+
+func scanProductStatus(row rowScanner) (ProductStatus, error) {
+	var st ProductStatus
+	var errMsg, worker sql.NullString
+	var queuedAt, startedAt, finishedAt, updatedAt sql.NullTime
+	var images []byte
+	err := row.Scan(
+		&st.ProductID,
+		&st.State,
+		&st.Attempts,
+		&errMsg,
+		&worker,
+		&images,
+		&queuedAt,
+		&startedAt,
+		&finishedAt,
+		&updatedAt,
+	)
+	if err != nil {
+		return ProductStatus{}, err
+	}
+	st.Error = errMsg.String
+	st.Worker = worker.String
+	st.QueuedAt = nullTimePtr(queuedAt)
+	st.StartedAt = nullTimePtr(startedAt)
+	st.FinishedAt = nullTimePtr(finishedAt)
+	st.UpdatedAt = nullTimePtr(updatedAt)
+	if err := json.Unmarshal(images, &st.Images); err != nil {
+		return ProductStatus{}, err
+	}
+	if st.Images == nil {
+		st.Images = []ImageStatus{}
+	}
+	return st, nil
+}
+
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func (s *PostgresStore) GetProductStatus(id int) (ProductStatus, error) {
+	return scanProductStatus(s.db.QueryRow(getProductStatusQuery, id))
+}
+
+// UpdateProductStatus applies a worker report to the status of a product. It
+// returns ErrInvalidTransition if the current state cannot move to the
+// reported one and sql.ErrNoRows if there is no such product.
+func (s *PostgresStore) UpdateProductStatus(id int, report StatusReport) (ProductStatus, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return ProductStatus{}, err
+	}
+	defer tx.Rollback()
+
+	st, err := scanProductStatus(tx.QueryRow(lockProductStatusQuery, id))
+	if err != nil {
+		return ProductStatus{}, err
+	}
+	if !canTransition(st.State, report.State) {
+		return ProductStatus{}, fmt.Errorf("%w from %s to %s", ErrInvalidTransition, st.State, report.State)
+	}
+
+	now := time.Now()
+	switch report.State {
+	case StatusQueued:
+		st.QueuedAt = &now
+		st.FinishedAt = nil
+	case StatusProcessing:
+		st.Attempts++
+		st.StartedAt = &now
+		st.FinishedAt = nil
+	default:
+		st.FinishedAt = &now
+	}
+	st.State = report.State
+	st.Error = report.Error
+	if report.Worker != "" {
+		st.Worker = report.Worker
+	}
+	st.Images = mergeImageStatus(st.Images, report.Images)
+
+	images, err := json.Marshal(st.Images)
+	if err != nil {
+		return ProductStatus{}, err
+	}
+	var queuedAt, startedAt, finishedAt any
+	if st.QueuedAt != nil {
+		queuedAt = *st.QueuedAt
+	}
+	if st.StartedAt != nil {
+		startedAt = *st.StartedAt
+	}
+	if st.FinishedAt != nil {
+		finishedAt = *st.FinishedAt
+	}
+	st, err = scanProductStatus(tx.QueryRow(saveProductStatusQuery,
+		id,
+		st.State,
+		st.Attempts,
+		nullString(st.Error),
+		nullString(st.Worker),
+		images,
+		queuedAt,
+		startedAt,
+		finishedAt))
+	if err != nil {
+		return ProductStatus{}, err
+	}
+
+	if err := insertProductEvent(tx, id, EventStatus, st); err != nil {
+		return ProductStatus{}, err
+	}
+	if st.State == StatusFailed {
+		if err := enqueueWebhookDeliveries(tx, id, WebhookProcessingFailed, st); err != nil {
+			return ProductStatus{}, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return ProductStatus{}, err
+	}
+	return st, nil
+}
+
+// mergeImageStatus records the reported image outcomes, counting an attempt
+// for each of them. Images not reported keep their last outcome.
+func mergeImageStatus(current, reported []ImageStatus) []ImageStatus {
+	index := make(map[string]int, len(current))
+	for i, img := range current {
+		index[img.URL] = i
+	}
+	for _, img := range reported {
+		i, ok := index[img.URL]
+		if !ok {
+			i = len(current)
+			index[img.URL] = i
+			current = append(current, ImageStatus{URL: img.URL})
+		}
+		current[i].State = img.State
+		current[i].Error = img.Error
+		current[i].Attempts++
+	}
+	return current
+}
+
+func (s *APIServer) handleGetProductStatus(w http.ResponseWriter, r *http.Request) error {
+
+	productId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return WriteProblem(w, invalidID("product"))
+	}
+
+	status, err := s.store.GetProductStatus(productId)
+	if err == sql.ErrNoRows {
+		return WriteProblem(w, productNotFound())
+	}
+	if err != nil {
+		return writeError(w, err)
+	}
+
+	return WriteJSON(w, http.StatusOK, status)
+}
+
+func (s *APIServer) handleReportProductStatus(w http.ResponseWriter, r *http.Request) error {
+
+	productId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return WriteProblem(w, invalidID("product"))
+	}
+
+	var report StatusReport
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+		return WriteProblem(w, malformedBody(err))
+	}
+	if err := validateStatusReport(report); err != nil {
+		return writeError(w, err)
+	}
+
+	status, err := s.store.UpdateProductStatus(productId, report)
+	if err == sql.ErrNoRows {
+		return WriteProblem(w, productNotFound())
+	}
+	if errors.Is(err, ErrInvalidTransition) {
+		return WriteProblem(w, NewProblem(http.StatusConflict, CodeInvalidTransition, err.Error()))
+	}
+	if err != nil {
+		return writeError(w, err)
+	}
+
+	return WriteJSON(w, http.StatusOK, status)
+}
+
+func validateStatusReport(report StatusReport) error {
+	if report.State == StatusIdle {
+		return fieldError("state", FieldInvalid, "idle cannot be reported")
+	}
+	if _, ok := statusTransitions[report.State]; !ok {
+		return fieldError("state", FieldInvalid, "unknown state %q", report.State)
+	}
+	for i, img := range report.Images {
+		if img.URL == "" {
+			return fieldError(fmt.Sprintf("images[%d].url", i), FieldRequired, "is required")
+		}
+		if img.State != StatusSucceeded && img.State != StatusFailed {
+			return fieldError(fmt.Sprintf("images[%d].state", i), FieldInvalid, "must be succeeded or failed")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_DB_ProductStatus(t *testing.T) {
+	product := createRandomProduct(t)
+
+	status, err := testPostgresStore.GetProductStatus(int(product.ID))
+	assert.NoError(t, err)
+	assert.Equal(t, StatusQueued, status.State)
+	assert.NotNil(t, status.QueuedAt)
+	assert.Empty(t, status.Images)
+
+	status, err = testPostgresStore.UpdateProductStatus(int(product.ID), StatusReport{State: StatusProcessing, Worker: "worker-1"})
+	assert.NoError(t, err)
+	assert.Equal(t, StatusProcessing, status.State)
+	assert.Equal(t, 1, status.Attempts)
+	assert.Equal(t, "worker-1", status.Worker)
+	assert.NotNil(t, status.StartedAt)
+
+	status, err = testPostgresStore.UpdateProductStatus(int(product.ID), StatusReport{
+		State: StatusPartiallyFailed,
+		Images: []ImageStatus{
+			{URL: product.Images[0], State: StatusSucceeded},
+			{URL: "https://example.com/broken.png", State: StatusFailed, Error: "404 Not Found"},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, StatusPartiallyFailed, status.State)
+	assert.NotNil(t, status.FinishedAt)
+	assert.Len(t, status.Images, 2)
+	assert.Equal(t, "404 Not Found", status.Images[1].Error)
+	assert.Equal(t, 1, status.Images[1].Attempts)
+
+	_, err = testPostgresStore.UpdateProductStatus(int(product.ID), StatusReport{State: StatusSucceeded})
+	assert.ErrorIs(t, err, ErrInvalidTransition)
+
+	// a new job for all images starts over
+	images := []string{RandomString(5)}
+	_, err = testPostgresStore.UpdateProduct(UpdateProductParams{ID: int(product.ID), ExpectedVersion: product.Version, Images: &images})
+	assert.NoError(t, err)
+	status, err = testPostgresStore.GetProductStatus(int(product.ID))
+	assert.NoError(t, err)
+	assert.Equal(t, StatusQueued, status.State)
+	assert.Equal(t, 0, status.Attempts)
+	assert.Empty(t, status.Images)
+	assert.Nil(t, status.FinishedAt)
+
+	_, err = testPostgresStore.GetProductStatus(0)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+	_, err = testPostgresStore.UpdateProductStatus(0, StatusReport{State: StatusProcessing})
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+}
+
+func Test_DB_ProductStatusIdle(t *testing.T) {
+	product, err := testPostgresStore.CreateProduct(CreateProductParams{
+		Name:        RandomString(5),
+		Description: RandomString(5),
+		Price:       "10",
+		UserID:      19,
+	})
+	assert.NoError(t, err)
+
+	status, err := testPostgresStore.GetProductStatus(int(product.ID))
+	assert.NoError(t, err)
+	assert.Equal(t, StatusIdle, status.State)
+	assert.Nil(t, status.QueuedAt)
+}
+
+func Test_API_ProductStatus(t *testing.T) {
+	product := createRandomProduct(t)
+	productId := strconv.Itoa(int(product.ID))
+
+	writer := makeRequest("GET", "/product/"+productId+"/status", nil)
+	assert.Equal(t, http.StatusOK, writer.Code)
+	var status ProductStatus
+	assert.NoError(t, json.Unmarshal(writer.Body.Bytes(), &status))
+	assert.Equal(t, product.ID, status.ProductID)
+	assert.Equal(t, StatusQueued, status.State)
+
+	writer = makeRequest("POST", "/product/"+productId+"/status", []byte(`{"state":"processing","worker":"worker-1"}`))
+	assert.Equal(t, http.StatusOK, writer.Code)
+
+	writer = makeRequest("POST", "/product/"+productId+"/status", []byte(`{"state":"queued","error":"503 Service Unavailable"}`))
+	assert.Equal(t, http.StatusOK, writer.Code)
+	assert.NoError(t, json.Unmarshal(writer.Body.Bytes(), &status))
+	assert.Equal(t, StatusQueued, status.State)
+	assert.Equal(t, "503 Service Unavailable", status.Error)
+	assert.Equal(t, 1, status.Attempts)
+
+	writer = makeRequest("POST", "/product/"+productId+"/status", []byte(`{"state":"succeeded"}`))
+	assert.Equal(t, http.StatusConflict, writer.Code)
+	assert.Contains(t, writer.Body.String(), `"code":"invalid_transition"`)
+
+	writer = makeRequest("POST", "/product/"+productId+"/status", []byte(`{"state":"done"}`))
+	assert.Equal(t, http.StatusUnprocessableEntity, writer.Code)
+
+	writer = makeRequest("POST", "/product/"+productId+"/status", []byte(`{"state":"failed","images":[{"url":"a","state":"queued"}]}`))
+	assert.Equal(t, http.StatusUnprocessableEntity, writer.Code)
+
+	writer = makeRequest("GET", "/product/abcd/status", nil)
+	assert.Equal(t, http.StatusBadRequest, writer.Code)
+
+	writer = makeRequest("GET", "/product/1000000/status", nil)
+	assert.Equal(t, http.StatusNotFound, writer.Code)
+}
+
+func Test_Status_CanTransition(t *testing.T) {
+	assert.True(t, canTransition(StatusQueued, StatusProcessing))
+	assert.True(t, canTransition(StatusProcessing, StatusPartiallyFailed))
+	assert.True(t, canTransition(StatusFailed, StatusProcessing))
+	assert.False(t, canTransition(StatusQueued, StatusSucceeded))
+	assert.False(t, canTransition(StatusSucceeded, StatusFailed))
+	assert.False(t, canTransition("unknown", StatusQueued))
+}
+
+func Test_Status_MergeImageStatus(t *testing.T) {
+	merged := mergeImageStatus(
+		[]ImageStatus{{URL: "a", State: StatusFailed, Error: "timeout", Attempts: 1}},
+		[]ImageStatus{{URL: "a", State: StatusSucceeded}, {URL: "b", State: StatusFailed, Error: "bad image"}},
+	)
+	assert.Equal(t, []ImageStatus{
+		{URL: "a", State: StatusSucceeded, Attempts: 2},
+		{URL: "b", State: StatusFailed, Error: "bad image", Attempts: 1},
+	}, merged)
+}
@@ -2,30 +2,104 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/lib/pq"
 )
 
 type Storage interface {
-	CreateProduct(CreateProductParams) (int, error)
+	CreateProduct(CreateProductParams) (Product, error)
 	CheckUserID(int) error
+	CheckUserIDs([]int) (map[int]bool, error)
+	CreateProducts(products []CreateProductParams, atomic bool) ([]BulkProductResult, error)
 	GetProduct(int) (Product, error)
 	AddProductCompressImages(AddProductCompressImagesParams) error
+	ListProducts(ListProductsParams) ([]Product, error)
+	CreateUser(CreateUserParams) (int, error)
+	GetUser(int) (User, error)
+	UpdateUser(UpdateUserParams) (User, error)
+	DeleteUser(int) error
+	UpdateProduct(UpdateProductParams) (Product, error)
+	DeleteProduct(id int, expectedVersion int64) error
+	AddProductImages(id int, images []string, expectedVersion int64) (Product, error)
+	GetProductStatus(int) (ProductStatus, error)
+	UpdateProductStatus(id int, report StatusReport) (ProductStatus, error)
+	ListProductEvents(after int64, filter EventFilter, limit int) ([]ProductEvent, error)
+	LastProductEventID() (int64, error)
+	PruneProductEvents(olderThan time.Duration) (int64, error)
+	CreateWebhook(CreateWebhookParams) (Webhook, error)
+	GetWebhook(int) (Webhook, error)
+	ListWebhooks(userId int) ([]Webhook, error)
+	UpdateWebhook(UpdateWebhookParams) (Webhook, error)
+	DeleteWebhook(int) error
+	ListWebhookDeliveries(ListWebhookDeliveriesParams) ([]WebhookDelivery, error)
+	ClaimWebhookDeliveries(limit int, lease time.Duration) ([]PendingDelivery, error)
+	RecordWebhookAttempt(WebhookAttempt) error
+	ClaimIdempotencyKey(scope, key, fingerprint string) (bool, IdempotencyRecord, error)
+	CompleteIdempotencyKey(scope, key string, rec IdempotencyRecord) error
+	ReleaseIdempotencyKey(scope, key string) error
+	PruneIdempotencyKeys(olderThan time.Duration) (int64, error)
+	RelayOutbox(limit int, lease time.Duration, publish func(OutboxMessage) error) (int, error)
+	PruneOutbox(olderThan time.Duration) (int64, error)
+	CreateAPIKey(CreateAPIKeyParams) (APIKey, error)
+	GetAPIKeyByPrefix(prefix string) (APIKey, error)
+	ListAPIKeys() ([]APIKey, error)
+	RevokeAPIKey(id int, at time.Time) (APIKey, error)
+	RotateAPIKey(RotateAPIKeyParams) (APIKey, error)
+	TouchAPIKey(id int64) error
+	ConsumeQuota(userId, products, images int, defaults QuotaLimits) (QuotaUsage, error)
+	GetQuotaUsage(userId int, defaults QuotaLimits) (QuotaUsage, error)
+	SetUserQuota(userId int, limits QuotaLimits) error
 }
 
+// ErrVersionMismatch is returned by writes guarded by an expected product
+// version when the product has been changed in the meantime.
+var ErrVersionMismatch = errors.New("product version mismatch")
+
+// maxProductImages is the number of images a product may have, see the
+// validate tags of the product payloads.
+const maxProductImages = 20
+
+// ErrTooManyImages is returned when images added to a product would take it
+// over maxProductImages.
+var ErrTooManyImages = errors.New("too many product images")
+
+// ErrImageCount is returned by writes of compressed images that would not
+// leave one location per product image.
+var ErrImageCount = errors.New("compressed images do not match the product images")
+
 type PostgresStore struct {
 	db *sql.DB
 }
+
+// Config is where the database is and how to log in.
 type Config struct {
-	Username string
-	Password string
-	Dbname   string
-	Sslmode  string
+	Host     string `yaml:"host" env:"DB_HOST" flag:"db-host" usage:"database host"`
+	Port     int    `yaml:"port" env:"DB_PORT" flag:"db-port" usage:"database port"`
+	Username string `yaml:"user" env:"DB_USER" flag:"db-user" usage:"database user"`
+	Password string `yaml:"password" env:"DB_PASSWORD" secret:"true"`
+	Dbname   string `yaml:"name" env:"DB_NAME" flag:"db-name" usage:"database name"`
+	Sslmode  string `yaml:"sslmode" env:"DB_SSLMODE" flag:"db-sslmode" usage:"sslmode of the database connection"`
+}
+
+var defaultDatabaseConfig = Config{
+	Host:     "localhost",
+	Port:     5432,
+	Username: "root",
+	Password: "secret",
+	Dbname:   "user_db",
+	Sslmode:  "disable",
 }
 
 func NewPostgresStore(config *Config) (*PostgresStore, error) {
-	connStr := fmt.Sprintf("user=%s password=%s dbname=%s sslmode=%s", config.Username, config.Password, config.Dbname, config.Sslmode)
+	connStr := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+		quoteConnValue(config.Host), config.Port, quoteConnValue(config.Username), quoteConnValue(config.Password),
+		quoteConnValue(config.Dbname), quoteConnValue(config.Sslmode))
 	db, err := sql.Open("postgres", connStr)
 	if err != nil {
 		return nil, err
@@ -40,17 +114,100 @@ func NewPostgresStore(config *Config) (*PostgresStore, error) {
 	}, nil
 }
 
+// quoteConnValue quotes a value of a connection string, which may then hold
+// spaces and quotes.
+func quoteConnValue(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+// CreateProductParams is the payload of a new product, checked by a
+// Validator against its validate tags.
 type CreateProductParams struct {
-	Name        string   `json:"name"`
-	Description string   `json:"description"`
-	Images      []string `json:"images"`
-	Price       string   `json:"price"`
-	UserID      int      `json:"user_id"`
+	Name        string   `json:"name" validate:"required,max=200"`
+	Description string   `json:"description" validate:"required,max=5000"`
+	Images      []string `json:"images" validate:"max=20,unique,dive,required,imageurl"`
+	Price       string   `json:"price" validate:"required,price"`
+	UserID      int      `json:"user_id" validate:"required"`
 }
 
+// AddProductCompressImagesParams writes the compressed images of a product
+// and records the worker that wrote them. Every list has a location per
+// source image in Sources, and the locations of the other images are kept.
+// Without Sources the lists are for all the product images or, with Append,
+// for the images not compressed yet, in order. A non-zero ExpectedVersion
+// makes the write fail with ErrVersionMismatch if the product was changed
+// after that version was read.
 type AddProductCompressImagesParams struct {
-	ID               int      `json:"id"`
-	CompressedImages []string `json:"compressed_images"`
+	ID               int                 `json:"id"`
+	Sources          []string            `json:"sources"`
+	CompressedImages []string            `json:"compressed_images"`
+	Renditions       map[string][]string `json:"renditions"`
+	Append           bool                `json:"append"`
+	Worker           string              `json:"worker"`
+	ExpectedVersion  int64               `json:"-"`
+}
+
+// UpdateProductParams holds a partial update of a product; nil fields are
+// left unchanged. Replacing the images clears the compressed images, which
+// no longer match them.
+type UpdateProductParams struct {
+	ID              int       `json:"-"`
+	ExpectedVersion int64     `json:"-"`
+	Name            *string   `json:"name" validate:"required,max=200"`
+	Description     *string   `json:"description" validate:"required,max=5000"`
+	Images          *[]string `json:"images" validate:"min=1,max=20,unique,dive,required,imageurl"`
+	Price           *string   `json:"price" validate:"required,price"`
+}
+
+type CreateUserParams struct {
+	Name      string `json:"name"`
+	Mobile    string `json:"mobile"`
+	Latitude  string `json:"latitude"`
+	Longitude string `json:"longitude"`
+}
+
+// UpdateUserParams holds a partial update of a user; nil fields are left
+// unchanged.
+type UpdateUserParams struct {
+	ID        int     `json:"-"`
+	Name      *string `json:"name"`
+	Mobile    *string `json:"mobile"`
+	Latitude  *string `json:"latitude"`
+	Longitude *string `json:"longitude"`
+}
+
+// ListProductsParams filters and orders a page of products. Only the fields
+// that are set are turned into WHERE clauses; Cursor continues the listing
+// after the last product of a previous page.
+type ListProductsParams struct {
+	UserID        int
+	MinPrice      *float64
+	MaxPrice      *float64
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	UpdatedAfter  *time.Time
+	UpdatedBefore *time.Time
+	SortBy        string
+	Descending    bool
+	Cursor        *ProductCursor
+	Limit         int
+}
+
+// ProductCursor points at the last product of a page: the value of the sort
+// column and the product id used as a tie breaker.
+type ProductCursor struct {
+	SortBy string `json:"s"`
+	Value  string `json:"v"`
+	ID     int64  `json:"id"`
+}
+
+// productSortColumns maps the sort keys accepted by ListProducts to the SQL
+// expression and the cast applied to cursor values of that column.
+var productSortColumns = map[string]struct{ expr, cast string }{
+	"id":         {"id", "::bigint"},
+	"price":      {"price", "::decimal"},
+	"created_at": {"created_at", "::timestamptz"},
+	"updated_at": {"COALESCE(updated_at, created_at)", "::timestamptz"},
 }
 
 const (
@@ -60,18 +217,91 @@ const (
 	) VALUES (
 	$1, $2, $3, $4, $5
 	)
-	RETURNING id
+	RETURNING ` + productColumns + `
 	`
 
+	productColumns = `id,name,description,images,price,user_id,compressed_images,renditions,compressed_by,compressed_at,version,created_at,updated_at`
+
 	getProductQuery = `
-	SELECT id,name,description,images,price,user_id,compressed_images,created_at FROM products WHERE
+	SELECT ` + productColumns + ` FROM products WHERE
 	id = $1
 	`
 
-	addProductCompressImagesQuery = `
+	lockProductQuery = getProductQuery + `FOR UPDATE
+	`
+
+	setProductCompressImagesQuery = `
 	UPDATE products
-	SET compressed_images = $2 ,updated_at = (SELECT NOW())
+	SET compressed_images = $2,
+	renditions = $3,
+	compressed_by = NULLIF($4, ''),
+	compressed_at = (SELECT NOW()),
+	version = version + 1,
+	updated_at = (SELECT NOW())
 	WHERE products.id = $1
+	RETURNING ` + productColumns + `
+	`
+
+	updateProductQuery = `
+	UPDATE products
+	SET name = COALESCE($3, name),
+	description = COALESCE($4, description),
+	images = COALESCE($5, images),
+	price = COALESCE($6, price),
+	compressed_images = CASE WHEN $5::text[] IS NULL THEN compressed_images ELSE NULL END,
+	renditions = CASE WHEN $5::text[] IS NULL THEN renditions ELSE NULL END,
+	compressed_by = CASE WHEN $5::text[] IS NULL THEN compressed_by ELSE NULL END,
+	compressed_at = CASE WHEN $5::text[] IS NULL THEN compressed_at ELSE NULL END,
+	version = version + 1,
+	updated_at = (SELECT NOW())
+	WHERE products.id = $1 AND products.version = $2
+	RETURNING ` + productColumns + `
+	`
+
+	addProductImagesQuery = `
+	UPDATE products
+	SET images = images || $2::text[],
+	version = version + 1,
+	updated_at = (SELECT NOW())
+	WHERE products.id = $1 AND ($3::bigint = 0 OR products.version = $3)
+	RETURNING ` + productColumns + `
+	`
+
+	deleteProductQuery = `
+	DELETE FROM products
+	WHERE products.id = $1 AND products.version = $2
+	`
+
+	userColumns = `id,name,mobile,latitude,longitude,created_at,updated_at`
+
+	createUserQuery = `
+	INSERT INTO users (
+	name, mobile, latitude, longitude
+	) VALUES (
+	$1, $2, $3, $4
+	)
+	RETURNING id
+	`
+
+	getUserQuery = `
+	SELECT ` + userColumns + ` FROM users WHERE
+	id = $1
+	`
+
+	updateUserQuery = `
+	UPDATE users
+	SET name = COALESCE($2, name),
+	mobile = COALESCE($3, mobile),
+	latitude = COALESCE($4, latitude),
+	longitude = COALESCE($5, longitude),
+	updated_at = (SELECT NOW())
+	WHERE users.id = $1
+	RETURNING ` + userColumns + `
+	`
+
+	deleteUserQuery = `
+	DELETE FROM users
+	WHERE users.id = $1
 	`
 
 	checkUserIdQuery = `
@@ -80,40 +310,387 @@ const (
 	`
 )
 
-func (s *PostgresStore) CreateProduct(arg CreateProductParams) (int, error) {
+// CreateProduct inserts a product and, in the same transaction, the outbox
+// message that asks the consumer to process its images. It returns the
+// product as inserted.
+func (s *PostgresStore) CreateProduct(arg CreateProductParams) (Product, error) {
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Product{}, err
+	}
+	defer tx.Rollback()
+
+	images := arg.Images
+	if images == nil {
+		images = []string{}
+	}
 
-	var productId int
-	err := s.db.QueryRow(createProductQuery,
+	product, err := scanProduct(tx.QueryRow(createProductQuery,
 		arg.Name,
 		arg.Description,
-		pq.Array(arg.Images),
+		pq.Array(images),
 		arg.Price,
-		arg.UserID).Scan(&productId)
+		arg.UserID))
 
 	if err != nil {
-		return -1, err
+		return Product{}, err
+	}
+
+	// products created without images get them later through uploads
+	if len(arg.Images) > 0 {
+		productId := int(product.ID)
+		if err := enqueueOutbox(tx, productJobTopic, strconv.Itoa(productId)); err != nil {
+			return Product{}, err
+		}
+		if err := markQueued(tx, productId, true); err != nil {
+			return Product{}, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Product{}, err
 	}
 
-	return productId, nil
+	return product, nil
 }
 
 func (s *PostgresStore) AddProductCompressImages(arg AddProductCompressImagesParams) error {
 
-	_, err := s.db.Exec(addProductCompressImagesQuery,
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	current, err := scanProduct(tx.QueryRow(lockProductQuery, arg.ID))
+	if err != nil {
+		return err
+	}
+	if arg.ExpectedVersion != 0 && current.Version != arg.ExpectedVersion {
+		return ErrVersionMismatch
+	}
+
+	sources := arg.Sources
+	if sources == nil {
+		// the product images in order, or those not compressed yet
+		count := len(arg.CompressedImages)
+		for _, locations := range arg.Renditions {
+			count = max(count, len(locations))
+		}
+		start := 0
+		if arg.Append {
+			start = len(current.CompressedImages)
+			for start > 0 && current.CompressedImages[start-1] == "" {
+				start--
+			}
+		}
+		if !arg.Append && count != len(current.Images) || start+count > len(current.Images) {
+			return ErrImageCount
+		}
+		sources = current.Images[start : start+count]
+	}
+
+	compressed, renditions := mergeCompressedImages(current, sources, arg)
+	renditionsJSON, err := json.Marshal(renditions)
+	if err != nil {
+		return err
+	}
+	product, err := scanProduct(tx.QueryRow(setProductCompressImagesQuery,
+		arg.ID,
+		pq.Array(compressed),
+		renditionsJSON,
+		arg.Worker))
+	if err != nil {
+		return err
+	}
+
+	event := imagesEvent{
+		ProductID:        product.ID,
+		Version:          product.Version,
+		CompressedImages: product.CompressedImages,
+		Renditions:       product.Renditions,
+		CompressedBy:     product.CompressedBy,
+		CompressedAt:     product.CompressedAt,
+	}
+	if err := insertProductEvent(tx, arg.ID, EventImages, event); err != nil {
+		return err
+	}
+	if err := enqueueWebhookDeliveries(tx, arg.ID, WebhookImagesReady, event); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// mergeCompressedImages returns the compressed images and renditions of
+// the product images after a write of the locations of sources, in the order
+// of arg. Images that were not written keep their stored locations, which are
+// in the order of the images but may be fewer; writing the same source again
+// replaces its locations rather than adding to them. Sources the product no
+// longer has are dropped, and images without any location get an empty one.
+func mergeCompressedImages(current Product, sources []string, arg AddProductCompressImagesParams) ([]string, map[string][]string) {
+	written := make(map[string]int, len(sources))
+	for i, source := range sources {
+		written[source] = i
+	}
+
+	compressed := make([]string, len(current.Images))
+	renditions := map[string][]string{}
+	for _, names := range []map[string][]string{current.Renditions, arg.Renditions} {
+		for name := range names {
+			renditions[name] = make([]string, len(current.Images))
+		}
+	}
+	for i, image := range current.Images {
+		if j, ok := written[image]; ok {
+			if j < len(arg.CompressedImages) {
+				compressed[i] = arg.CompressedImages[j]
+			}
+			for name, locations := range arg.Renditions {
+				renditions[name][i] = locations[j]
+			}
+			continue
+		}
+		if i < len(current.CompressedImages) {
+			compressed[i] = current.CompressedImages[i]
+		}
+		for name, locations := range current.Renditions {
+			if i < len(locations) {
+				renditions[name][i] = locations[i]
+			}
+		}
+	}
+
+	// a rendition no image has any more is dropped
+	for name, locations := range renditions {
+		if strings.Join(locations, "") == "" {
+			delete(renditions, name)
+		}
+	}
+	return compressed, renditions
+}
+
+func (s *PostgresStore) UpdateProduct(arg UpdateProductParams) (Product, error) {
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Product{}, err
+	}
+	defer tx.Rollback()
+
+	var images any
+	if arg.Images != nil {
+		images = pq.Array(*arg.Images)
+	}
+	row := tx.QueryRow(updateProductQuery,
 		arg.ID,
-		pq.Array(arg.CompressedImages))
+		arg.ExpectedVersion,
+		arg.Name,
+		arg.Description,
+		images,
+		arg.Price)
+	product, err := scanProduct(row)
+	if err == sql.ErrNoRows {
+		return Product{}, s.productWriteMissError(arg.ID)
+	}
+	if err != nil {
+		return Product{}, err
+	}
+
+	// new source images need to be compressed again
+	if arg.Images != nil {
+		if err := enqueueOutbox(tx, productJobTopic, strconv.Itoa(arg.ID)); err != nil {
+			return Product{}, err
+		}
+		if err := markQueued(tx, arg.ID, true); err != nil {
+			return Product{}, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Product{}, err
+	}
+
+	return product, nil
+}
 
+// AddProductImages appends images to a product and queues a job that
+// processes only those images. A zero expectedVersion appends
+// unconditionally. The product may have at most maxProductImages images.
+func (s *PostgresStore) AddProductImages(id int, images []string, expectedVersion int64) (Product, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Product{}, err
+	}
+	defer tx.Rollback()
+
+	current, err := scanProduct(tx.QueryRow(lockProductQuery, id))
+	if err != nil {
+		return Product{}, err
+	}
+	if len(current.Images)+len(images) > maxProductImages {
+		return Product{}, ErrTooManyImages
+	}
+
+	product, err := scanProduct(tx.QueryRow(addProductImagesQuery, id, pq.Array(images), expectedVersion))
+	if err == sql.ErrNoRows {
+		return Product{}, s.productWriteMissError(id)
+	}
+	if err != nil {
+		return Product{}, err
+	}
+
+	job, err := json.Marshal(ProductImagesJob{ProductID: id, Images: images})
+	if err != nil {
+		return Product{}, err
+	}
+	if err := enqueueOutbox(tx, productImagesJobTopic, string(job)); err != nil {
+		return Product{}, err
+	}
+	if err := markQueued(tx, id, false); err != nil {
+		return Product{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Product{}, err
+	}
+
+	return product, nil
+}
+
+// DeleteProduct removes a product if it is still at expectedVersion.
+func (s *PostgresStore) DeleteProduct(id int, expectedVersion int64) error {
+	res, err := s.db.Exec(deleteProductQuery, id, expectedVersion)
 	if err != nil {
 		return err
 	}
+	return s.checkProductWrite(res, id)
+}
 
+// checkProductWrite turns a guarded write that touched no rows into
+// sql.ErrNoRows or ErrVersionMismatch.
+func (s *PostgresStore) checkProductWrite(res sql.Result, id int) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return s.productWriteMissError(id)
+	}
 	return nil
 }
 
+func (s *PostgresStore) productWriteMissError(id int) error {
+	if _, err := s.GetProduct(id); err != nil {
+		return err
+	}
+	return ErrVersionMismatch
+}
+
 func (s *PostgresStore) GetProduct(id int) (Product, error) {
 
 	row := s.db.QueryRow(getProductQuery, id)
+	i, err := scanProduct(row)
+	if err != nil {
+		return Product{}, err
+	}
+
+	return i, nil
+}
+
+func (s *PostgresStore) ListProducts(arg ListProductsParams) ([]Product, error) {
+	sortBy := arg.SortBy
+	if sortBy == "" {
+		sortBy = "id"
+	}
+	column, ok := productSortColumns[sortBy]
+	if !ok {
+		return nil, fmt.Errorf("unknown sort column %q", sortBy)
+	}
+
+	var where []string
+	var args []any
+	addFilter := func(clause string, value any) {
+		args = append(args, value)
+		where = append(where, fmt.Sprintf(clause, len(args)))
+	}
+
+	if arg.UserID != 0 {
+		addFilter("user_id = $%d", arg.UserID)
+	}
+	if arg.MinPrice != nil {
+		addFilter("price >= $%d", *arg.MinPrice)
+	}
+	if arg.MaxPrice != nil {
+		addFilter("price <= $%d", *arg.MaxPrice)
+	}
+	if arg.CreatedAfter != nil {
+		addFilter("created_at >= $%d", *arg.CreatedAfter)
+	}
+	if arg.CreatedBefore != nil {
+		addFilter("created_at < $%d", *arg.CreatedBefore)
+	}
+	// products never updated count as updated when created, as they sort
+	updated := productSortColumns["updated_at"].expr
+	if arg.UpdatedAfter != nil {
+		addFilter(updated+" >= $%d", *arg.UpdatedAfter)
+	}
+	if arg.UpdatedBefore != nil {
+		addFilter(updated+" < $%d", *arg.UpdatedBefore)
+	}
+
+	direction, comparison := "ASC", ">"
+	if arg.Descending {
+		direction, comparison = "DESC", "<"
+	}
+
+	if arg.Cursor != nil {
+		// keyset pagination: continue strictly after the (sort value, id) pair
+		// of the last row of the previous page
+		args = append(args, arg.Cursor.Value, arg.Cursor.ID)
+		where = append(where, fmt.Sprintf("(%s, id) %s ($%d%s, $%d)",
+			column.expr, comparison, len(args)-1, column.cast, len(args)))
+	}
+
+	query := "SELECT " + productColumns + " FROM products"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	args = append(args, arg.Limit)
+	query += fmt.Sprintf(" ORDER BY %s %s, id %s LIMIT $%d", column.expr, direction, direction, len(args))
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	products := make([]Product, 0)
+	for rows.Next() {
+		i, err := scanProduct(rows)
+		if err != nil {
+			return nil, err
+		}
+		products = append(products, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return products, nil
+}
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanProduct(row rowScanner) (Product, error) {
 	var i Product
+	var renditions []byte
+	var compressedBy sql.NullString
+	var compressedAt, updatedAt sql.NullTime
 	err := row.Scan(
 		&i.ID,
 		&i.Name,
@@ -122,15 +699,48 @@ func (s *PostgresStore) GetProduct(id int) (Product, error) {
 		&i.Price,
 		&i.UserID,
 		pq.Array(&i.CompressedImages),
+		&renditions,
+		&compressedBy,
+		&compressedAt,
+		&i.Version,
 		&i.CreatedAt,
+		&updatedAt,
 	)
 	if err != nil {
 		return Product{}, err
 	}
+	i.UpdatedAt = updatedAt.Time
+	if renditions != nil {
+		if err := json.Unmarshal(renditions, &i.Renditions); err != nil {
+			return Product{}, err
+		}
+	}
+	i.CompressedBy = compressedBy.String
+	if compressedAt.Valid {
+		i.CompressedAt = &compressedAt.Time
+	}
 
 	return i, nil
 }
 
+// productCursorValue returns the value of the sort column for p, formatted
+// the way ListProducts expects it back in a ProductCursor.
+func productCursorValue(p Product, sortBy string) string {
+	switch sortBy {
+	case "price":
+		return strconv.FormatFloat(p.Price, 'f', -1, 64)
+	case "created_at":
+		return p.CreatedAt.Format(time.RFC3339Nano)
+	case "updated_at":
+		if p.UpdatedAt.IsZero() {
+			return p.CreatedAt.Format(time.RFC3339Nano)
+		}
+		return p.UpdatedAt.Format(time.RFC3339Nano)
+	default:
+		return strconv.FormatInt(p.ID, 10)
+	}
+}
+
 func (s *PostgresStore) CheckUserID(id int) error {
 	var userId int
 	err := s.db.QueryRow(checkUserIdQuery, id).Scan(&userId)
@@ -139,3 +749,75 @@ func (s *PostgresStore) CheckUserID(id int) error {
 	}
 	return nil
 }
+
+func (s *PostgresStore) CreateUser(arg CreateUserParams) (int, error) {
+
+	var userId int
+	err := s.db.QueryRow(createUserQuery,
+		arg.Name,
+		arg.Mobile,
+		arg.Latitude,
+		arg.Longitude).Scan(&userId)
+
+	if err != nil {
+		return -1, err
+	}
+
+	return userId, nil
+}
+
+func (s *PostgresStore) GetUser(id int) (User, error) {
+	return scanUser(s.db.QueryRow(getUserQuery, id))
+}
+
+func (s *PostgresStore) UpdateUser(arg UpdateUserParams) (User, error) {
+	return scanUser(s.db.QueryRow(updateUserQuery,
+		arg.ID,
+		arg.Name,
+		arg.Mobile,
+		arg.Latitude,
+		arg.Longitude))
+}
+
+// DeleteUser removes a user. It returns sql.ErrNoRows when the user does not
+// exist; users that still own products are kept by the foreign key.
+func (s *PostgresStore) DeleteUser(id int) error {
+	res, err := s.db.Exec(deleteUserQuery, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func scanUser(row rowScanner) (User, error) {
+	var i User
+	var updatedAt sql.NullTime
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.Mobile,
+		&i.Latitude,
+		&i.Longitude,
+		&i.CreatedAt,
+		&updatedAt,
+	)
+	if err != nil {
+		return User{}, err
+	}
+	i.UpdatedAt = updatedAt.Time
+
+	return i, nil
+}
+
+// isForeignKeyViolation reports whether err is a postgres foreign key error.
+func isForeignKeyViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23503"
+}
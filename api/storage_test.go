@@ -1,8 +1,10 @@
 package main
 
 import (
+	"database/sql"
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -16,12 +18,12 @@ func createRandomProduct(t *testing.T) Product {
 		UserID:      int(RandomInt(1, 100)),
 	}
 
-	productId, err := testPostgresStore.CreateProduct(arg)
+	created, err := testPostgresStore.CreateProduct(arg)
 	assert.NoError(t, err)
-	assert.NotZero(t, productId)
-	product, err := testPostgresStore.GetProduct(productId)
+	assert.NotZero(t, created.ID)
+	product, err := testPostgresStore.GetProduct(int(created.ID))
 	assert.NoError(t, err)
-	assert.NotEmpty(t, product)
+	assert.Equal(t, created, product)
 	return product
 }
 func Test_DB_CreateProduct(t *testing.T) {
@@ -32,10 +34,87 @@ func Test_DB_AddProductCompressImages(t *testing.T) {
 	product := createRandomProduct(t)
 	arg1 := AddProductCompressImagesParams{
 		ID:               int(product.ID),
-		CompressedImages: []string{"./images/" + RandomString(5) + ".png", "./images/" + RandomString(5) + ".png"},
+		CompressedImages: []string{"./images/" + RandomString(5) + ".png"},
+		Append:           true,
 	}
 	err := testPostgresStore.AddProductCompressImages(arg1)
 	assert.NoError(t, err)
+
+	arg2 := AddProductCompressImagesParams{
+		ID:               int(product.ID),
+		CompressedImages: []string{"./images/" + RandomString(5) + ".png"},
+		Append:           true,
+		Worker:           "worker-" + RandomString(3),
+	}
+	err = testPostgresStore.AddProductCompressImages(arg2)
+	assert.NoError(t, err)
+
+	newProduct, err := testPostgresStore.GetProduct(int(product.ID))
+	assert.NoError(t, err)
+	assert.Equal(t, append(arg1.CompressedImages, arg2.CompressedImages...), newProduct.CompressedImages)
+	assert.Equal(t, arg2.Worker, newProduct.CompressedBy)
+	assert.NotNil(t, newProduct.CompressedAt)
+
+	// every image is compressed already
+	err = testPostgresStore.AddProductCompressImages(arg2)
+	assert.ErrorIs(t, err, ErrImageCount)
+
+	arg3 := AddProductCompressImagesParams{
+		ID:               int(product.ID),
+		CompressedImages: []string{"./images/a_listing.png", "./images/b_listing.png"},
+		Renditions: map[string][]string{
+			"listing": {"./images/a_listing.png", "./images/b_listing.png"},
+			"thumb":   {"./images/a_thumb.jpg", "./images/b_thumb.jpg"},
+		},
+	}
+	err = testPostgresStore.AddProductCompressImages(arg3)
+	assert.NoError(t, err)
+
+	newProduct, err = testPostgresStore.GetProduct(int(product.ID))
+	assert.NoError(t, err)
+	assert.Equal(t, arg3.Renditions, newProduct.Renditions)
+
+	// a set needs a location per product image
+	arg1.Append = false
+	err = testPostgresStore.AddProductCompressImages(arg1)
+	assert.ErrorIs(t, err, ErrImageCount)
+
+	arg3.ExpectedVersion = product.Version
+	err = testPostgresStore.AddProductCompressImages(arg3)
+	assert.ErrorIs(t, err, ErrVersionMismatch)
+
+	arg1.ID = 0
+	err = testPostgresStore.AddProductCompressImages(arg1)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+}
+
+func Test_Storage_MergeCompressedImages(t *testing.T) {
+	current := Product{
+		Images:           []string{"a", "b", "c"},
+		CompressedImages: []string{"a.png"},
+		Renditions:       map[string][]string{"thumb": {"a_thumb.jpg"}, "zoom": {"a_zoom.jpg"}},
+	}
+
+	// the stored paths are kept, written ones are set by source
+	compressed, renditions := mergeCompressedImages(current, []string{"c", "gone"}, AddProductCompressImagesParams{
+		CompressedImages: []string{"c.png", "gone.png"},
+		Renditions:       map[string][]string{"thumb": {"c_thumb.jpg", "gone_thumb.jpg"}},
+	})
+	assert.Equal(t, []string{"a.png", "", "c.png"}, compressed)
+	assert.Equal(t, map[string][]string{
+		"thumb": {"a_thumb.jpg", "", "c_thumb.jpg"},
+		"zoom":  {"a_zoom.jpg", "", ""},
+	}, renditions)
+
+	// writing a source again replaces its paths, and renditions no image
+	// has any more are dropped
+	current.CompressedImages, current.Renditions = compressed, renditions
+	compressed, renditions = mergeCompressedImages(current, []string{"a"}, AddProductCompressImagesParams{
+		CompressedImages: []string{"a2.png"},
+		Renditions:       map[string][]string{"thumb": {"a2_thumb.jpg"}},
+	})
+	assert.Equal(t, []string{"a2.png", "", "c.png"}, compressed)
+	assert.Equal(t, map[string][]string{"thumb": {"a2_thumb.jpg", "", "c_thumb.jpg"}}, renditions)
 }
 
 func Test_DB_GetProduct(t *testing.T) {
@@ -64,3 +143,181 @@ func Test_DB_CheckUserID(t *testing.T) {
 	err = testPostgresStore.CheckUserID(int(0))
 	assert.Error(t, err)
 }
+
+func Test_DB_ListProducts(t *testing.T) {
+	first := createRandomProduct(t)
+	for i := 0; i < 2; i++ {
+		arg := CreateProductParams{
+			Name:        RandomString(5),
+			Description: RandomString(10),
+			Images:      []string{RandomString(5)},
+			Price:       strconv.Itoa(int(RandomInt(100, 1000))),
+			UserID:      int(first.UserID),
+		}
+		_, err := testPostgresStore.CreateProduct(arg)
+		assert.NoError(t, err)
+	}
+
+	products, err := testPostgresStore.ListProducts(ListProductsParams{UserID: int(first.UserID), Limit: 2})
+	assert.NoError(t, err)
+	assert.Len(t, products, 2)
+	for _, p := range products {
+		assert.Equal(t, first.UserID, p.UserID)
+	}
+
+	last := products[len(products)-1]
+	rest, err := testPostgresStore.ListProducts(ListProductsParams{
+		UserID: int(first.UserID),
+		Limit:  10,
+		Cursor: &ProductCursor{SortBy: "id", Value: productCursorValue(last, "id"), ID: last.ID},
+	})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, rest)
+	for _, p := range rest {
+		assert.Greater(t, p.ID, last.ID)
+	}
+
+	minPrice, maxPrice := 100.0, 1000.0
+	products, err = testPostgresStore.ListProducts(ListProductsParams{
+		MinPrice:   &minPrice,
+		MaxPrice:   &maxPrice,
+		SortBy:     "price",
+		Descending: true,
+		Limit:      10,
+	})
+	assert.NoError(t, err)
+	for i := 1; i < len(products); i++ {
+		assert.GreaterOrEqual(t, products[i-1].Price, products[i].Price)
+	}
+
+	// products never updated are filtered by when they were created, as they
+	// are sorted
+	after := first.CreatedAt.Add(-time.Second)
+	products, err = testPostgresStore.ListProducts(ListProductsParams{
+		UserID:       int(first.UserID),
+		UpdatedAfter: &after,
+		SortBy:       "updated_at",
+		Limit:        10,
+	})
+	assert.NoError(t, err)
+	ids := make([]int64, len(products))
+	for i, p := range products {
+		ids[i] = p.ID
+	}
+	assert.Contains(t, ids, first.ID)
+
+	_, err = testPostgresStore.ListProducts(ListProductsParams{SortBy: "name", Limit: 10})
+	assert.Error(t, err)
+}
+
+func createRandomUser(t *testing.T) User {
+	arg := CreateUserParams{
+		Name:      RandomString(6),
+		Mobile:    strconv.Itoa(RandomInt(1000000000, 9999999999)),
+		Latitude:  strconv.Itoa(RandomInt(-90, 90)),
+		Longitude: strconv.Itoa(RandomInt(-180, 180)),
+	}
+
+	userId, err := testPostgresStore.CreateUser(arg)
+	assert.NoError(t, err)
+	assert.NotZero(t, userId)
+	user, err := testPostgresStore.GetUser(userId)
+	assert.NoError(t, err)
+	assert.Equal(t, arg.Name, user.Name)
+	assert.Equal(t, arg.Mobile, user.Mobile)
+	return user
+}
+
+func Test_DB_CreateUser(t *testing.T) {
+	createRandomUser(t)
+}
+
+func Test_DB_UpdateUser(t *testing.T) {
+	user := createRandomUser(t)
+	name := RandomString(6)
+	updated, err := testPostgresStore.UpdateUser(UpdateUserParams{ID: int(user.ID), Name: &name})
+	assert.NoError(t, err)
+	assert.Equal(t, name, updated.Name)
+	assert.Equal(t, user.Mobile, updated.Mobile)
+	assert.False(t, updated.UpdatedAt.IsZero())
+
+	_, err = testPostgresStore.UpdateUser(UpdateUserParams{ID: 0, Name: &name})
+	assert.Error(t, err)
+}
+
+func Test_DB_DeleteUser(t *testing.T) {
+	user := createRandomUser(t)
+	err := testPostgresStore.DeleteUser(int(user.ID))
+	assert.NoError(t, err)
+	_, err = testPostgresStore.GetUser(int(user.ID))
+	assert.Error(t, err)
+	err = testPostgresStore.DeleteUser(int(user.ID))
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+}
+
+func Test_DB_UpdateProduct(t *testing.T) {
+	product := createRandomProduct(t)
+	assert.Equal(t, int64(1), product.Version)
+
+	name := RandomString(5)
+	images := []string{RandomString(5)}
+	updated, err := testPostgresStore.UpdateProduct(UpdateProductParams{
+		ID:              int(product.ID),
+		ExpectedVersion: product.Version,
+		Name:            &name,
+		Images:          &images,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, name, updated.Name)
+	assert.Equal(t, images, updated.Images)
+	assert.Equal(t, product.Description, updated.Description)
+	assert.Equal(t, product.Version+1, updated.Version)
+	assert.Nil(t, updated.CompressedImages)
+
+	_, err = testPostgresStore.UpdateProduct(UpdateProductParams{
+		ID:              int(product.ID),
+		ExpectedVersion: product.Version,
+		Name:            &name,
+	})
+	assert.ErrorIs(t, err, ErrVersionMismatch)
+
+	_, err = testPostgresStore.UpdateProduct(UpdateProductParams{ID: 0, ExpectedVersion: 1, Name: &name})
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+}
+
+func Test_DB_DeleteProduct(t *testing.T) {
+	product := createRandomProduct(t)
+	err := testPostgresStore.DeleteProduct(int(product.ID), product.Version+1)
+	assert.ErrorIs(t, err, ErrVersionMismatch)
+	err = testPostgresStore.DeleteProduct(int(product.ID), product.Version)
+	assert.NoError(t, err)
+	err = testPostgresStore.DeleteProduct(int(product.ID), product.Version)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+}
+
+func Test_DB_AddProductImages(t *testing.T) {
+	product := createRandomProduct(t)
+	added := []string{RandomString(5), RandomString(5)}
+
+	updated, err := testPostgresStore.AddProductImages(int(product.ID), added, product.Version)
+	assert.NoError(t, err)
+	assert.Equal(t, append(product.Images, added...), updated.Images)
+	assert.Equal(t, product.Version+1, updated.Version)
+
+	_, err = testPostgresStore.AddProductImages(int(product.ID), added, product.Version)
+	assert.ErrorIs(t, err, ErrVersionMismatch)
+
+	// without an expected version the images are appended unconditionally
+	updated, err = testPostgresStore.AddProductImages(int(product.ID), added[:1], 0)
+	assert.NoError(t, err)
+	assert.Len(t, updated.Images, len(product.Images)+3)
+
+	var jobs int
+	err = testPostgresStore.db.QueryRow(`SELECT COUNT(*) FROM outbox WHERE topic = $1 AND payload::jsonb->>'product_id' = $2`,
+		productImagesJobTopic, strconv.Itoa(int(product.ID))).Scan(&jobs)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, jobs)
+
+	_, err = testPostgresStore.AddProductImages(0, added, 0)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const maxImageURLLength = 2048
+
+// priceRegexp matches a non-negative amount of money: up to 10 digits and at
+// most 2 decimals.
+var priceRegexp = regexp.MustCompile(`^(0|[1-9][0-9]{0,9})(\.[0-9]{1,2})?$`)
+
+// Validator checks payload structs against the rules of their validate tags,
+// separated by commas:
+//
+//	required     not empty: a blank string, an empty slice or a zero number
+//	min=n, max=n the length of a string in characters, or of a slice
+//	price        a decimal amount with at most two decimals, see priceRegexp
+//	imageurl     an absolute URL of an allowed scheme and host, or the
+//	             location of an object of the image store
+//	unique       no repeated elements
+//	dive         checks every element of a slice with the rules after it
+//
+// A field is named in errors by its JSON name. Pointer fields are optional:
+// nil is not checked and anything else is checked as its value, so that a
+// partial update is held to the same rules as a create.
+type Validator struct {
+	// ImageSchemes are the URL schemes product images may use.
+	ImageSchemes []string
+	// ImageHosts, if not empty, are the hosts product images may be fetched
+	// from, each with its subdomains.
+	ImageHosts []string
+	// ImageStore, if set, also allows the locations of its objects, such as
+	// uploaded images, whatever their scheme and host.
+	ImageStore interface{ Owns(rawurl string) bool }
+}
+
+func NewValidator(imageHosts []string) *Validator {
+	return &Validator{
+		ImageSchemes: []string{"http", "https"},
+		ImageHosts:   imageHosts,
+	}
+}
+
+// Validate returns the FieldErrors of payload, a pointer to a struct or a
+// struct, or nil if it is valid. At most one error is reported per field.
+func (v *Validator) Validate(payload any) error {
+	value := reflect.Indirect(reflect.ValueOf(payload))
+	var errs FieldErrors
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		tag, ok := field.Tag.Lookup("validate")
+		if !ok || !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" {
+			name = field.Name
+		}
+
+		fv := value.Field(i)
+		if fv.Kind() == reflect.Pointer {
+			if fv.IsNil() {
+				continue
+			}
+			fv = fv.Elem()
+		}
+		errs = append(errs, v.check(name, fv, strings.Split(tag, ","))...)
+	}
+	if errs == nil {
+		return nil
+	}
+	return errs
+}
+
+func (v *Validator) check(field string, value reflect.Value, rules []string) []FieldError {
+	for i, rule := range rules {
+		name, arg, _ := strings.Cut(rule, "=")
+		if name == "dive" {
+			var errs []FieldError
+			for j := 0; j < value.Len(); j++ {
+				errs = append(errs, v.check(fmt.Sprintf("%s[%d]", field, j), value.Index(j), rules[i+1:])...)
+			}
+			return errs
+		}
+		if fe := v.apply(field, value, name, arg); fe != nil {
+			return []FieldError{*fe}
+		}
+	}
+	return nil
+}
+
+// apply checks value against one rule.
+func (v *Validator) apply(field string, value reflect.Value, rule, arg string) *FieldError {
+	fail := func(code, format string, a ...any) *FieldError {
+		fe := fieldError(field, code, format, a...)
+		return &fe
+	}
+
+	switch rule {
+	case "required":
+		if value.Kind() == reflect.String && strings.TrimSpace(value.String()) == "" ||
+			value.Kind() == reflect.Slice && value.Len() == 0 ||
+			value.IsZero() {
+			return fail(FieldRequired, "is required")
+		}
+
+	case "min", "max":
+		limit, err := strconv.Atoi(arg)
+		if err != nil {
+			panic(fmt.Sprintf("validate: bad %s rule %q", rule, arg))
+		}
+		n, unit := value.Len(), "items"
+		if value.Kind() == reflect.String {
+			n, unit = utf8.RuneCountInString(value.String()), "characters"
+		}
+		if rule == "min" && n < limit {
+			return fail(FieldOutOfRange, "must have at least %d %s", limit, unit)
+		}
+		if rule == "max" && n > limit {
+			return fail(FieldOutOfRange, "must have at most %d %s", limit, unit)
+		}
+
+	case "price":
+		if !priceRegexp.MatchString(value.String()) {
+			return fail(FieldInvalid, "must be a non-negative decimal number with at most 2 decimals")
+		}
+
+	case "imageurl":
+		if msg := v.checkImageURL(value.String()); msg != "" {
+			return fail(FieldInvalid, "%s", msg)
+		}
+
+	case "unique":
+		seen := make(map[any]bool, value.Len())
+		for j := 0; j < value.Len(); j++ {
+			elem := value.Index(j).Interface()
+			if seen[elem] {
+				fe := fieldError(fmt.Sprintf("%s[%d]", field, j), FieldDuplicate, "is a duplicate")
+				return &fe
+			}
+			seen[elem] = true
+		}
+
+	default:
+		panic(fmt.Sprintf("validate: unknown rule %q", rule))
+	}
+	return nil
+}
+
+// checkImageURL returns why rawurl may not be a product image, or "".
+func (v *Validator) checkImageURL(rawurl string) string {
+	if len(rawurl) > maxImageURLLength {
+		return fmt.Sprintf("must be at most %d characters", maxImageURLLength)
+	}
+	if v.ImageStore != nil && v.ImageStore.Owns(rawurl) {
+		return ""
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil || !u.IsAbs() || u.Hostname() == "" {
+		return "must be an absolute URL"
+	}
+	if !contains(v.ImageSchemes, u.Scheme) {
+		return fmt.Sprintf("must use one of the schemes %s", strings.Join(v.ImageSchemes, ", "))
+	}
+	if len(v.ImageHosts) == 0 {
+		return ""
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range v.ImageHosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || strings.HasSuffix(host, "."+allowed) {
+			return ""
+		}
+	}
+	return fmt.Sprintf("host %s is not allowed", host)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// decodePayload decodes a JSON payload into v, rejecting fields that v does
+// not have. Malformed JSON is a 400 problem, an unknown field a FieldError.
+func decodePayload(r io.Reader, v any) error {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		if name, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+			return fieldError(strings.Trim(name, `"`), FieldUnknown, "is not a known field")
+		}
+		return malformedBody(err)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Validator_CreateProduct(t *testing.T) {
+	v := NewValidator([]string{"placeholder.com"})
+	good := CreateProductParams{
+		Name:        "a",
+		Description: "b",
+		Images:      []string{"https://via.placeholder.com/100/1", "http://placeholder.com/100/2"},
+		Price:       "12.50",
+		UserID:      1,
+	}
+	assert.NoError(t, v.Validate(good))
+	assert.NoError(t, v.Validate(&good))
+
+	for _, price := range []string{"0", "0.5", "10", "9999999999.99"} {
+		ok := good
+		ok.Price = price
+		assert.NoError(t, v.Validate(ok), price)
+	}
+	for _, price := range []string{"abc", "-1", "1e5", "NaN", "1.", "12.345", "01", "12345678901"} {
+		bad := good
+		bad.Price = price
+		assertFieldError(t, v.Validate(bad), "price", FieldInvalid)
+	}
+
+	for image, code := range map[string]string{
+		"":                             FieldRequired,
+		"/100/1":                       FieldInvalid,
+		"ftp://placeholder.com/1":      FieldInvalid,
+		"https://evil.com/1":           FieldInvalid,
+		"https://notplaceholder.com/1": FieldInvalid,
+		"https://placeholder.com/" + strings.Repeat("a", maxImageURLLength): FieldInvalid,
+	} {
+		bad := good
+		bad.Images = []string{good.Images[0], image}
+		assertFieldError(t, v.Validate(bad), "images[1]", code)
+	}
+
+	bad := good
+	bad.Images = []string{good.Images[0], good.Images[0]}
+	assertFieldError(t, v.Validate(bad), "images[1]", FieldDuplicate)
+	bad.Images = make([]string, 21)
+	assertFieldError(t, v.Validate(bad), "images", FieldOutOfRange)
+
+	bad = good
+	bad.Name = strings.Repeat("é", 201)
+	assertFieldError(t, v.Validate(bad), "name", FieldOutOfRange)
+	bad.Name = strings.Repeat("é", 200)
+	assert.NoError(t, v.Validate(bad))
+
+	err := v.Validate(CreateProductParams{Name: "  ", Price: "x"})
+	var errs FieldErrors
+	assert.True(t, errors.As(err, &errs))
+	assert.Equal(t, []string{"name", "description", "price", "user_id"}, fieldNames(errs))
+}
+
+func Test_Validator_UpdateProduct(t *testing.T) {
+	v := NewValidator(nil)
+	assert.NoError(t, v.Validate(UpdateProductParams{}))
+
+	price := "1.999"
+	empty := ""
+	images := []string{}
+	err := v.Validate(UpdateProductParams{Name: &empty, Images: &images, Price: &price})
+	var errs FieldErrors
+	assert.True(t, errors.As(err, &errs))
+	assert.Equal(t, []string{"name", "images", "price"}, fieldNames(errs))
+
+	// any host is allowed without an allow-list
+	images = []string{"https://example.org/a.png"}
+	assert.NoError(t, v.Validate(UpdateProductParams{Images: &images}))
+
+	// uploaded images are kept with the product images they were added to
+	v = NewValidator([]string{"placeholder.com"})
+	v.ImageStore = ownsPrefix("file:///images/")
+	images = []string{"https://placeholder.com/1", "file:///images/originals/a.png"}
+	assert.NoError(t, v.Validate(UpdateProductParams{Images: &images}))
+	images = []string{"https://placeholder.com/1", "file:///etc/passwd"}
+	assertFieldError(t, v.Validate(UpdateProductParams{Images: &images}), "images[1]", FieldInvalid)
+}
+
+type ownsPrefix string
+
+func (p ownsPrefix) Owns(rawurl string) bool {
+	return strings.HasPrefix(rawurl, string(p))
+}
+
+func Test_Validator_DecodePayload(t *testing.T) {
+	var params CreateProductParams
+	assert.NoError(t, decodePayload(strings.NewReader(`{"name":"a","price":"1"}`), &params))
+	assert.Equal(t, "a", params.Name)
+
+	err := decodePayload(strings.NewReader(`{"name":"a","colour":"red"}`), &params)
+	assertFieldError(t, err, "colour", FieldUnknown)
+
+	err = decodePayload(strings.NewReader(`{"name":`), &params)
+	assert.Equal(t, CodeMalformedBody, problemFor(err).Code)
+}
+
+func assertFieldError(t *testing.T, err error, field, code string) {
+	t.Helper()
+	p := problemFor(err)
+	if assert.Len(t, p.Errors, 1, err) {
+		assert.Equal(t, field, p.Errors[0].Field)
+		assert.Equal(t, code, p.Errors[0].Code)
+	}
+}
+
+func fieldNames(errs FieldErrors) []string {
+	names := make([]string, len(errs))
+	for i, fe := range errs {
+		names[i] = fe.Field
+	}
+	return names
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	webhookBatchSize    = 20
+	webhookPollInterval = time.Second
+	webhookTimeout      = 10 * time.Second
+	// webhookLease is how long a claimed delivery is hidden from other
+	// dispatchers; it must outlast webhookTimeout
+	webhookLease        = time.Minute
+	webhookMaxAttempts  = 8
+	webhookBaseDelay    = 10 * time.Second
+	webhookMaxDelay     = time.Hour
+	webhookSignatureKey = "X-Webhook-Signature"
+)
+
+// PendingDelivery is a delivery claimed by a dispatcher, together with the
+// target of its webhook.
+type PendingDelivery struct {
+	ID       int64
+	Event    string
+	Payload  string
+	Attempts int
+	URL      string
+	Secret   string
+}
+
+// WebhookAttempt is the outcome of one attempt at a delivery. StatusCode is
+// 0 if no response was received.
+type WebhookAttempt struct {
+	DeliveryID int64
+	StatusCode int
+	Error      string
+	// NextAttempt is set while the delivery is to be retried
+	NextAttempt *time.Time
+	Succeeded   bool
+}
+
+const (
+	// claimWebhookDeliveriesQuery hides up to $1 due deliveries from the
+	// other dispatchers for $2 seconds and returns them
+	claimWebhookDeliveriesQuery = `
+	UPDATE webhook_deliveries d
+	SET next_attempt_at = NOW() + make_interval(secs => $2)
+	FROM webhooks w
+	WHERE w.id = d.webhook_id AND d.id IN (
+		SELECT id FROM webhook_deliveries
+		WHERE status = 'pending' AND next_attempt_at <= NOW()
+		ORDER BY next_attempt_at, id
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED
+	)
+	RETURNING d.id, d.event, d.payload, d.attempts, w.url, w.secret
+	`
+
+	recordWebhookAttemptQuery = `
+	UPDATE webhook_deliveries
+	SET attempts = attempts + 1,
+	status = $2,
+	last_status_code = NULLIF($3, 0),
+	last_error = NULLIF($4, ''),
+	next_attempt_at = COALESCE($5, next_attempt_at),
+	delivered_at = CASE WHEN $2 = 'succeeded' THEN NOW() ELSE delivered_at END
+	WHERE id = $1
+	`
+)
+
+func (s *PostgresStore) ClaimWebhookDeliveries(limit int, lease time.Duration) ([]PendingDelivery, error) {
+	rows, err := s.db.Query(claimWebhookDeliveriesQuery, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []PendingDelivery
+	for rows.Next() {
+		var d PendingDelivery
+		if err := rows.Scan(&d.ID, &d.Event, &d.Payload, &d.Attempts, &d.URL, &d.Secret); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+func (s *PostgresStore) RecordWebhookAttempt(arg WebhookAttempt) error {
+	status := DeliveryFailed
+	switch {
+	case arg.Succeeded:
+		status = DeliverySucceeded
+	case arg.NextAttempt != nil:
+		status = DeliveryPending
+	}
+	var next any
+	if arg.NextAttempt != nil {
+		next = *arg.NextAttempt
+	}
+	_, err := s.db.Exec(recordWebhookAttemptQuery, arg.DeliveryID, status, arg.StatusCode, arg.Error, next)
+	return err
+}
+
+// webhookRetryDelay is the wait before the attempt after attempt, doubling
+// from webhookBaseDelay up to webhookMaxDelay.
+func webhookRetryDelay(attempt int) time.Duration {
+	delay := webhookBaseDelay
+	for i := 1; i < attempt && delay < webhookMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > webhookMaxDelay {
+		delay = webhookMaxDelay
+	}
+	return delay
+}
+
+// signWebhook returns the X-Webhook-Signature header of a payload sent at t:
+// "t=<unix seconds>,v1=<hex HMAC-SHA256 of "<unix seconds>.<payload>">".
+// Receivers recompute it with their secret and reject old timestamps.
+func signWebhook(secret string, t time.Time, payload []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookDispatcher posts the queued webhook deliveries and records every
+// attempt. Several API instances may run one each.
+type WebhookDispatcher struct {
+	store  Storage
+	client *http.Client
+}
+
+func NewWebhookDispatcher(store Storage) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		store:  store,
+		client: &http.Client{Timeout: webhookTimeout},
+	}
+}
+
+// Run delivers due webhooks until ctx is done.
+func (d *WebhookDispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for {
+				n, err := d.dispatch(ctx)
+				if err != nil {
+					log.Printf("webhook dispatcher: %s", err)
+				}
+				if err != nil || n < webhookBatchSize {
+					break
+				}
+			}
+		}
+	}
+}
+
+// dispatch claims a batch of due deliveries, sends them in parallel and
+// returns how many it claimed.
+func (d *WebhookDispatcher) dispatch(ctx context.Context) (int, error) {
+	deliveries, err := d.store.ClaimWebhookDeliveries(webhookBatchSize, webhookLease)
+	if err != nil {
+		return 0, err
+	}
+
+	var wg sync.WaitGroup
+	for _, delivery := range deliveries {
+		wg.Add(1)
+		go func(delivery PendingDelivery) {
+			defer wg.Done()
+			attempt := d.deliver(ctx, delivery)
+			if err := d.store.RecordWebhookAttempt(attempt); err != nil {
+				log.Printf("webhook dispatcher: delivery %d: %s", delivery.ID, err)
+			}
+		}(delivery)
+	}
+	wg.Wait()
+	return len(deliveries), nil
+}
+
+// deliver posts one delivery and returns the outcome, scheduling a retry
+// unless it succeeded or ran out of attempts.
+func (d *WebhookDispatcher) deliver(ctx context.Context, delivery PendingDelivery) WebhookAttempt {
+	attempt := WebhookAttempt{DeliveryID: delivery.ID}
+
+	statusCode, err := d.post(ctx, delivery)
+	attempt.StatusCode = statusCode
+	if err == nil {
+		attempt.Succeeded = true
+		return attempt
+	}
+	attempt.Error = err.Error()
+
+	if n := delivery.Attempts + 1; n < webhookMaxAttempts {
+		next := time.Now().Add(webhookRetryDelay(n))
+		attempt.NextAttempt = &next
+	}
+	log.Printf("webhook delivery %d to %s failed (attempt %d): %s", delivery.ID, delivery.URL, delivery.Attempts+1, err)
+	return attempt
+}
+
+func (d *WebhookDispatcher) post(ctx context.Context, delivery PendingDelivery) (int, error) {
+	payload := []byte(delivery.Payload)
+	req, err := http.NewRequestWithContext(ctx, "POST", delivery.URL, strings.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go-message-queue-api-webhooks")
+	req.Header.Set("X-Webhook-Event", delivery.Event)
+	req.Header.Set("X-Webhook-Delivery", strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(webhookSignatureKey, signWebhook(delivery.Secret, time.Now(), payload))
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return res.StatusCode, fmt.Errorf("%s %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	return res.StatusCode, nil
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Webhook events.
+const (
+	// WebhookImagesReady fires when the compressed images of a product are
+	// written
+	WebhookImagesReady = "product.images_ready"
+	// WebhookProcessingFailed fires when the processing of a product failed
+	// for good
+	WebhookProcessingFailed = "product.processing_failed"
+)
+
+var webhookEvents = []string{WebhookImagesReady, WebhookProcessingFailed}
+
+// Delivery states.
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+// Webhook is a subscription to product events. Webhooks without a user get
+// the events of every product. The secret signs the payloads and is only
+// returned when the webhook is created.
+type Webhook struct {
+	ID        int64     `json:"id"`
+	UserID    *int64    `json:"user_id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	Events    []string  `json:"events"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// WebhookPayload is the JSON body posted to a webhook.
+type WebhookPayload struct {
+	Event     string    `json:"event"`
+	ProductID int64     `json:"product_id"`
+	CreatedAt time.Time `json:"created_at"`
+	Data      any       `json:"data"`
+}
+
+// WebhookDelivery is one event sent, or still to be sent, to a webhook.
+type WebhookDelivery struct {
+	ID             int64           `json:"id"`
+	WebhookID      int64           `json:"webhook_id"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  *time.Time      `json:"next_attempt_at,omitempty"`
+	LastStatusCode int             `json:"last_status_code,omitempty"`
+	LastError      string          `json:"last_error,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	DeliveredAt    *time.Time      `json:"delivered_at,omitempty"`
+}
+
+type CreateWebhookParams struct {
+	UserID *int64   `json:"user_id"`
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+}
+
+// UpdateWebhookParams holds a partial update of a webhook; nil fields are
+// left unchanged.
+type UpdateWebhookParams struct {
+	ID     int       `json:"-"`
+	URL    *string   `json:"url"`
+	Events *[]string `json:"events"`
+	Active *bool     `json:"active"`
+}
+
+// ListWebhookDeliveriesParams selects a page of the delivery log of a
+// webhook, newest first. Before is the id of the last delivery of the
+// previous page.
+type ListWebhookDeliveriesParams struct {
+	WebhookID int
+	Status    string
+	Before    int64
+	Limit     int
+}
+
+const (
+	webhookColumns = `id,user_id,url,secret,events,active,created_at,updated_at`
+
+	deliveryColumns = `id,webhook_id,event,payload,status,attempts,next_attempt_at,last_status_code,last_error,created_at,delivered_at`
+
+	createWebhookQuery = `
+	INSERT INTO webhooks (
+	user_id, url, secret, events
+	) VALUES (
+	$1, $2, $3, $4
+	)
+	RETURNING ` + webhookColumns + `
+	`
+
+	getWebhookQuery = `
+	SELECT ` + webhookColumns + ` FROM webhooks WHERE
+	id = $1
+	`
+
+	listWebhooksQuery = `
+	SELECT ` + webhookColumns + ` FROM webhooks
+	WHERE $1::bigint = 0 OR user_id = $1
+	ORDER BY id
+	`
+
+	updateWebhookQuery = `
+	UPDATE webhooks
+	SET url = COALESCE($2, url),
+	events = COALESCE($3, events),
+	active = COALESCE($4, active),
+	updated_at = (SELECT NOW())
+	WHERE webhooks.id = $1
+	RETURNING ` + webhookColumns + `
+	`
+
+	deleteWebhookQuery = `
+	DELETE FROM webhooks WHERE id = $1
+	`
+
+	// enqueueWebhookDeliveriesQuery queues the payload $3 of event $2 of
+	// product $1 for the active webhooks of its owner and the global ones
+	enqueueWebhookDeliveriesQuery = `
+	INSERT INTO webhook_deliveries (
+	webhook_id, event, payload
+	)
+	SELECT w.id, $2, $3
+	FROM webhooks w JOIN products p ON p.id = $1
+	WHERE w.active AND (w.user_id IS NULL OR w.user_id = p.user_id) AND $2 = ANY(w.events)
+	`
+
+	listWebhookDeliveriesQuery = `
+	SELECT ` + deliveryColumns + ` FROM webhook_deliveries
+	WHERE webhook_id = $1
+	AND ($2 = '' OR status = $2)
+	AND ($3::bigint = 0 OR id < $3)
+	ORDER BY id DESC
+	LIMIT $4
+	`
+)
+
+// enqueueWebhookDeliveries queues an event of a product in tx for every
+// webhook subscribed to it.
+func enqueueWebhookDeliveries(tx *sql.Tx, productId int, event string, data any) error {
+	payload, err := json.Marshal(WebhookPayload{
+		Event:     event,
+		ProductID: int64(productId),
+		CreatedAt: time.Now().UTC(),
+		Data:      data,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(enqueueWebhookDeliveriesQuery, productId, event, string(payload))
+	return err
+}
+
+func scanWebhook(row rowScanner) (Webhook, error) {
+	var h Webhook
+	var userId sql.NullInt64
+	err := row.Scan(
+		&h.ID,
+		&userId,
+		&h.URL,
+		&h.Secret,
+		pq.Array(&h.Events),
+		&h.Active,
+		&h.CreatedAt,
+		&h.UpdatedAt,
+	)
+	if err != nil {
+		return Webhook{}, err
+	}
+	if userId.Valid {
+		h.UserID = &userId.Int64
+	}
+	return h, nil
+}
+
+func scanWebhookDelivery(row rowScanner) (WebhookDelivery, error) {
+	var d WebhookDelivery
+	var payload string
+	var nextAttemptAt, deliveredAt sql.NullTime
+	var lastStatusCode sql.NullInt64
+	var lastError sql.NullString
+	err := row.Scan(
+		&d.ID,
+		&d.WebhookID,
+		&d.Event,
+		&payload,
+		&d.Status,
+		&d.Attempts,
+		&nextAttemptAt,
+		&lastStatusCode,
+		&lastError,
+		&d.CreatedAt,
+		&deliveredAt,
+	)
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+	d.Payload = json.RawMessage(payload)
+	if d.Status == DeliveryPending {
+		d.NextAttemptAt = nullTimePtr(nextAttemptAt)
+	}
+	d.LastStatusCode = int(lastStatusCode.Int64)
+	d.LastError = lastError.String
+	d.DeliveredAt = nullTimePtr(deliveredAt)
+	return d, nil
+}
+
+func (s *PostgresStore) CreateWebhook(arg CreateWebhookParams) (Webhook, error) {
+	return scanWebhook(s.db.QueryRow(createWebhookQuery, arg.UserID, arg.URL, arg.Secret, pq.Array(arg.Events)))
+}
+
+func (s *PostgresStore) GetWebhook(id int) (Webhook, error) {
+	return scanWebhook(s.db.QueryRow(getWebhookQuery, id))
+}
+
+// ListWebhooks returns the webhooks of a user, or all webhooks for userId 0.
+func (s *PostgresStore) ListWebhooks(userId int) ([]Webhook, error) {
+	rows, err := s.db.Query(listWebhooksQuery, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []Webhook{}
+	for rows.Next() {
+		h, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, h)
+	}
+	return webhooks, rows.Err()
+}
+
+func (s *PostgresStore) UpdateWebhook(arg UpdateWebhookParams) (Webhook, error) {
+	var events any
+	if arg.Events != nil {
+		events = pq.Array(*arg.Events)
+	}
+	return scanWebhook(s.db.QueryRow(updateWebhookQuery, arg.ID, arg.URL, events, arg.Active))
+}
+
+func (s *PostgresStore) DeleteWebhook(id int) error {
+	res, err := s.db.Exec(deleteWebhookQuery, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (s *PostgresStore) ListWebhookDeliveries(arg ListWebhookDeliveriesParams) ([]WebhookDelivery, error) {
+	rows, err := s.db.Query(listWebhookDeliveriesQuery, arg.WebhookID, arg.Status, arg.Before, arg.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// authorizeWebhook returns the webhook with id if the caller may manage it:
+// its owner, or an admin for every webhook including the global ones.
+func (s *APIServer) authorizeWebhook(r *http.Request, id int) (Webhook, error) {
+	webhook, err := s.store.GetWebhook(id)
+	if err == sql.ErrNoRows {
+		return Webhook{}, webhookNotFound()
+	}
+	if err != nil {
+		return Webhook{}, err
+	}
+	if !principalOf(r).canManageWebhooksOf(webhook.UserID) {
+		return Webhook{}, forbidden("webhook belongs to another user")
+	}
+	return webhook, nil
+}
+
+// canManageWebhooksOf reports whether p may manage the webhooks of the user
+// userID, or the global webhooks if userID is nil, which only admins may.
+func (p Principal) canManageWebhooksOf(userID *int64) bool {
+	if userID == nil {
+		return p.Role == RoleAdmin
+	}
+	return p.CanActFor(int(*userID))
+}
+
+func (s *APIServer) handleCreateWebhook(w http.ResponseWriter, r *http.Request) error {
+
+	var params CreateWebhookParams
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		return WriteProblem(w, malformedBody(err))
+	}
+	if params.Events == nil {
+		params.Events = webhookEvents
+	}
+	if err := validateWebhook(&params.URL, &params.Events); err != nil {
+		return writeError(w, err)
+	}
+	if params.UserID != nil && *params.UserID < 1 {
+		return writeError(w, fieldError("user_id", FieldInvalid, "must be a user id"))
+	}
+	// users subscribe to the events of their own products by default
+	principal := principalOf(r)
+	if params.UserID == nil && principal.UserID != 0 {
+		userId := int64(principal.UserID)
+		params.UserID = &userId
+	}
+	if !principal.canManageWebhooksOf(params.UserID) {
+		if params.UserID == nil {
+			return WriteProblem(w, forbidden("webhooks for every product require the admin role"))
+		}
+		return WriteProblem(w, forbidden("not allowed to act for user "+strconv.FormatInt(*params.UserID, 10)))
+	}
+	if params.Secret == "" {
+		params.Secret = newWebhookSecret()
+	} else if len(params.Secret) < 16 || len(params.Secret) > 255 {
+		return writeError(w, fieldError("secret", FieldInvalid, "must be 16 to 255 characters"))
+	}
+
+	webhook, err := s.store.CreateWebhook(params)
+	if err != nil {
+		if isForeignKeyViolation(err) {
+			return writeError(w, fieldError("user_id", FieldNotFound, "user id not found"))
+		}
+		return writeError(w, err)
+	}
+
+	return WriteJSON(w, http.StatusCreated, webhook)
+}
+
+// handleListWebhooks lists the webhooks of ?user_id=, or without it those of
+// the caller, or every webhook for admins.
+func (s *APIServer) handleListWebhooks(w http.ResponseWriter, r *http.Request) error {
+
+	principal := principalOf(r)
+	userId := principal.UserID
+	if v := r.URL.Query().Get("user_id"); v != "" {
+		var err error
+		userId, err = strconv.Atoi(v)
+		if err != nil || userId < 1 {
+			return WriteProblem(w, parameterProblem(fieldError("user_id", FieldInvalid, "must be a user id")))
+		}
+		if err := authorizeUser(r, userId); err != nil {
+			return writeError(w, err)
+		}
+	} else if userId == 0 && principal.Role != RoleAdmin {
+		return WriteProblem(w, forbidden("the webhooks of every user require the admin role"))
+	}
+
+	webhooks, err := s.store.ListWebhooks(userId)
+	if err != nil {
+		return writeError(w, err)
+	}
+	for i := range webhooks {
+		webhooks[i].Secret = ""
+	}
+
+	return WriteJSON(w, http.StatusOK, webhooks)
+}
+
+func (s *APIServer) handleGetWebhook(w http.ResponseWriter, r *http.Request) error {
+
+	webhookId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return WriteProblem(w, invalidID("webhook"))
+	}
+
+	webhook, err := s.authorizeWebhook(r, webhookId)
+	if err != nil {
+		return writeError(w, err)
+	}
+	webhook.Secret = ""
+
+	return WriteJSON(w, http.StatusOK, webhook)
+}
+
+func (s *APIServer) handlePatchWebhook(w http.ResponseWriter, r *http.Request) error {
+
+	webhookId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return WriteProblem(w, invalidID("webhook"))
+	}
+
+	var params UpdateWebhookParams
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		return WriteProblem(w, malformedBody(err))
+	}
+	if params.URL != nil {
+		if err := validateWebhook(params.URL, nil); err != nil {
+			return writeError(w, err)
+		}
+	}
+	if params.Events != nil {
+		if err := validateWebhook(nil, params.Events); err != nil {
+			return writeError(w, err)
+		}
+	}
+	params.ID = webhookId
+	if _, err := s.authorizeWebhook(r, webhookId); err != nil {
+		return writeError(w, err)
+	}
+
+	webhook, err := s.store.UpdateWebhook(params)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return WriteProblem(w, webhookNotFound())
+		}
+		return writeError(w, err)
+	}
+	webhook.Secret = ""
+
+	return WriteJSON(w, http.StatusOK, webhook)
+}
+
+func (s *APIServer) handleDeleteWebhook(w http.ResponseWriter, r *http.Request) error {
+
+	webhookId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return WriteProblem(w, invalidID("webhook"))
+	}
+	if _, err := s.authorizeWebhook(r, webhookId); err != nil {
+		return writeError(w, err)
+	}
+
+	if err := s.store.DeleteWebhook(webhookId); err != nil {
+		if err == sql.ErrNoRows {
+			return WriteProblem(w, webhookNotFound())
+		}
+		return writeError(w, err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// handleListWebhookDeliveries returns the delivery log of a webhook, newest
+// first, optionally filtered by ?status= and paged with ?before= and ?limit=.
+func (s *APIServer) handleListWebhookDeliveries(w http.ResponseWriter, r *http.Request) error {
+
+	webhookId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return WriteProblem(w, invalidID("webhook"))
+	}
+	if _, err := s.authorizeWebhook(r, webhookId); err != nil {
+		return writeError(w, err)
+	}
+
+	query := r.URL.Query()
+	params := ListWebhookDeliveriesParams{WebhookID: webhookId, Limit: defaultPageSize}
+	switch status := query.Get("status"); status {
+	case "", DeliveryPending, DeliverySucceeded, DeliveryFailed:
+		params.Status = status
+	default:
+		return WriteProblem(w, parameterProblem(fieldError("status", FieldInvalid, "must be pending, succeeded or failed")))
+	}
+	if v := query.Get("limit"); v != "" {
+		params.Limit, err = strconv.Atoi(v)
+		if err != nil || params.Limit < 1 || params.Limit > maxPageSize {
+			return WriteProblem(w, parameterProblem(fieldError("limit", FieldOutOfRange, "must be between 1 and %d", maxPageSize)))
+		}
+	}
+	if v := query.Get("before"); v != "" {
+		params.Before, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || params.Before < 1 {
+			return WriteProblem(w, parameterProblem(fieldError("before", FieldInvalid, "must be a delivery id")))
+		}
+	}
+
+	deliveries, err := s.store.ListWebhookDeliveries(params)
+	if err != nil {
+		return writeError(w, err)
+	}
+
+	return WriteJSON(w, http.StatusOK, deliveries)
+}
+
+// validateWebhook checks the url and events of a webhook payload when given.
+func validateWebhook(rawurl *string, events *[]string) error {
+	if rawurl != nil {
+		u, err := url.Parse(*rawurl)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(*rawurl) > 2048 {
+			return fieldError("url", FieldInvalid, "must be an absolute http or https URL")
+		}
+	}
+	if events != nil {
+		if len(*events) == 0 {
+			return fieldError("events", FieldRequired, "must not be empty")
+		}
+		seen := make(map[string]bool, len(*events))
+		for i, event := range *events {
+			known := false
+			for _, e := range webhookEvents {
+				known = known || e == event
+			}
+			if !known {
+				return fieldError(fmt.Sprintf("events[%d]", i), FieldInvalid, "unknown event %q", event)
+			}
+			if seen[event] {
+				return fieldError(fmt.Sprintf("events[%d]", i), FieldDuplicate, "duplicate event %q", event)
+			}
+			seen[event] = true
+		}
+	}
+	return nil
+}
+
+func newWebhookSecret() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return "whsec_" + hex.EncodeToString(b)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func createTestWebhook(t *testing.T, body string) Webhook {
+	writer := makeRequest("POST", "/webhook", []byte(body))
+	assert.Equal(t, http.StatusCreated, writer.Code)
+	var webhook Webhook
+	assert.NoError(t, json.Unmarshal(writer.Body.Bytes(), &webhook))
+	return webhook
+}
+
+func Test_API_Webhooks(t *testing.T) {
+	webhook := createTestWebhook(t, `{"url":"https://hooks.example.com/images","user_id":19}`)
+	webhookId := strconv.Itoa(int(webhook.ID))
+	assert.NotEmpty(t, webhook.Secret)
+	assert.Equal(t, webhookEvents, webhook.Events)
+	assert.True(t, webhook.Active)
+
+	// the secret is only shown on create
+	writer := makeRequest("GET", "/webhook/"+webhookId, nil)
+	assert.Equal(t, http.StatusOK, writer.Code)
+	assert.NotContains(t, writer.Body.String(), webhook.Secret)
+
+	writer = makeRequest("GET", "/webhook?user_id=19", nil)
+	assert.Equal(t, http.StatusOK, writer.Code)
+	assert.Contains(t, writer.Body.String(), `"url":"https://hooks.example.com/images"`)
+
+	writer = makeRequest("PATCH", "/webhook/"+webhookId, []byte(`{"events":["product.processing_failed"],"active":false}`))
+	assert.Equal(t, http.StatusOK, writer.Code)
+	var updated Webhook
+	assert.NoError(t, json.Unmarshal(writer.Body.Bytes(), &updated))
+	assert.Equal(t, []string{WebhookProcessingFailed}, updated.Events)
+	assert.False(t, updated.Active)
+
+	writer = makeRequest("GET", "/webhook/"+webhookId+"/deliveries", nil)
+	assert.Equal(t, http.StatusOK, writer.Code)
+	assert.Equal(t, "[]\n", writer.Body.String())
+
+	writer = makeRequest("DELETE", "/webhook/"+webhookId, nil)
+	assert.Equal(t, http.StatusNoContent, writer.Code)
+	writer = makeRequest("GET", "/webhook/"+webhookId, nil)
+	assert.Equal(t, http.StatusNotFound, writer.Code)
+
+	for _, body := range []string{
+		`{"url":"ftp://hooks.example.com"}`,
+		`{"url":"/relative"}`,
+		`{"url":"https://hooks.example.com","events":["product.created"]}`,
+		`{"url":"https://hooks.example.com","events":[]}`,
+		`{"url":"https://hooks.example.com","secret":"short"}`,
+		`{"url":"https://hooks.example.com","user_id":1000000}`,
+	} {
+		writer = makeRequest("POST", "/webhook", []byte(body))
+		assert.Equal(t, http.StatusUnprocessableEntity, writer.Code, body)
+	}
+
+	writer = makeRequest("GET", "/webhook/1000000/deliveries", nil)
+	assert.Equal(t, http.StatusNotFound, writer.Code)
+}
+
+func Test_API_WebhookOwners(t *testing.T) {
+	as := func(who string) map[string]string {
+		return map[string]string{"Authorization": "Bearer " + testToken(who)}
+	}
+
+	// users subscribe to their own products by default
+	writer := makeRequestWithHeaders("POST", "/webhook", []byte(`{"url":"https://hooks.example.com/own"}`), as("19"))
+	assert.Equal(t, http.StatusCreated, writer.Code)
+	var webhook Webhook
+	assert.NoError(t, json.Unmarshal(writer.Body.Bytes(), &webhook))
+	if assert.NotNil(t, webhook.UserID) {
+		assert.Equal(t, int64(19), *webhook.UserID)
+	}
+	webhookId := strconv.Itoa(int(webhook.ID))
+
+	writer = makeRequestWithHeaders("GET", "/webhook", nil, as("19"))
+	assert.Equal(t, http.StatusOK, writer.Code)
+	assert.Contains(t, writer.Body.String(), `"url":"https://hooks.example.com/own"`)
+	writer = makeRequestWithHeaders("GET", "/webhook/"+webhookId, nil, as("19"))
+	assert.Equal(t, http.StatusOK, writer.Code)
+
+	// other users see and change neither the webhook nor its deliveries
+	for _, req := range []struct{ method, url, body string }{
+		{"GET", "/webhook/" + webhookId, ""},
+		{"PATCH", "/webhook/" + webhookId, `{"active":false}`},
+		{"DELETE", "/webhook/" + webhookId, ""},
+		{"GET", "/webhook/" + webhookId + "/deliveries", ""},
+		{"GET", "/webhook?user_id=19", ""},
+		{"POST", "/webhook", `{"url":"https://hooks.example.com/other","user_id":19}`},
+	} {
+		writer = makeRequestWithHeaders(req.method, req.url, []byte(req.body), as("20"))
+		assert.Equal(t, http.StatusForbidden, writer.Code, req.method+" "+req.url)
+	}
+
+	// only admins manage the webhooks of every product
+	global := createTestWebhook(t, `{"url":"https://hooks.example.com/global"}`)
+	writer = makeRequestWithHeaders("GET", "/webhook/"+strconv.Itoa(int(global.ID)), nil, as("19"))
+	assert.Equal(t, http.StatusForbidden, writer.Code)
+	writer = makeRequestWithHeaders("GET", "/webhook", nil, as(RoleService))
+	assert.Equal(t, http.StatusForbidden, writer.Code)
+	writer = makeRequestWithHeaders("POST", "/webhook", []byte(`{"url":"https://hooks.example.com/all"}`), as(RoleService))
+	assert.Equal(t, http.StatusForbidden, writer.Code)
+	writer = makeRequest("DELETE", "/webhook/"+strconv.Itoa(int(global.ID)), nil)
+	assert.Equal(t, http.StatusNoContent, writer.Code)
+
+	writer = makeRequest("GET", "/webhook/"+webhookId, nil)
+	assert.Equal(t, http.StatusOK, writer.Code)
+	writer = makeRequestWithHeaders("DELETE", "/webhook/"+webhookId, nil, as("19"))
+	assert.Equal(t, http.StatusNoContent, writer.Code)
+}
+
+func Test_API_WebhookDelivery(t *testing.T) {
+	received := make(chan *http.Request, 4)
+	bodies := make(chan []byte, 4)
+	fail := true
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		// the first delivery fails and is retried
+		if fail {
+			fail = false
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		received <- r
+		bodies <- body
+	}))
+	defer receiver.Close()
+
+	product := createRandomProduct(t)
+	productId := strconv.Itoa(int(product.ID))
+	webhook := createTestWebhook(t, `{"url":"`+receiver.URL+`","user_id":`+strconv.Itoa(int(product.UserID))+`,"secret":"0123456789abcdef"}`)
+	// a webhook of another user is not called
+	createTestWebhook(t, `{"url":"`+receiver.URL+`/other","user_id":`+strconv.Itoa(int(product.UserID)%100+1)+`}`)
+
+	writer := makeRequest("PUT", "/product/"+productId+"/compressed-images", []byte(`{"images":["./home/path1","./home/path2"]}`))
+	assert.Equal(t, http.StatusOK, writer.Code)
+
+	dispatcher := NewWebhookDispatcher(testPostgresStore)
+	n, err := dispatcher.dispatch(context.Background())
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, n, 1)
+
+	deliveries, err := testPostgresStore.ListWebhookDeliveries(ListWebhookDeliveriesParams{WebhookID: int(webhook.ID), Limit: 10})
+	assert.NoError(t, err)
+	assert.Len(t, deliveries, 1)
+	assert.Equal(t, DeliveryPending, deliveries[0].Status)
+	assert.Equal(t, 1, deliveries[0].Attempts)
+	assert.Equal(t, http.StatusServiceUnavailable, deliveries[0].LastStatusCode)
+	assert.NotNil(t, deliveries[0].NextAttemptAt)
+
+	// make the retry due
+	_, err = testPostgresStore.db.Exec(`UPDATE webhook_deliveries SET next_attempt_at = NOW() WHERE id = $1`, deliveries[0].ID)
+	assert.NoError(t, err)
+	_, err = dispatcher.dispatch(context.Background())
+	assert.NoError(t, err)
+
+	select {
+	case r := <-received:
+		body := <-bodies
+		assert.Equal(t, WebhookImagesReady, r.Header.Get("X-Webhook-Event"))
+		assert.Equal(t, strconv.Itoa(int(deliveries[0].ID)), r.Header.Get("X-Webhook-Delivery"))
+		signature := r.Header.Get(webhookSignatureKey)
+		ts, _ := strconv.ParseInt(signature[2:12], 10, 64)
+		assert.Equal(t, signWebhook("0123456789abcdef", time.Unix(ts, 0), body), signature)
+
+		var payload WebhookPayload
+		assert.NoError(t, json.Unmarshal(body, &payload))
+		assert.Equal(t, WebhookImagesReady, payload.Event)
+		assert.Equal(t, product.ID, payload.ProductID)
+		assert.Contains(t, string(body), `"compressed_images":["./home/path1","./home/path2"]`)
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not delivered")
+	}
+
+	writer = makeRequest("GET", "/webhook/"+strconv.Itoa(int(webhook.ID))+"/deliveries?status=succeeded", nil)
+	assert.Equal(t, http.StatusOK, writer.Code)
+	var log []WebhookDelivery
+	assert.NoError(t, json.Unmarshal(writer.Body.Bytes(), &log))
+	assert.Len(t, log, 1)
+	assert.Equal(t, 2, log[0].Attempts)
+	assert.NotNil(t, log[0].DeliveredAt)
+	assert.Nil(t, log[0].NextAttemptAt)
+}
+
+func Test_Webhook_RetryDelay(t *testing.T) {
+	assert.Equal(t, webhookBaseDelay, webhookRetryDelay(1))
+	assert.Equal(t, 2*webhookBaseDelay, webhookRetryDelay(2))
+	assert.Equal(t, 8*webhookBaseDelay, webhookRetryDelay(4))
+	assert.Equal(t, webhookMaxDelay, webhookRetryDelay(50))
+}
+
+func Test_Webhook_Sign(t *testing.T) {
+	at := time.Unix(1700000000, 0)
+	signature := signWebhook("secret", at, []byte(`{"event":"product.images_ready"}`))
+	assert.Equal(t, "t=1700000000,v1=", signature[:16])
+	assert.Len(t, signature, 16+64)
+	assert.Equal(t, signature, signWebhook("secret", at, []byte(`{"event":"product.images_ready"}`)))
+	assert.NotEqual(t, signature, signWebhook("other", at, []byte(`{"event":"product.images_ready"}`)))
+	assert.NotEqual(t, signature, signWebhook("secret", at.Add(time.Second), []byte(`{"event":"product.images_ready"}`)))
+}
+
+func Test_Webhook_Validate(t *testing.T) {
+	good := "https://hooks.example.com/x"
+	assert.NoError(t, validateWebhook(&good, &[]string{WebhookImagesReady}))
+	assert.Error(t, validateWebhook(nil, &[]string{WebhookImagesReady, WebhookImagesReady}))
+	bad := "mailto:someone@example.com"
+	assert.Error(t, validateWebhook(&bad, nil))
+}
@@ -0,0 +1,273 @@
+// Package auth verifies and issues the JSON Web Tokens that authenticate
+// clients of the API. Tokens are checked against a key set read from a local
+// JWKS file (RFC 7517), so that no identity provider has to be reachable.
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+)
+
+// algorithms are the signature algorithms accepted, with the key type and
+// hash each one needs.
+var algorithms = map[string]struct {
+	kty  string
+	hash crypto.Hash
+}{
+	"HS256": {"oct", crypto.SHA256},
+	"HS384": {"oct", crypto.SHA384},
+	"HS512": {"oct", crypto.SHA512},
+	"RS256": {"RSA", crypto.SHA256},
+	"RS384": {"RSA", crypto.SHA384},
+	"RS512": {"RSA", crypto.SHA512},
+	"ES256": {"EC", crypto.SHA256},
+	"ES384": {"EC", crypto.SHA384},
+	"ES512": {"EC", crypto.SHA512},
+}
+
+// curveAlgorithms are the ECDSA algorithms of each curve.
+var curveAlgorithms = map[string]string{
+	"P-256": "ES256",
+	"P-384": "ES384",
+	"P-521": "ES512",
+}
+
+// Key is a key of a KeySet. Secret is set for symmetric keys; Public for
+// asymmetric ones and Private too if the JWK holds the private key.
+type Key struct {
+	ID      string
+	Type    string
+	Alg     string
+	Secret  []byte
+	Public  crypto.PublicKey
+	Private crypto.Signer
+}
+
+// accepts reports whether the key may verify a signature made with alg.
+func (k *Key) accepts(alg string) bool {
+	a, ok := algorithms[alg]
+	if !ok || a.kty != k.Type || k.Alg != "" && k.Alg != alg {
+		return false
+	}
+	if ec, ok := k.Public.(*ecdsa.PublicKey); ok {
+		return curveAlgorithms[ec.Curve.Params().Name] == alg
+	}
+	return true
+}
+
+// signingAlg is the algorithm Sign uses with the key.
+func (k *Key) signingAlg() string {
+	if k.Alg != "" {
+		return k.Alg
+	}
+	switch k.Type {
+	case "oct":
+		return "HS256"
+	case "RSA":
+		return "RS256"
+	}
+	return curveAlgorithms[k.Public.(*ecdsa.PublicKey).Curve.Params().Name]
+}
+
+// KeySet holds the keys tokens are verified with.
+type KeySet struct {
+	Keys []*Key
+}
+
+// jwk is a JSON Web Key. Only the members of the supported key types are
+// read; the private members are optional.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	K   string `json:"k"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	D   string `json:"d"`
+	P   string `json:"p"`
+	Q   string `json:"q"`
+}
+
+// LoadKeySet reads a JWKS file.
+func LoadKeySet(path string) (*KeySet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ks, err := ParseKeySet(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return ks, nil
+}
+
+// ParseKeySet parses a JWKS document, {"keys":[...]}. Keys meant for
+// encryption ("use":"enc") are skipped.
+func ParseKeySet(data []byte) (*KeySet, error) {
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %w", err)
+	}
+	ks := &KeySet{}
+	for i, j := range doc.Keys {
+		if j.Use == "enc" {
+			continue
+		}
+		key, err := parseKey(j)
+		if err != nil {
+			return nil, fmt.Errorf("key %d (%q): %w", i, j.Kid, err)
+		}
+		ks.Keys = append(ks.Keys, key)
+	}
+	if len(ks.Keys) == 0 {
+		return nil, errors.New("no signing keys in JWKS")
+	}
+	return ks, nil
+}
+
+func parseKey(j jwk) (*Key, error) {
+	key := &Key{ID: j.Kid, Type: j.Kty, Alg: j.Alg}
+	if j.Alg != "" {
+		if a, ok := algorithms[j.Alg]; !ok || a.kty != j.Kty {
+			return nil, fmt.Errorf("unsupported alg %q for a %s key", j.Alg, j.Kty)
+		}
+	}
+
+	switch j.Kty {
+	case "oct":
+		secret, err := decodeSegment(j.K)
+		if err != nil || len(secret) < 32 {
+			return nil, errors.New("k must be at least 32 bytes of base64url")
+		}
+		key.Secret = secret
+
+	case "RSA":
+		n, err := decodeInt(j.N)
+		if err != nil {
+			return nil, fmt.Errorf("n: %w", err)
+		}
+		e, err := decodeInt(j.E)
+		if err != nil || !e.IsInt64() {
+			return nil, errors.New("e: invalid exponent")
+		}
+		if n.BitLen() < 2048 {
+			return nil, errors.New("RSA keys must have at least 2048 bits")
+		}
+		public := &rsa.PublicKey{N: n, E: int(e.Int64())}
+		key.Public = public
+		if j.D != "" {
+			private, err := rsaPrivateKey(public, j)
+			if err != nil {
+				return nil, err
+			}
+			key.Private = private
+		}
+
+	case "EC":
+		var curve elliptic.Curve
+		switch j.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", j.Crv)
+		}
+		if j.Alg != "" && curveAlgorithms[j.Crv] != j.Alg {
+			return nil, fmt.Errorf("alg %s does not match curve %s", j.Alg, j.Crv)
+		}
+		x, errX := decodeInt(j.X)
+		y, errY := decodeInt(j.Y)
+		if errX != nil || errY != nil || !curve.IsOnCurve(x, y) {
+			return nil, errors.New("invalid EC point")
+		}
+		public := &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		key.Public = public
+		if j.D != "" {
+			d, err := decodeInt(j.D)
+			if err != nil {
+				return nil, fmt.Errorf("d: %w", err)
+			}
+			key.Private = &ecdsa.PrivateKey{PublicKey: *public, D: d}
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", j.Kty)
+	}
+	return key, nil
+}
+
+func rsaPrivateKey(public *rsa.PublicKey, j jwk) (*rsa.PrivateKey, error) {
+	d, errD := decodeInt(j.D)
+	p, errP := decodeInt(j.P)
+	q, errQ := decodeInt(j.Q)
+	if errD != nil || errP != nil || errQ != nil {
+		return nil, errors.New("RSA private keys need d, p and q")
+	}
+	private := &rsa.PrivateKey{PublicKey: *public, D: d, Primes: []*big.Int{p, q}}
+	if err := private.Validate(); err != nil {
+		return nil, err
+	}
+	private.Precompute()
+	return private, nil
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	b, err := decodeSegment(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("missing value")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func decodeSegment(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+// lookup returns the key a token signed with alg under kid is verified
+// with. A token without a kid is verified with the only key accepting alg.
+func (ks *KeySet) lookup(kid, alg string) (*Key, error) {
+	var found *Key
+	for _, key := range ks.Keys {
+		if !key.accepts(alg) || kid != "" && key.ID != kid {
+			continue
+		}
+		if found != nil {
+			return nil, errors.New("token does not name one of several keys")
+		}
+		found = key
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no %s key %q", alg, kid)
+	}
+	return found, nil
+}
+
+// signingKey is the first key that can sign tokens.
+func (ks *KeySet) signingKey() (*Key, error) {
+	for _, key := range ks.Keys {
+		if key.Secret != nil || key.Private != nil {
+			return key, nil
+		}
+	}
+	return nil, errors.New("no private or symmetric key to sign with")
+}
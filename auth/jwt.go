@@ -0,0 +1,245 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// ErrInvalidToken wraps every reason a token is rejected.
+var ErrInvalidToken = errors.New("invalid token")
+
+// Claims are the registered claims of a token (RFC 7519) and the role of its
+// subject.
+type Claims struct {
+	Subject   string      `json:"sub"`
+	Role      string      `json:"role,omitempty"`
+	Issuer    string      `json:"iss,omitempty"`
+	Audience  Audience    `json:"aud,omitempty"`
+	ExpiresAt NumericDate `json:"exp,omitempty"`
+	NotBefore NumericDate `json:"nbf,omitempty"`
+	IssuedAt  NumericDate `json:"iat,omitempty"`
+}
+
+// Audience is the aud claim, a string or an array of strings.
+type Audience []string
+
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*a = Audience{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return errors.New("aud must be a string or an array of strings")
+	}
+	*a = many
+	return nil
+}
+
+func (a Audience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]string(a))
+}
+
+// NumericDate is a time in seconds since the epoch. It may be fractional in
+// tokens but is kept to the second.
+type NumericDate int64
+
+func NewNumericDate(t time.Time) NumericDate {
+	return NumericDate(t.Unix())
+}
+
+func (d *NumericDate) UnmarshalJSON(data []byte) error {
+	var f float64
+	if err := json.Unmarshal(data, &f); err != nil {
+		return errors.New("dates must be numbers")
+	}
+	*d = NumericDate(f)
+	return nil
+}
+
+func (d NumericDate) Time() time.Time {
+	return time.Unix(int64(d), 0)
+}
+
+// Verifier checks tokens: their signature against Keys, their expiry and,
+// when set, their issuer and audience. Tokens without an expiry are rejected.
+type Verifier struct {
+	Keys     *KeySet
+	Issuer   string
+	Audience string
+	// Leeway is the clock skew tolerated on exp and nbf.
+	Leeway time.Duration
+
+	now func() time.Time
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid,omitempty"`
+	Typ string `json:"typ,omitempty"`
+}
+
+// Verify returns the claims of a valid token in compact serialization.
+func (v *Verifier) Verify(token string) (*Claims, error) {
+	claims, err := v.verify(token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidToken, err)
+	}
+	return claims, nil
+}
+
+func (v *Verifier) verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var h header
+	if err := decodeJSONSegment(parts[0], &h); err != nil {
+		return nil, fmt.Errorf("header: %w", err)
+	}
+	alg, ok := algorithms[h.Alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported alg %q", h.Alg)
+	}
+	key, err := v.Keys.lookup(h.Kid, h.Alg)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := decodeSegment(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+	if !verifySignature(key, alg.hash, []byte(parts[0]+"."+parts[1]), signature) {
+		return nil, errors.New("bad signature")
+	}
+
+	var claims Claims
+	if err := decodeJSONSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("claims: %w", err)
+	}
+	now := time.Now
+	if v.now != nil {
+		now = v.now
+	}
+	t := now()
+	switch {
+	case claims.ExpiresAt == 0:
+		return nil, errors.New("token does not expire")
+	case t.After(claims.ExpiresAt.Time().Add(v.Leeway)):
+		return nil, errors.New("token expired")
+	case claims.NotBefore != 0 && t.Before(claims.NotBefore.Time().Add(-v.Leeway)):
+		return nil, errors.New("token not valid yet")
+	case v.Issuer != "" && claims.Issuer != v.Issuer:
+		return nil, fmt.Errorf("issuer %q not trusted", claims.Issuer)
+	case v.Audience != "" && !contains(claims.Audience, v.Audience):
+		return nil, errors.New("token not meant for this audience")
+	case claims.Subject == "":
+		return nil, errors.New("token has no subject")
+	}
+	return &claims, nil
+}
+
+func verifySignature(key *Key, hash crypto.Hash, signed, signature []byte) bool {
+	switch key.Type {
+	case "oct":
+		mac := hmac.New(hash.New, key.Secret)
+		mac.Write(signed)
+		return hmac.Equal(signature, mac.Sum(nil))
+	case "RSA":
+		return rsa.VerifyPKCS1v15(key.Public.(*rsa.PublicKey), hash, digest(hash, signed), signature) == nil
+	case "EC":
+		public := key.Public.(*ecdsa.PublicKey)
+		size := (public.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(public, digest(hash, signed), r, s)
+	}
+	return false
+}
+
+// Sign issues a token with claims, signed with the first key of the set
+// that holds a secret or private key.
+func (ks *KeySet) Sign(claims Claims) (string, error) {
+	key, err := ks.signingKey()
+	if err != nil {
+		return "", err
+	}
+	alg := key.signingAlg()
+	h, err := json.Marshal(header{Alg: alg, Kid: key.ID, Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := encodeSegment(h) + "." + encodeSegment(c)
+
+	hash := algorithms[alg].hash
+	var signature []byte
+	switch private := key.Private.(type) {
+	case nil:
+		mac := hmac.New(hash.New, key.Secret)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, private, hash, digest(hash, []byte(signed)))
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, private, digest(hash, []byte(signed)))
+		if err == nil {
+			size := (private.Curve.Params().BitSize + 7) / 8
+			signature = make([]byte, 2*size)
+			r.FillBytes(signature[:size])
+			s.FillBytes(signature[size:])
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + encodeSegment(signature), nil
+}
+
+func digest(hash crypto.Hash, data []byte) []byte {
+	h := hash.New()
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func decodeJSONSegment(s string, v any) error {
+	data, err := decodeSegment(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func encodeSegment(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
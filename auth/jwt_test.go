@@ -0,0 +1,159 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testSecretJWKS = `{"keys":[{"kty":"oct","kid":"dev","alg":"HS256","k":"c2VjcmV0LXNlY3JldC1zZWNyZXQtc2VjcmV0LXNlY3JldA"}]}`
+
+func encodeInt(i *big.Int) string {
+	return encodeSegment(i.Bytes())
+}
+
+func rsaJWKS(t *testing.T, kid string) []byte {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	data, _ := json.Marshal(map[string]any{"keys": []map[string]string{{
+		"kty": "RSA", "kid": kid,
+		"n": encodeInt(key.N), "e": encodeInt(big.NewInt(int64(key.E))),
+		"d": encodeInt(key.D), "p": encodeInt(key.Primes[0]), "q": encodeInt(key.Primes[1]),
+	}}})
+	return data
+}
+
+func ecJWKS(t *testing.T, kid string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	data, _ := json.Marshal(map[string]any{"keys": []map[string]string{{
+		"kty": "EC", "kid": kid, "crv": "P-256",
+		"x": encodeSegment(key.X.FillBytes(make([]byte, 32))),
+		"y": encodeSegment(key.Y.FillBytes(make([]byte, 32))),
+		"d": encodeSegment(key.D.FillBytes(make([]byte, 32))),
+	}}})
+	return data
+}
+
+func validClaims() Claims {
+	return Claims{
+		Subject:   "17",
+		Role:      "user",
+		Audience:  Audience{"products"},
+		ExpiresAt: NewNumericDate(time.Now().Add(time.Hour)),
+	}
+}
+
+func Test_Auth_SignVerify(t *testing.T) {
+	for name, jwks := range map[string][]byte{
+		"HS256": []byte(testSecretJWKS),
+		"RS256": rsaJWKS(t, "rsa"),
+		"ES256": ecJWKS(t, "ec"),
+	} {
+		ks, err := ParseKeySet(jwks)
+		assert.NoError(t, err, name)
+		token, err := ks.Sign(validClaims())
+		assert.NoError(t, err, name)
+
+		v := &Verifier{Keys: ks, Audience: "products"}
+		claims, err := v.Verify(token)
+		assert.NoError(t, err, name)
+		assert.Equal(t, "17", claims.Subject)
+		assert.Equal(t, "user", claims.Role)
+
+		// a flipped signature bit fails
+		tampered := []byte(token)
+		tampered[len(tampered)-2] ^= 1
+		_, err = v.Verify(string(tampered))
+		assert.ErrorIs(t, err, ErrInvalidToken, name)
+	}
+}
+
+func Test_Auth_VerifyRejects(t *testing.T) {
+	ks, err := ParseKeySet([]byte(testSecretJWKS))
+	assert.NoError(t, err)
+	v := &Verifier{Keys: ks, Issuer: "https://issuer", Audience: "products", Leeway: time.Minute}
+	sign := func(edit func(*Claims)) string {
+		c := validClaims()
+		c.Issuer = "https://issuer"
+		edit(&c)
+		token, err := ks.Sign(c)
+		assert.NoError(t, err)
+		return token
+	}
+
+	good := sign(func(c *Claims) {})
+	_, err = v.Verify(good)
+	assert.NoError(t, err)
+
+	for reason, token := range map[string]string{
+		"expired":      sign(func(c *Claims) { c.ExpiresAt = NewNumericDate(time.Now().Add(-2 * time.Minute)) }),
+		"no expiry":    sign(func(c *Claims) { c.ExpiresAt = 0 }),
+		"not yet":      sign(func(c *Claims) { c.NotBefore = NewNumericDate(time.Now().Add(time.Hour)) }),
+		"issuer":       sign(func(c *Claims) { c.Issuer = "https://other" }),
+		"audience":     sign(func(c *Claims) { c.Audience = Audience{"other"} }),
+		"subject":      sign(func(c *Claims) { c.Subject = "" }),
+		"alg none":     encodeSegment([]byte(`{"alg":"none"}`)) + "." + strings.Split(good, ".")[1] + ".",
+		"unknown kid":  encodeSegment([]byte(`{"alg":"HS256","kid":"other"}`)) + "." + strings.Split(good, ".")[1] + "." + strings.Split(good, ".")[2],
+		"wrong alg":    encodeSegment([]byte(`{"alg":"RS256","kid":"dev"}`)) + "." + strings.Split(good, ".")[1] + "." + strings.Split(good, ".")[2],
+		"garbage":      "a.b",
+		"other secret": signWith(t, `{"keys":[{"kty":"oct","kid":"dev","k":"b3RoZXItb3RoZXItb3RoZXItb3RoZXItb3RoZXItb3RoZXI"}]}`),
+	} {
+		_, err := v.Verify(token)
+		assert.True(t, errors.Is(err, ErrInvalidToken), reason)
+	}
+
+	// within the leeway
+	v.now = func() time.Time { return time.Now().Add(time.Hour + 30*time.Second) }
+	_, err = v.Verify(good)
+	assert.NoError(t, err)
+}
+
+func signWith(t *testing.T, jwks string) string {
+	ks, err := ParseKeySet([]byte(jwks))
+	assert.NoError(t, err)
+	c := validClaims()
+	c.Issuer = "https://issuer"
+	token, err := ks.Sign(c)
+	assert.NoError(t, err)
+	return token
+}
+
+func Test_Auth_ParseKeySet(t *testing.T) {
+	for _, bad := range []string{
+		`{"keys":[]}`,
+		`{"keys":[{"kty":"oct","k":"c2hvcnQ"}]}`,
+		`{"keys":[{"kty":"oct","alg":"RS256","k":"c2VjcmV0LXNlY3JldC1zZWNyZXQtc2VjcmV0LXNlY3JldA"}]}`,
+		`{"keys":[{"kty":"RSA","n":"AQAB","e":"AQAB"}]}`,
+		`{"keys":[{"kty":"EC","crv":"P-256","x":"AQ","y":"AQ"}]}`,
+		`{"keys":[{"kty":"OKP","crv":"Ed25519","x":"AQ"}]}`,
+		`not json`,
+	} {
+		_, err := ParseKeySet([]byte(bad))
+		assert.Error(t, err, bad)
+	}
+
+	// encryption keys are ignored
+	ks, err := ParseKeySet([]byte(`{"keys":[{"kty":"OKP","use":"enc"},` + strings.TrimPrefix(testSecretJWKS, `{"keys":[`)))
+	assert.NoError(t, err)
+	assert.Len(t, ks.Keys, 1)
+}
+
+func Test_Auth_Audience(t *testing.T) {
+	var c Claims
+	assert.NoError(t, json.Unmarshal([]byte(`{"aud":"a","exp":1.7e9}`), &c))
+	assert.Equal(t, Audience{"a"}, c.Audience)
+	assert.Equal(t, NumericDate(1700000000), c.ExpiresAt)
+	assert.NoError(t, json.Unmarshal([]byte(`{"aud":["a","b"]}`), &c))
+	assert.Equal(t, Audience{"a", "b"}, c.Audience)
+	assert.Error(t, json.Unmarshal([]byte(`{"aud":1}`), &c))
+}
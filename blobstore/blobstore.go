@@ -0,0 +1,94 @@
+// Package blobstore stores processed and uploaded images. Objects are
+// addressed by fully qualified URLs so that the paths kept in the database
+// mean the same thing on every host.
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned by Get for objects that do not exist.
+var ErrNotFound = errors.New("blobstore: object not found")
+
+// Store is a place to keep image blobs.
+type Store interface {
+	// Put stores the content of r under key and returns the object URL.
+	Put(ctx context.Context, key string, r io.Reader, contentType string) (string, error)
+	// Get opens the object at rawurl, which must be owned by the store.
+	Get(ctx context.Context, rawurl string) (*Object, error)
+	// Owns reports whether rawurl refers to an object of this store.
+	Owns(rawurl string) bool
+	// Delete removes the object at rawurl, which must be owned by the store.
+	// Deleting a missing object is not an error.
+	Delete(ctx context.Context, rawurl string) error
+}
+
+// Object is an opened blob. The caller must close Body.
+type Object struct {
+	Body        io.ReadCloser
+	ContentType string
+	Size        int64
+	ModTime     time.Time
+	ETag        string
+}
+
+// Open returns the store described by location:
+//
+//	./images or file:///var/lib/images       local directory
+//	s3://bucket/prefix?endpoint=http://localhost:9000&region=us-east-1
+//
+// S3 credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.
+func Open(location string) (Store, error) {
+	if !strings.Contains(location, "://") {
+		return NewLocalStore(location)
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "file":
+		return NewLocalStore(u.Path)
+	case "s3":
+		query := u.Query()
+		return NewS3Store(S3Config{
+			Endpoint:  query.Get("endpoint"),
+			Region:    query.Get("region"),
+			Bucket:    u.Host,
+			Prefix:    strings.TrimPrefix(u.Path, "/"),
+			AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		})
+	}
+	return nil, fmt.Errorf("blobstore: unsupported store %q", location)
+}
+
+// ContentTypeOf guesses the content type of an object from its key.
+func ContentTypeOf(key string) string {
+	switch strings.ToLower(key[strings.LastIndex(key, ".")+1:]) {
+	case "png":
+		return "image/png"
+	case "jpg", "jpeg":
+		return "image/jpeg"
+	case "gif":
+		return "image/gif"
+	case "webp":
+		return "image/webp"
+	}
+	return "application/octet-stream"
+}
+
+// validKey rejects keys that could escape the store.
+func validKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "..") || strings.Contains(key, "\\") {
+		return fmt.Errorf("blobstore: invalid key %q", key)
+	}
+	return nil
+}
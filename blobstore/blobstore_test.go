@@ -0,0 +1,37 @@
+package blobstore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Blobstore_Open(t *testing.T) {
+	store, err := Open(t.TempDir())
+	assert.NoError(t, err)
+	assert.IsType(t, &LocalStore{}, store)
+
+	store, err = Open("file://" + t.TempDir())
+	assert.NoError(t, err)
+	assert.IsType(t, &LocalStore{}, store)
+
+	store, err = Open("s3://images/products?endpoint=http://localhost:9000")
+	assert.NoError(t, err)
+	assert.IsType(t, &S3Store{}, store)
+	assert.True(t, store.Owns("http://localhost:9000/images/products/a.png"))
+	assert.False(t, store.Owns("http://localhost:9000/other/products/a.png"))
+
+	_, err = Open("s3://images")
+	assert.Error(t, err)
+
+	_, err = Open("ftp://host/images")
+	assert.Error(t, err)
+}
+
+func Test_Blobstore_ContentTypeOf(t *testing.T) {
+	assert.Equal(t, "image/png", ContentTypeOf("a/b.png"))
+	assert.Equal(t, "image/jpeg", ContentTypeOf("b.JPG"))
+	assert.Equal(t, "image/gif", ContentTypeOf("b.gif"))
+	assert.Equal(t, "image/webp", ContentTypeOf("b.webp"))
+	assert.Equal(t, "application/octet-stream", ContentTypeOf("b"))
+}
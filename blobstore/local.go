@@ -0,0 +1,112 @@
+package blobstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LocalStore keeps objects as files below a directory. Its URLs are file://
+// URLs, which are only meaningful to hosts that share the directory.
+type LocalStore struct {
+	dir string
+}
+
+func NewLocalStore(dir string) (*LocalStore, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(abs, 0755); err != nil {
+		return nil, err
+	}
+	return &LocalStore{dir: abs}, nil
+}
+
+func (s *LocalStore) Put(ctx context.Context, key string, r io.Reader, contentType string) (string, error) {
+	if err := validKey(key); err != nil {
+		return "", err
+	}
+	path := filepath.Join(s.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+
+	// write to a temporary file first so readers never see a partial image
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", err
+	}
+
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String(), nil
+}
+
+func (s *LocalStore) Get(ctx context.Context, rawurl string) (*Object, error) {
+	path, err := s.path(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &Object{
+		Body:        file,
+		ContentType: ContentTypeOf(path),
+		Size:        info.Size(),
+		ModTime:     info.ModTime(),
+		ETag:        fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()),
+	}, nil
+}
+
+func (s *LocalStore) Delete(ctx context.Context, rawurl string) error {
+	path, err := s.path(rawurl)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *LocalStore) Owns(rawurl string) bool {
+	_, err := s.path(rawurl)
+	return err == nil
+}
+
+// path returns the file behind rawurl if it lies below the store directory.
+func (s *LocalStore) path(rawurl string) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Scheme != "file" {
+		return "", fmt.Errorf("blobstore: %q is not a file URL", rawurl)
+	}
+	path := filepath.Clean(filepath.FromSlash(u.Path))
+	if !strings.HasPrefix(path, s.dir+string(filepath.Separator)) {
+		return "", fmt.Errorf("blobstore: %q is outside of %s", rawurl, s.dir)
+	}
+	return path, nil
+}
@@ -0,0 +1,55 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_LocalStore_PutGet(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewLocalStore(t.TempDir())
+	assert.NoError(t, err)
+
+	url, err := store.Put(ctx, "products/1/img.png", strings.NewReader("png data"), "image/png")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(url, "file:///"))
+	assert.True(t, store.Owns(url))
+
+	obj, err := store.Get(ctx, url)
+	assert.NoError(t, err)
+	defer obj.Body.Close()
+	data, err := io.ReadAll(obj.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "png data", string(data))
+	assert.Equal(t, "image/png", obj.ContentType)
+	assert.Equal(t, int64(8), obj.Size)
+	assert.NotEmpty(t, obj.ETag)
+
+	_, err = store.Get(ctx, url+".missing")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	assert.NoError(t, store.Delete(ctx, url))
+	_, err = store.Get(ctx, url)
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.NoError(t, store.Delete(ctx, url))
+}
+
+func Test_LocalStore_RejectsEscapes(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewLocalStore(t.TempDir())
+	assert.NoError(t, err)
+
+	_, err = store.Put(ctx, "../escape.png", strings.NewReader(""), "image/png")
+	assert.Error(t, err)
+	_, err = store.Put(ctx, "/etc/passwd", strings.NewReader(""), "image/png")
+	assert.Error(t, err)
+
+	assert.False(t, store.Owns("file:///etc/passwd"))
+	assert.False(t, store.Owns("http://example.com/img.png"))
+	_, err = store.Get(ctx, "file:///etc/passwd")
+	assert.Error(t, err)
+}
@@ -0,0 +1,277 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Config describes a bucket of an S3 compatible service such as MinIO.
+// Objects are addressed path style, as endpoint/bucket/key.
+type S3Config struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+}
+
+// S3Store keeps objects in an S3 bucket, signing requests with AWS
+// signature version 4.
+type S3Store struct {
+	config   S3Config
+	endpoint *url.URL
+	client   *http.Client
+	now      func() time.Time
+}
+
+func NewS3Store(config S3Config) (*S3Store, error) {
+	if config.Endpoint == "" || config.Bucket == "" {
+		return nil, fmt.Errorf("blobstore: s3 store needs an endpoint and a bucket")
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	if config.Prefix != "" && !strings.HasSuffix(config.Prefix, "/") {
+		config.Prefix += "/"
+	}
+	endpoint, err := url.Parse(strings.TrimSuffix(config.Endpoint, "/"))
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("blobstore: bad s3 endpoint %q", config.Endpoint)
+	}
+	return &S3Store{
+		config:   config,
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: time.Minute},
+		now:      time.Now,
+	}, nil
+}
+
+func (s *S3Store) Put(ctx context.Context, key string, r io.Reader, contentType string) (string, error) {
+	if err := validKey(key); err != nil {
+		return "", err
+	}
+	// the payload hash is part of the signature, so the body is buffered
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+
+	objectURL := s.objectURL(s.config.Prefix + key)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, objectURL, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Type", contentType)
+	s.sign(req, sha256Hex(body))
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", s3Error(res)
+	}
+	return objectURL, nil
+}
+
+func (s *S3Store) Get(ctx context.Context, rawurl string) (*Object, error) {
+	if !s.Owns(rawurl) {
+		return nil, fmt.Errorf("blobstore: %q is not in bucket %s", rawurl, s.config.Bucket)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawurl, nil)
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, sha256Hex(nil))
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, ErrNotFound
+	}
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		return nil, s3Error(res)
+	}
+
+	modTime, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+	size, _ := strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
+	contentType := res.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = ContentTypeOf(rawurl)
+	}
+	return &Object{
+		Body:        res.Body,
+		ContentType: contentType,
+		Size:        size,
+		ModTime:     modTime,
+		ETag:        res.Header.Get("ETag"),
+	}, nil
+}
+
+func (s *S3Store) Delete(ctx context.Context, rawurl string) error {
+	if !s.Owns(rawurl) {
+		return fmt.Errorf("blobstore: %q is not in bucket %s", rawurl, s.config.Bucket)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, rawurl, nil)
+	if err != nil {
+		return err
+	}
+	s.sign(req, sha256Hex(nil))
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	// S3 answers 204 whether or not the object existed
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNotFound {
+		return s3Error(res)
+	}
+	return nil
+}
+
+func (s *S3Store) Owns(rawurl string) bool {
+	prefix := s.objectURL(s.config.Prefix)
+	return strings.HasPrefix(rawurl, prefix) && !strings.Contains(rawurl[len(prefix):], "..")
+}
+
+func (s *S3Store) objectURL(key string) string {
+	u := *s.endpoint
+	u.Path = "/" + s.config.Bucket + "/" + key
+	return u.String()
+}
+
+// sign adds the AWS signature version 4 headers to req. Host, Range,
+// Content-Type and all x-amz-* headers are signed.
+func (s *S3Store) sign(req *http.Request, payloadHash string) {
+	now := s.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") || name == "range" || name == "content-type" {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI(req.URL),
+		canonicalQuery(req.URL),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.config.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.config.SecretKey), date)
+	key = hmacSHA256(key, s.config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.config.AccessKey, scope, signedHeaders, signature))
+}
+
+// canonicalURI encodes every path segment as S3 expects it.
+func canonicalURI(u *url.URL) string {
+	segments := strings.Split(u.Path, "/")
+	for i, segment := range segments {
+		segments[i] = uriEncode(segment)
+	}
+	path := strings.Join(segments, "/")
+	if path == "" {
+		return "/"
+	}
+	return path
+}
+
+func canonicalQuery(u *url.URL) string {
+	query := u.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		values := query[k]
+		sort.Strings(values)
+		for _, v := range values {
+			pairs = append(pairs, uriEncode(k)+"="+uriEncode(v))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode percent-encodes everything but the unreserved characters of
+// RFC 3986.
+func uriEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func s3Error(res *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+	return fmt.Errorf("blobstore: s3 %s %s: %s %s", res.Request.Method, res.Request.URL, res.Status, strings.TrimSpace(string(body)))
+}
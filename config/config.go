@@ -0,0 +1,317 @@
+// Package config loads the configuration of the API server, the producer
+// and the consumer. A configuration is a struct whose fields say where they
+// come from in tags:
+//
+//	Listen string `yaml:"listen" env:"API_LISTEN" flag:"listen" usage:"address to listen on"`
+//
+// Its values when loaded are the defaults, which are overridden in turn by
+// the YAML file of -config, the environment and the flags. Fields tagged
+// secret:"true" are redacted when the configuration is printed.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ErrPrintConfig is returned by Load when -print-config is given: cfg is
+// loaded but not validated, and is to be printed rather than used.
+var ErrPrintConfig = errors.New("config: print requested")
+
+// Validator is implemented by configurations that check themselves once
+// loaded.
+type Validator interface {
+	Validate() error
+}
+
+// redacted replaces secrets in printed configurations.
+const redacted = "REDACTED"
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// field is a tagged field of a configuration.
+type field struct {
+	value  reflect.Value
+	env    string
+	flag   string
+	usage  string
+	secret bool
+}
+
+// fieldsOf returns the tagged fields of the struct v and of the structs it
+// holds.
+func fieldsOf(v reflect.Value) []field {
+	var fields []field
+	for i := 0; i < v.NumField(); i++ {
+		sf := v.Type().Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		fv := v.Field(i)
+		if sf.Type.Kind() == reflect.Struct {
+			fields = append(fields, fieldsOf(fv)...)
+			continue
+		}
+		f := field{
+			value:  fv,
+			env:    sf.Tag.Get("env"),
+			flag:   sf.Tag.Get("flag"),
+			usage:  sf.Tag.Get("usage"),
+			secret: sf.Tag.Get("secret") == "true",
+		}
+		if f.env != "" || f.flag != "" || f.secret {
+			// fail early on fields that could not be set
+			parse(sf.Type, "")
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// parse converts s to a value of type t. Lists are comma separated.
+func parse(t reflect.Type, s string) (reflect.Value, error) {
+	v := reflect.New(t).Elem()
+	if t == durationType {
+		if s == "" {
+			return v, nil
+		}
+		d, err := time.ParseDuration(s)
+		v.SetInt(int64(d))
+		return v, err
+	}
+	switch t.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		if s == "" {
+			return v, nil
+		}
+		b, err := strconv.ParseBool(s)
+		v.SetBool(b)
+		return v, err
+	case reflect.Int, reflect.Int64:
+		if s == "" {
+			return v, nil
+		}
+		n, err := strconv.ParseInt(s, 10, 64)
+		v.SetInt(n)
+		return v, err
+	case reflect.Float64:
+		if s == "" {
+			return v, nil
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		v.SetFloat(f)
+		return v, err
+	case reflect.Slice:
+		if t.Elem().Kind() != reflect.String {
+			panic("config: unsupported field type " + t.String())
+		}
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				v = reflect.Append(v, reflect.ValueOf(item).Convert(t.Elem()))
+			}
+		}
+	default:
+		panic("config: unsupported field type " + t.String())
+	}
+	return v, nil
+}
+
+// format is the inverse of parse.
+func format(v reflect.Value) string {
+	switch {
+	case v.Type() == durationType:
+		return time.Duration(v.Int()).String()
+	case v.Kind() == reflect.Slice:
+		items := make([]string, v.Len())
+		for i := range items {
+			items[i] = v.Index(i).String()
+		}
+		return strings.Join(items, ",")
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// flagValue is the flag of a field. Its value is kept until the file and
+// the environment are loaded, so that it overrides them.
+type flagValue struct {
+	field  field
+	parsed *reflect.Value
+}
+
+// String is the default shown in the usage, where secrets are redacted too.
+func (f *flagValue) String() string {
+	if !f.field.value.IsValid() {
+		return ""
+	}
+	s := format(f.field.value)
+	if f.field.secret && s != "" {
+		return redact(s)
+	}
+	return s
+}
+
+func (f *flagValue) Set(s string) error {
+	v, err := parse(f.field.value.Type(), s)
+	if err != nil {
+		return err
+	}
+	f.parsed = &v
+	return nil
+}
+
+func (f *flagValue) IsBoolFlag() bool {
+	return f.field.value.Kind() == reflect.Bool
+}
+
+// Load fills cfg, a pointer to a configuration struct holding its defaults,
+// from the YAML file of -config or $fileEnv, the environment and the flags
+// of args, in increasing precedence, and validates it if it is a Validator.
+// The flags of the fields and -config and -print-config are defined on fs,
+// which may define flags of its own.
+func Load(cfg any, fs *flag.FlagSet, args []string, fileEnv string) error {
+	v := reflect.ValueOf(cfg)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		panic("config: Load needs a pointer to a struct")
+	}
+	fields := fieldsOf(v.Elem())
+
+	var flags []*flagValue
+	for _, f := range fields {
+		if f.flag == "" {
+			continue
+		}
+		usage := f.usage
+		if f.env != "" {
+			usage += ", $" + f.env
+		}
+		value := &flagValue{field: f}
+		fs.Var(value, f.flag, usage)
+		flags = append(flags, value)
+	}
+	file := fs.String("config", "", "YAML file with the configuration, $"+fileEnv)
+	printConfig := fs.Bool("print-config", false, "print the configuration, with secrets redacted, and exit")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *file == "" {
+		*file = os.Getenv(fileEnv)
+	}
+	if *file != "" {
+		if err := loadFile(cfg, *file); err != nil {
+			return err
+		}
+	}
+	for _, f := range fields {
+		s, ok := os.LookupEnv(f.env)
+		if f.env == "" || !ok {
+			continue
+		}
+		value, err := parse(f.value.Type(), s)
+		if err != nil {
+			return fmt.Errorf("config: $%s: %w", f.env, err)
+		}
+		f.value.Set(value)
+	}
+	for _, value := range flags {
+		if value.parsed != nil {
+			value.field.value.Set(*value.parsed)
+		}
+	}
+
+	if *printConfig {
+		return ErrPrintConfig
+	}
+	return Validate(cfg)
+}
+
+// loadFile sets the fields of cfg found in the YAML file at path. Unknown
+// keys are rejected, as they are usually misspelt ones.
+func loadFile(cfg any, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && err != io.EOF {
+		return fmt.Errorf("config: %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate validates cfg if it is a Validator.
+func Validate(cfg any) error {
+	if v, ok := cfg.(Validator); ok {
+		if err := v.Validate(); err != nil {
+			return fmt.Errorf("config: %w", err)
+		}
+	}
+	return nil
+}
+
+// Print writes cfg as YAML with its secrets redacted. Only the password of
+// a secret URL is redacted, so that it still shows where it points.
+func Print(w io.Writer, cfg any) error {
+	v := reflect.ValueOf(cfg).Elem()
+	copied := reflect.New(v.Type())
+	copied.Elem().Set(v)
+	for _, f := range fieldsOf(copied.Elem()) {
+		if f.secret && f.value.Kind() == reflect.String && f.value.String() != "" {
+			f.value.SetString(redact(f.value.String()))
+		}
+	}
+
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(copied.Interface()); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+func redact(secret string) string {
+	u, err := url.Parse(secret)
+	if err == nil && u.Scheme != "" && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+			return u.String()
+		}
+	}
+	return redacted
+}
+
+// MustLoad loads cfg from the command line like Load. With -print-config it
+// prints cfg and exits, with a failure if cfg is invalid; other errors exit
+// the program too.
+func MustLoad(cfg any, fileEnv string) {
+	err := Load(cfg, flag.CommandLine, os.Args[1:], fileEnv)
+	if err == ErrPrintConfig {
+		if err := Print(os.Stdout, cfg); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if err := Validate(cfg); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Config_Validate(t *testing.T) {
+	cfg := defaultConsumerConfig
+	assert.NoError(t, cfg.Validate())
+
+	cfg.Workers = 0
+	cfg.Retry.MaxDelay = cfg.Retry.BaseDelay / 2
+	cfg.Output.Format = "webp"
+	cfg.ShutdownTimeout = 0
+	err := cfg.Validate()
+	assert.ErrorContains(t, err, "workers")
+	assert.ErrorContains(t, err, "max retry delay")
+	assert.ErrorContains(t, err, "output format")
+	assert.ErrorContains(t, err, "shutdown_timeout")
+}
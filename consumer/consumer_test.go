@@ -4,17 +4,24 @@ import (
 	"bytes"
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"image"
+	"image/png"
 	"io"
 	"log"
 	"net/http"
+	"net/http/httptest"
 	"os"
-	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/arjun/go-message-queue-api/auth"
+	"github.com/arjun/go-message-queue-api/blobstore"
 	_ "github.com/lib/pq"
 	amqp "github.com/rabbitmq/amqp091-go"
 	"github.com/stretchr/testify/assert"
@@ -30,9 +37,15 @@ const (
 	test_dirname     = "tests"
 )
 
+// test_jwks is the JWKS file of the API under test, which the tests sign
+// their tokens with.
+var test_jwks = os.Getenv("JWKS")
+
 var testDb *sql.DB
+var testStore *blobstore.LocalStore
 var test_products = make([]string, 0)
 var test_productIds = make([]string, 0)
+var testAdminToken string
 
 func TestMain(m *testing.M) {
 	setup()
@@ -50,6 +63,15 @@ func setup() {
 	}
 	testDb = db
 
+	testStore, err = blobstore.NewLocalStore(test_dirname)
+	if err != nil {
+		log.Fatal("cannot create image store", err)
+	}
+
+	// the API under test runs with the development keys
+	apiToken = testToken("service", "service")
+	testAdminToken = testToken("admin", "admin")
+
 	var test_product1 = `{
 		"name": "aged-thunder",
 		"description": "black-dawn",
@@ -88,7 +110,7 @@ func setup() {
 	}
 }
 func teardown() {
-	testDb.Exec("TRUNCATE TABLE products")
+	testDb.Exec("TRUNCATE TABLE products, product_status")
 	testDb.Exec("ALTER TABLE products AUTO_INCREMENT = 1")
 	os.RemoveAll(test_dirname)
 }
@@ -110,7 +132,7 @@ func Test_Consumer_ConnectAMQPReceiveMsg(t *testing.T) {
 func doConsumeMsgWithTimeout() error {
 	result := make(chan string, 1)
 	go func() {
-		connectAMQPReceiveMsg(test_connAmqpStr, test_queueName, test_url, test_dirname)
+		connectAMQPReceiveMsg(context.Background(), test_connAmqpStr, test_queueName, test_url, testStore, defaultConsumerOptions)
 		result <- "done"
 	}()
 	select {
@@ -120,8 +142,27 @@ func doConsumeMsgWithTimeout() error {
 		return errors.New("timeout" + result)
 	}
 }
+func Test_Consumer_Shutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- connectAMQPReceiveMsg(ctx, test_connAmqpStr, test_queueName, test_url, testStore, defaultConsumerOptions)
+	}()
+	time.Sleep(time.Second)
+
+	cancel()
+	select {
+	case err := <-stopped:
+		assert.NoError(t, err)
+	case <-time.After(defaultConsumerOptions.ShutdownTimeout + 5*time.Second):
+		t.Fatal("consumer still running after the shutdown")
+	}
+}
+
 func Test_Consumer_GetImageUrls(t *testing.T) {
-	urls := getImageUrls(test_url, test_productIds[0])
+	urls, etag, err := getImageUrls(test_url, test_productIds[0])
+	assert.NoError(t, err)
+	assert.NotEmpty(t, etag)
 	assert.Len(t, urls, 2)
 	assert.Contains(t, urls, "https://via.placeholder.com/100/2225011")
 	assert.Contains(t, urls, "https://via.placeholder.com/100/378823")
@@ -129,35 +170,185 @@ func Test_Consumer_GetImageUrls(t *testing.T) {
 
 func Test_Consumer_DownloadStoreCompressImage(t *testing.T) {
 	urls := []string{"https://via.placeholder.com/100/2225011", "https://via.placeholder.com/100/378823"}
-	paths := downloadStoreCompressImage(urls, test_dirname, test_productIds[0])
-	expectedpath1 := fmt.Sprintf("./%s/product_%s_img_%s.png", test_dirname, test_productIds[0], path.Base(urls[0]))
-	expectedpath2 := fmt.Sprintf("./%s/product_%s_img_%s.png", test_dirname, test_productIds[0], path.Base(urls[1]))
-	assert.Len(t, paths, 2)
-	assert.Contains(t, paths, expectedpath1)
-	assert.Contains(t, paths, expectedpath2)
+	paths, images, err := downloadStoreCompressImage(context.Background(), urls, testStore, test_productIds[0], defaultConsumerOptions)
+	assert.NoError(t, err)
+	assert.Equal(t, statusSucceeded, outcomeState(images))
+	dir, _ := filepath.Abs(test_dirname)
+	expectedpath1 := fmt.Sprintf("file://%s/%s_compressed.png", dir, imageObjectName(test_productIds[0], urls[0]))
+	expectedpath2 := fmt.Sprintf("file://%s/%s_compressed.png", dir, imageObjectName(test_productIds[0], urls[1]))
+	assert.Len(t, paths, 1)
+	assert.Len(t, paths["compressed"], 2)
+	assert.Equal(t, expectedpath1, paths["compressed"][0])
+	assert.Equal(t, expectedpath2, paths["compressed"][1])
+
+	// an image that can never be processed keeps an empty place
+	missing := fmt.Sprintf("file://%s/originals/missing.png", dir)
+	paths, images, err = downloadStoreCompressImage(context.Background(), append([]string{missing}, urls...), testStore, test_productIds[0], defaultConsumerOptions)
+	assert.NoError(t, err)
+	assert.Equal(t, statusPartiallyFailed, outcomeState(images))
+	assert.Equal(t, statusFailed, images[0].State)
+	assert.NotEmpty(t, images[0].Error)
+	assert.Equal(t, []string{"", expectedpath1, expectedpath2}, paths["compressed"])
+
+	// a failing image fails the product even when run in parallel
+	_, images, err = downloadStoreCompressImage(context.Background(), append(urls, "http://localhost:1/missing"), testStore, test_productIds[0], defaultConsumerOptions)
+	assert.Error(t, err)
+	assert.Len(t, images, 3)
+}
+
+func Test_Consumer_DownloadStoreCompressSameNamedImages(t *testing.T) {
+	// two different images of one product with the same file name
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		size := 2
+		if strings.HasPrefix(r.URL.Path, "/b/") {
+			size = 3
+		}
+		png.Encode(w, image.NewRGBA(image.Rect(0, 0, size, size)))
+	}))
+	defer server.Close()
+
+	store, err := blobstore.NewLocalStore(t.TempDir())
+	assert.NoError(t, err)
+
+	urls := []string{server.URL + "/a/photo.png", server.URL + "/b/photo.png"}
+	paths, images, err := downloadStoreCompressImage(context.Background(), urls, store, "1", defaultConsumerOptions)
+	assert.NoError(t, err)
+	assert.Equal(t, statusSucceeded, outcomeState(images))
+	assert.Len(t, paths["compressed"], 2)
+	assert.NotEqual(t, paths["compressed"][0], paths["compressed"][1])
+
+	for i, size := range []int{2, 3} {
+		obj, err := store.Get(context.Background(), paths["compressed"][i])
+		assert.NoError(t, err)
+		cfg, _, err := image.DecodeConfig(obj.Body)
+		obj.Body.Close()
+		assert.NoError(t, err)
+		assert.Equal(t, size, cfg.Width, urls[i])
+	}
+}
+
+func Test_Consumer_OutcomeState(t *testing.T) {
+	ok := imageStatus{URL: "a", State: statusSucceeded}
+	failed := imageStatus{URL: "b", State: statusFailed, Error: "bad image"}
+	assert.Equal(t, statusSucceeded, outcomeState(nil))
+	assert.Equal(t, statusSucceeded, outcomeState([]imageStatus{ok}))
+	assert.Equal(t, statusPartiallyFailed, outcomeState([]imageStatus{ok, failed}))
+	assert.Equal(t, statusFailed, outcomeState([]imageStatus{failed}))
+}
+
+func Test_Consumer_ReportStatus(t *testing.T) {
+	err := postStatus(test_url, test_productIds[1], statusReport{State: statusProcessing})
+	assert.NoError(t, err)
+
+	// idle is never reported, the API rejects the report for good
+	err = postStatus(test_url, test_productIds[1], statusReport{State: "idle"})
+	assert.Error(t, err)
+	assert.True(t, isPermanent(err))
 }
 
 func Test_Consumer_SetStoragePaths(t *testing.T) {
 	urls := []string{"https://via.placeholder.com/100/2225011", "https://via.placeholder.com/100/378823"}
-	path1 := fmt.Sprintf("./%s/product_%s_img_%s.png", test_dirname, test_productIds[0], path.Base(urls[0]))
-	path2 := fmt.Sprintf("./%s/product_%s_img_%s.png", test_dirname, test_productIds[0], path.Base(urls[1]))
-	paths := make([]string, 0)
-	paths = append(paths, path1, path2)
-	err := setStoragePaths(test_url, test_productIds[0], paths)
+	path1 := fmt.Sprintf("./%s/%s_compressed.png", test_dirname, imageObjectName(test_productIds[0], urls[0]))
+	path2 := fmt.Sprintf("./%s/%s_compressed.png", test_dirname, imageObjectName(test_productIds[0], urls[1]))
+	thumb1 := fmt.Sprintf("./%s/%s_thumb.jpg", test_dirname, imageObjectName(test_productIds[0], urls[0]))
+	thumb2 := fmt.Sprintf("./%s/%s_thumb.jpg", test_dirname, imageObjectName(test_productIds[0], urls[1]))
+	renditions := map[string][]string{
+		"compressed": {path1, path2},
+		"thumb":      {thumb1, thumb2},
+	}
+	_, etag, err := getImageUrls(test_url, test_productIds[0])
+	assert.NoError(t, err)
+	err = setStoragePaths(test_url, test_productIds[0], etag, urls, renditions, "compressed")
+	assert.NoError(t, err)
+
+	// the product version moved on, so the old etag is rejected until the
+	// product is processed again
+	err = setStoragePaths(test_url, test_productIds[0], etag, urls, renditions, "compressed")
+	assert.Error(t, err)
+	assert.False(t, isPermanent(err))
+
+	// writing the paths of an image again replaces them
+	err = setStoragePaths(test_url, test_productIds[0], "", urls[1:], map[string][]string{"compressed": {path2}, "thumb": {thumb2}}, "compressed")
+	assert.NoError(t, err)
+	res, err := http.Get(test_url + "/" + test_productIds[0])
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	var product struct {
+		CompressedImages []string `json:"compressed_images"`
+	}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&product))
+	assert.Equal(t, []string{path1, path2}, product.CompressedImages)
+}
+
+func Test_Consumer_ParseProductJob(t *testing.T) {
+	job, err := parseProductJob([]byte("42\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, productJob{ProductID: "42"}, job)
+
+	job, err = parseProductJob([]byte(`{"product_id":42,"images":["file:///tmp/a.png"]}`))
 	assert.NoError(t, err)
+	assert.Equal(t, "42", job.ProductID)
+	assert.Equal(t, []string{"file:///tmp/a.png"}, job.Images)
+
+	for _, body := range []string{"", "abc", `{"images":["a"]}`, `{"product_id":`} {
+		_, err := parseProductJob([]byte(body))
+		assert.Error(t, err, body)
+	}
 }
 
-func Test_Consumer_ImageProcessingWithCreateFolder(t *testing.T) {
+func Test_Consumer_StillListed(t *testing.T) {
+	assert.Equal(t, []string{"b", "c"}, stillListed([]string{"b", "x", "c"}, []string{"a", "b", "c"}))
+	assert.Empty(t, stillListed([]string{"x"}, []string{"a"}))
+}
+
+func Test_Consumer_OpenImageFromStore(t *testing.T) {
+	url, err := testStore.Put(context.Background(), "originals/test_open.png", strings.NewReader("png"), "image/png")
+	assert.NoError(t, err)
+
+	body, err := openImage(context.Background(), url, testStore)
+	assert.NoError(t, err)
+	data, _ := io.ReadAll(body)
+	body.Close()
+	assert.Equal(t, "png", string(data))
+
+	_, err = openImage(context.Background(), url+".missing", testStore)
+	assert.Error(t, err)
+	assert.True(t, isPermanent(err))
+}
+
+func Test_Consumer_ImageProcessing(t *testing.T) {
 
 	resp, err := http.Get(test_image_url)
 	if err != nil {
 		panic(err)
 	}
-	err = createFolder(test_dirname)
+
+	profile := RenditionProfile{
+		{Name: "compressed", Fit: FitContain},
+		{Name: "thumb", Width: 20, Height: 20, Fit: FitCover, Format: FormatJPEG},
+	}
+	urls, err := imageProcessing(context.Background(), resp.Body, testStore, "test_img_1", defaultOutputOptions, profile)
 	assert.NoError(t, err)
+	assert.Len(t, urls, 2)
+	assert.True(t, strings.HasSuffix(urls["compressed"], "/test_img_1_compressed.png"))
+	assert.True(t, strings.HasSuffix(urls["thumb"], "/test_img_1_thumb.jpg"))
 
-	err = imageProcessing(resp.Body, test_dirname, "test_img_1")
+	obj, err := testStore.Get(context.Background(), urls["thumb"])
 	assert.NoError(t, err)
+	defer obj.Body.Close()
+	assert.Equal(t, "image/jpeg", obj.ContentType)
+}
+
+func Test_Consumer_GetImageUrlsMissingProduct(t *testing.T) {
+	_, _, err := getImageUrls(test_url, "1000000")
+	assert.Error(t, err)
+	assert.True(t, isPermanent(err))
+}
+
+func Test_Consumer_ImageProcessingBadImage(t *testing.T) {
+	_, err := imageProcessing(context.Background(), strings.NewReader("not an image"), testStore, "test_img_bad", defaultOutputOptions, defaultRenditionProfile)
+	assert.Error(t, err)
+	assert.True(t, isPermanent(err))
 }
 
 func Test_Consumer_FailOnError(t *testing.T) {
@@ -165,6 +356,19 @@ func Test_Consumer_FailOnError(t *testing.T) {
 	assert.NotPanics(t, func() { failOnError(nil, msg) })
 }
 
+// testToken is a token for the API signed with its keys, see test_jwks.
+func testToken(subject, role string) string {
+	keys, err := auth.LoadKeySet(test_jwks)
+	if err != nil {
+		log.Fatal("cannot load the keys of the API from $JWKS", err)
+	}
+	token, err := keys.Sign(auth.Claims{Subject: subject, Role: role, ExpiresAt: auth.NewNumericDate(time.Now().Add(time.Hour))})
+	if err != nil {
+		log.Fatal("cannot sign token", err)
+	}
+	return token
+}
+
 func createTestProduct(payload []byte) string {
 	r, err := http.NewRequest("POST", test_url, bytes.NewBuffer(payload))
 	if err != nil {
@@ -172,6 +376,7 @@ func createTestProduct(payload []byte) string {
 	}
 
 	r.Header.Add("Content-Type", "application/json")
+	r.Header.Add("Authorization", "Bearer "+testAdminToken)
 
 	client := &http.Client{}
 	res, err := client.Do(r)
@@ -183,10 +388,13 @@ func createTestProduct(payload []byte) string {
 		panic(err)
 	}
 	defer res.Body.Close()
-	productMsg := string(body)
-	productMsg = strings.ReplaceAll(productMsg, "\"\n", "")
-	productId := strings.Split(productMsg, ":")[1]
-	return productId
+	var product struct {
+		ID int `json:"id"`
+	}
+	if err := json.Unmarshal(body, &product); err != nil {
+		panic(err)
+	}
+	return strconv.Itoa(product.ID)
 }
 
 func createTestConnectAMQPSendMsg() {
@@ -203,7 +411,7 @@ func createTestConnectAMQPSendMsg() {
 
 	queue, err := ch.QueueDeclare(
 		test_queueName, // name
-		false,          // durable
+		true,           // durable
 		false,          // delete when unused
 		false,          // exclusive
 		false,          // no-wait
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+
+	"golang.org/x/image/webp"
+)
+
+const (
+	FormatSource = "source"
+	FormatJPEG   = "jpeg"
+	FormatPNG    = "png"
+	FormatGIF    = "gif"
+	FormatWebP   = "webp"
+)
+
+// OutputOptions selects the encoding of processed images. FormatSource keeps
+// the format of the input, except for WebP which has no encoder and is
+// written as PNG. JPEGQuality applies to every JPEG output. CompressionRatio
+// is the SVD compression ratio applied to every image, 0 for none.
+type OutputOptions struct {
+	Format           string `yaml:"format" env:"OUTPUT_FORMAT" flag:"output-format" usage:"format of processed images: source, jpeg or png"`
+	JPEGQuality      int    `yaml:"jpeg_quality" env:"JPEG_QUALITY" flag:"jpeg-quality" usage:"quality of JPEG output, 1 to 100"`
+	CompressionRatio int    `yaml:"compression_ratio" env:"COMPRESSION_RATIO" flag:"compression-ratio" usage:"SVD compression ratio of processed images, 0 for none to 99"`
+}
+
+var defaultOutputOptions = OutputOptions{
+	Format:           FormatSource,
+	JPEGQuality:      85,
+	CompressionRatio: 90,
+}
+
+// Validate reports unusable output options.
+func (o OutputOptions) Validate() error {
+	switch o.Format {
+	case FormatSource, FormatJPEG, FormatPNG:
+	default:
+		return fmt.Errorf("output format must be %q, %q or %q", FormatSource, FormatJPEG, FormatPNG)
+	}
+	if o.JPEGQuality < 1 || o.JPEGQuality > 100 {
+		return fmt.Errorf("jpeg quality must be between 1 and 100")
+	}
+	if o.CompressionRatio < 0 || o.CompressionRatio > 99 {
+		return fmt.Errorf("compression ratio must be between 0 and 99")
+	}
+	return nil
+}
+
+// sniffImageFormat detects the format of an image from its first bytes rather
+// than trusting the URL or the Content-Type of the server that hosts it.
+func sniffImageFormat(r *bufio.Reader) (string, error) {
+	head, err := r.Peek(512)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return "", err
+	}
+	switch contentType := http.DetectContentType(head); contentType {
+	case "image/png":
+		return FormatPNG, nil
+	case "image/jpeg":
+		return FormatJPEG, nil
+	case "image/gif":
+		return FormatGIF, nil
+	case "image/webp":
+		return FormatWebP, nil
+	default:
+		return "", permanent(fmt.Errorf("unsupported image type %s", contentType))
+	}
+}
+
+// decodeImage sniffs and decodes an image. Only the first frame of an
+// animated GIF is kept. The returned image always has its origin at (0, 0).
+func decodeImage(body io.Reader) (image.Image, string, error) {
+	r := bufio.NewReaderSize(body, 512)
+	format, err := sniffImageFormat(r)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var img image.Image
+	switch format {
+	case FormatPNG:
+		img, err = png.Decode(r)
+	case FormatJPEG:
+		img, err = jpeg.Decode(r)
+	case FormatGIF:
+		img, err = gif.Decode(r)
+	case FormatWebP:
+		img, err = webp.Decode(r)
+	}
+	if err != nil {
+		// a broken image stays broken on retry
+		return nil, "", permanent(fmt.Errorf("decode %s: %w", format, err))
+	}
+
+	if img.Bounds().Min != (image.Point{}) {
+		b := img.Bounds()
+		rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(rgba, rgba.Bounds(), img, b.Min, draw.Src)
+		img = rgba
+	}
+	return img, format, nil
+}
+
+// outputFormat returns the format an image decoded from source is written in.
+func outputFormat(source string, o OutputOptions) string {
+	if o.Format != FormatSource {
+		return o.Format
+	}
+	if source == FormatWebP {
+		return FormatPNG
+	}
+	return source
+}
+
+func formatExtension(format string) string {
+	if format == FormatJPEG {
+		return "jpg"
+	}
+	return format
+}
+
+func encodeImage(w io.Writer, img image.Image, format string, o OutputOptions) error {
+	switch format {
+	case FormatJPEG:
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: o.JPEGQuality})
+	case FormatGIF:
+		return gif.Encode(w, img, nil)
+	case FormatPNG:
+		return png.Encode(w, img)
+	}
+	return fmt.Errorf("no encoder for %s", format)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 1x1 lossless WebP image
+const test_webp = "UklGRhoAAABXRUJQVlA4TA0AAAAvAAAAEAcQERGIiP4HAA=="
+
+func testImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for x := 0; x < 4; x++ {
+		for y := 0; y < 4; y++ {
+			img.Set(x, y, color.RGBA{uint8(x * 60), uint8(y * 60), 100, 255})
+		}
+	}
+	return img
+}
+
+func Test_ImageFormat_DecodeImage(t *testing.T) {
+	var pngBuf, jpegBuf, gifBuf bytes.Buffer
+	assert.NoError(t, png.Encode(&pngBuf, testImage()))
+	assert.NoError(t, jpeg.Encode(&jpegBuf, testImage(), nil))
+	assert.NoError(t, gif.Encode(&gifBuf, testImage(), nil))
+	webpBytes, err := base64.StdEncoding.DecodeString(test_webp)
+	assert.NoError(t, err)
+
+	for format, data := range map[string][]byte{
+		FormatPNG:  pngBuf.Bytes(),
+		FormatJPEG: jpegBuf.Bytes(),
+		FormatGIF:  gifBuf.Bytes(),
+		FormatWebP: webpBytes,
+	} {
+		img, detected, err := decodeImage(bytes.NewReader(data))
+		assert.NoError(t, err, format)
+		assert.Equal(t, format, detected)
+		assert.Equal(t, image.Point{}, img.Bounds().Min)
+	}
+
+	_, _, err = decodeImage(bytes.NewReader([]byte("<html></html>")))
+	assert.Error(t, err)
+	assert.True(t, isPermanent(err))
+
+	// a PNG signature followed by garbage is detected but fails to decode
+	_, _, err = decodeImage(bytes.NewReader(append(pngBuf.Bytes()[:16], 0, 1, 2)))
+	assert.Error(t, err)
+	assert.True(t, isPermanent(err))
+}
+
+func Test_ImageFormat_OutputFormat(t *testing.T) {
+	source := OutputOptions{Format: FormatSource, JPEGQuality: 85}
+	assert.Equal(t, FormatJPEG, outputFormat(FormatJPEG, source))
+	assert.Equal(t, FormatGIF, outputFormat(FormatGIF, source))
+	assert.Equal(t, FormatPNG, outputFormat(FormatWebP, source))
+
+	forced := OutputOptions{Format: FormatJPEG, JPEGQuality: 60}
+	assert.Equal(t, FormatJPEG, outputFormat(FormatPNG, forced))
+	assert.Equal(t, "jpg", formatExtension(FormatJPEG))
+
+	var buf bytes.Buffer
+	assert.NoError(t, encodeImage(&buf, testImage(), FormatJPEG, forced))
+	_, detected, err := decodeImage(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, FormatJPEG, detected)
+}
+
+func Test_ImageFormat_Validate(t *testing.T) {
+	assert.NoError(t, defaultOutputOptions.Validate())
+	assert.Error(t, OutputOptions{Format: "webp", JPEGQuality: 85}.Validate())
+	assert.Error(t, OutputOptions{Format: FormatJPEG, JPEGQuality: 0}.Validate())
+	assert.Error(t, OutputOptions{Format: FormatJPEG, JPEGQuality: 85, CompressionRatio: 100}.Validate())
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"os"
+	"regexp"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	FitContain = "contain"
+	FitCover   = "cover"
+	FitFill    = "fill"
+)
+
+// Rendition is one named variant produced for every image. A zero Width or
+// Height leaves that dimension to the aspect ratio; both zero keeps the
+// original size. Fit decides how the image is matched to the box:
+//   - contain scales it down to fit inside the box, never up,
+//   - cover scales it to cover the box and crops the overflow from the center,
+//   - fill stretches it to exactly the box.
+//
+// Format overrides the global output format of the consumer when set.
+type Rendition struct {
+	Name   string `json:"name"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Fit    string `json:"fit"`
+	Format string `json:"format"`
+}
+
+// RenditionProfile lists the variants produced for every image. The first
+// rendition is the primary one, which is also reported as the product's
+// compressed images for clients that do not know about renditions.
+type RenditionProfile []Rendition
+
+// defaultRenditionProfile produces a single compressed copy of every image
+// in its original size.
+var defaultRenditionProfile = RenditionProfile{
+	{Name: "compressed", Fit: FitContain},
+}
+
+var renditionNamePattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// LoadRenditionProfile reads a JSON array of renditions from path.
+func LoadRenditionProfile(path string) (RenditionProfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var profile RenditionProfile
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for i := range profile {
+		if profile[i].Fit == "" {
+			profile[i].Fit = FitContain
+		}
+	}
+	return profile, profile.Validate()
+}
+
+func (p RenditionProfile) Validate() error {
+	if len(p) == 0 {
+		return fmt.Errorf("rendition profile is empty")
+	}
+	seen := make(map[string]bool, len(p))
+	for _, r := range p {
+		if !renditionNamePattern.MatchString(r.Name) {
+			return fmt.Errorf("rendition name %q must be 1 to 32 of a-z, 0-9, _ and -", r.Name)
+		}
+		if seen[r.Name] {
+			return fmt.Errorf("rendition %q is defined twice", r.Name)
+		}
+		seen[r.Name] = true
+		if r.Width < 0 || r.Height < 0 {
+			return fmt.Errorf("rendition %q has a negative size", r.Name)
+		}
+		switch r.Fit {
+		case FitContain:
+		case FitCover, FitFill:
+			if r.Width == 0 || r.Height == 0 {
+				return fmt.Errorf("rendition %q needs width and height for fit %q", r.Name, r.Fit)
+			}
+		default:
+			return fmt.Errorf("rendition %q fit must be %q, %q or %q", r.Name, FitContain, FitCover, FitFill)
+		}
+		switch r.Format {
+		case "", FormatSource, FormatJPEG, FormatPNG:
+		default:
+			return fmt.Errorf("rendition %q format must be %q, %q or %q", r.Name, FormatSource, FormatJPEG, FormatPNG)
+		}
+	}
+	return nil
+}
+
+// Primary returns the name of the primary rendition.
+func (p RenditionProfile) Primary() string {
+	return p[0].Name
+}
+
+// output returns the output options of the rendition, falling back to the
+// global ones.
+func (r Rendition) output(global OutputOptions) OutputOptions {
+	if r.Format != "" {
+		global.Format = r.Format
+	}
+	return global
+}
+
+// resize returns img matched to the box of the rendition. img must have its
+// origin at (0, 0).
+func (r Rendition) resize(img image.Image) image.Image {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	if (r.Width == 0 && r.Height == 0) || w == 0 || h == 0 {
+		return img
+	}
+
+	switch r.Fit {
+	case FitFill:
+		return scale(img, img.Bounds(), r.Width, r.Height)
+
+	case FitCover:
+		// crop the source to the aspect ratio of the box, then scale
+		src := img.Bounds()
+		if w*r.Height > h*r.Width {
+			cw := h * r.Width / r.Height
+			src = image.Rect((w-cw)/2, 0, (w-cw)/2+cw, h)
+		} else {
+			ch := w * r.Height / r.Width
+			src = image.Rect(0, (h-ch)/2, w, (h-ch)/2+ch)
+		}
+		return scale(img, src, r.Width, r.Height)
+
+	default:
+		dw, dh := w, h
+		if r.Width > 0 && dw > r.Width {
+			dw, dh = r.Width, h*r.Width/w
+		}
+		if r.Height > 0 && dh > r.Height {
+			dw, dh = w*r.Height/h, r.Height
+		}
+		if dw == w && dh == h {
+			return img
+		}
+		return scale(img, img.Bounds(), max(dw, 1), max(dh, 1))
+	}
+}
+
+func scale(img image.Image, src image.Rectangle, width, height int) image.Image {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, src, draw.Src, nil)
+	return dst
+}
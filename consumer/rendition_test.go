@@ -0,0 +1,60 @@
+package main
+
+import (
+	"image"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Rendition_Resize(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 400, 200))
+
+	contain := Rendition{Name: "listing", Width: 100, Height: 100, Fit: FitContain}
+	assert.Equal(t, image.Rect(0, 0, 100, 50), contain.resize(img).Bounds())
+
+	// contain never scales up
+	large := Rendition{Name: "zoom", Width: 1000, Height: 1000, Fit: FitContain}
+	assert.Equal(t, img.Bounds(), large.resize(img).Bounds())
+
+	heightOnly := Rendition{Name: "strip", Height: 50, Fit: FitContain}
+	assert.Equal(t, image.Rect(0, 0, 100, 50), heightOnly.resize(img).Bounds())
+
+	cover := Rendition{Name: "thumb", Width: 50, Height: 50, Fit: FitCover}
+	assert.Equal(t, image.Rect(0, 0, 50, 50), cover.resize(img).Bounds())
+
+	fill := Rendition{Name: "banner", Width: 300, Height: 30, Fit: FitFill}
+	assert.Equal(t, image.Rect(0, 0, 300, 30), fill.resize(img).Bounds())
+
+	original := Rendition{Name: "compressed", Fit: FitContain}
+	assert.Equal(t, img.Bounds(), original.resize(img).Bounds())
+}
+
+func Test_Rendition_Validate(t *testing.T) {
+	assert.NoError(t, defaultRenditionProfile.Validate())
+	assert.Error(t, RenditionProfile{}.Validate())
+	assert.Error(t, RenditionProfile{{Name: "Thumb", Fit: FitContain}}.Validate())
+	assert.Error(t, RenditionProfile{{Name: "a", Fit: FitContain}, {Name: "a", Fit: FitContain}}.Validate())
+	assert.Error(t, RenditionProfile{{Name: "a", Width: 10, Fit: FitCover}}.Validate())
+	assert.Error(t, RenditionProfile{{Name: "a", Fit: "stretch"}}.Validate())
+	assert.Error(t, RenditionProfile{{Name: "a", Fit: FitContain, Format: "webp"}}.Validate())
+}
+
+func Test_Rendition_LoadRenditionProfile(t *testing.T) {
+	profile, err := LoadRenditionProfile("./renditions.json")
+	assert.NoError(t, err)
+	assert.Equal(t, "listing", profile.Primary())
+	assert.Len(t, profile, 3)
+
+	path := filepath.Join(t.TempDir(), "renditions.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`[{"name":"thumb","width":10}]`), 0644))
+	profile, err = LoadRenditionProfile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, FitContain, profile[0].Fit)
+
+	assert.NoError(t, os.WriteFile(path, []byte(`{"name":"thumb"}`), 0644))
+	_, err = LoadRenditionProfile(path)
+	assert.Error(t, err)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// attemptHeader counts how often a message has already failed.
+	attemptHeader = "x-attempt"
+	errorHeader   = "x-last-error"
+
+	// publishTimeout bounds a republish including the wait for its confirm.
+	publishTimeout = 10 * time.Second
+)
+
+// RetryPolicy controls how failed products are retried. Retry n waits
+// BaseDelay * 2^(n-1), capped at MaxDelay, in the delay queue of that delay;
+// after MaxRetries retries the message goes to the dead-letter queue.
+type RetryPolicy struct {
+	MaxRetries int           `yaml:"max_retries" env:"MAX_RETRIES" flag:"max-retries" usage:"retries of a failed product before it is dead-lettered"`
+	BaseDelay  time.Duration `yaml:"delay" env:"RETRY_DELAY" flag:"retry-delay" usage:"delay before the first retry, doubled on every further retry"`
+	MaxDelay   time.Duration `yaml:"max_delay" env:"MAX_RETRY_DELAY" flag:"max-retry-delay" usage:"upper bound of the retry delay"`
+}
+
+var defaultRetryPolicy = RetryPolicy{
+	MaxRetries: 5,
+	BaseDelay:  5 * time.Second,
+	MaxDelay:   10 * time.Minute,
+}
+
+// Delay returns the delay before retry number attempt (starting at 1).
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempt && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+// retryQueueName names the delay queue after its delay, as the TTL of a queue
+// cannot change once it is declared: a new delay gets a new queue, and the
+// queues of old delays still drain into queueName.
+func retryQueueName(queueName string, delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%dms", queueName, delay.Milliseconds())
+}
+
+func deadLetterQueueName(queueName string) string {
+	return queueName + ".dlq"
+}
+
+// permanentError marks failures that will not succeed on retry, such as a
+// product that no longer exists or an image that cannot be decoded.
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+func permanent(err error) error {
+	return permanentError{err: err}
+}
+
+func isPermanent(err error) bool {
+	var p permanentError
+	return errors.As(err, &p)
+}
+
+// declareRetryQueues declares one delay queue per retry delay, each with a
+// fixed TTL that dead-letters expired messages back onto queueName, and the
+// dead-letter queue. A queue per delay avoids short delays waiting behind
+// long ones, as RabbitMQ only expires messages at the head of a queue.
+func declareRetryQueues(ch *amqp.Channel, queueName string, retry RetryPolicy) error {
+	declared := map[time.Duration]bool{}
+	for attempt := 1; attempt <= retry.MaxRetries; attempt++ {
+		delay := retry.Delay(attempt)
+		if declared[delay] {
+			continue
+		}
+		declared[delay] = true
+		_, err := ch.QueueDeclare(
+			retryQueueName(queueName, delay), // name
+			true,                             // durable
+			false,                            // delete when unused
+			false,                            // exclusive
+			false,                            // no-wait
+			amqp.Table{
+				"x-message-ttl":             delay.Milliseconds(),
+				"x-dead-letter-exchange":    "",
+				"x-dead-letter-routing-key": queueName,
+			},
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := ch.QueueDeclare(
+		deadLetterQueueName(queueName), // name
+		true,                           // durable
+		false,                          // delete when unused
+		false,                          // exclusive
+		false,                          // no-wait
+		nil,                            // arguments
+	)
+	return err
+}
+
+// deliveryAttempt returns how often the delivery has failed before.
+func deliveryAttempt(d amqp.Delivery) int {
+	switch v := d.Headers[attemptHeader].(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case int:
+		return v
+	}
+	return 0
+}
+
+// willDeadLetter reports whether retryOrDeadLetter moves d to the dead letter
+// queue rather than scheduling another attempt.
+func willDeadLetter(d amqp.Delivery, retry RetryPolicy, cause error) bool {
+	return isPermanent(cause) || deliveryAttempt(d)+1 > retry.MaxRetries
+}
+
+// publishConfirmed publishes msg to the queue routingKey on ch, which must be
+// in confirm mode, and waits until the broker has taken it over.
+func publishConfirmed(ch *amqp.Channel, routingKey string, msg amqp.Publishing) error {
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+	confirm, err := ch.PublishWithDeferredConfirmWithContext(ctx,
+		"",         // exchange
+		routingKey, // routing key
+		false,      // mandatory
+		false,      // immediate
+		msg)
+	if err != nil {
+		return err
+	}
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !acked {
+		return errors.New("message nacked by broker")
+	}
+	return nil
+}
+
+// retryOrDeadLetter republishes a failed delivery to the next delay queue or,
+// once the retries are used up or the failure is permanent, to the
+// dead-letter queue, and acknowledges it once the broker has confirmed the
+// copy, so that a lost republish cannot lose the product. ch must be in
+// confirm mode. If republishing fails the delivery is left for the caller to
+// requeue.
+func retryOrDeadLetter(ch *amqp.Channel, queueName string, d amqp.Delivery, retry RetryPolicy, cause error) error {
+	attempt := deliveryAttempt(d) + 1
+
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	headers[attemptHeader] = int32(attempt)
+	headers[errorHeader] = cause.Error()
+
+	target := retryQueueName(queueName, retry.Delay(attempt))
+	if willDeadLetter(d, retry, cause) {
+		target = deadLetterQueueName(queueName)
+		log.Printf("dead-lettering message %q after %d attempts", d.Body, attempt)
+	} else {
+		log.Printf("retrying message %q in %s", d.Body, retry.Delay(attempt))
+	}
+
+	err := publishConfirmed(ch, target, amqp.Publishing{
+		Headers:      headers,
+		ContentType:  d.ContentType,
+		DeliveryMode: amqp.Persistent,
+		MessageId:    d.MessageId,
+		Body:         d.Body,
+	})
+	if err != nil {
+		return err
+	}
+	return d.Ack(false)
+}
+
+// inspectDeadLetters prints the dead-lettered messages without removing them.
+func inspectDeadLetters(connect, queueName string) {
+	conn, err := amqp.Dial(connect)
+	failOnError(err, "Failed to connect to RabbitMQ")
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+	failOnError(err, "Failed to open a channel")
+	defer ch.Close()
+
+	count := 0
+	for {
+		d, ok, err := ch.Get(deadLetterQueueName(queueName), false)
+		failOnError(err, "Failed to read the dead-letter queue")
+		if !ok {
+			break
+		}
+		count++
+		log.Printf("ProductID:%s attempts:%d error:%v", d.Body, deliveryAttempt(d), d.Headers[errorHeader])
+	}
+	// closing the channel hands the unacknowledged messages back to the queue
+	log.Printf("%d dead-lettered messages", count)
+}
+
+// replayDeadLetters moves every dead-lettered message back to the queue with
+// a fresh attempt count.
+func replayDeadLetters(connect, queueName string) {
+	conn, err := amqp.Dial(connect)
+	failOnError(err, "Failed to connect to RabbitMQ")
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+	failOnError(err, "Failed to open a channel")
+	defer ch.Close()
+	failOnError(ch.Confirm(false), "Failed to put the channel into confirm mode")
+
+	count := 0
+	for {
+		d, ok, err := ch.Get(deadLetterQueueName(queueName), false)
+		failOnError(err, "Failed to read the dead-letter queue")
+		if !ok {
+			break
+		}
+		err = publishConfirmed(ch, queueName, amqp.Publishing{
+			ContentType:  d.ContentType,
+			DeliveryMode: amqp.Persistent,
+			MessageId:    d.MessageId,
+			Body:         d.Body,
+		})
+		failOnError(err, "Failed to replay a message")
+		failOnError(d.Ack(false), "Failed to acknowledge a replayed message")
+		count++
+	}
+	log.Printf("replayed %d dead-lettered messages", count)
+}
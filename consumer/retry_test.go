@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Retry_Delay(t *testing.T) {
+	policy := RetryPolicy{MaxRetries: 5, BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+	assert.Equal(t, time.Second, policy.Delay(1))
+	assert.Equal(t, 2*time.Second, policy.Delay(2))
+	assert.Equal(t, 4*time.Second, policy.Delay(3))
+	assert.Equal(t, 5*time.Second, policy.Delay(4))
+	assert.Equal(t, 5*time.Second, policy.Delay(50))
+}
+
+func Test_Retry_DeliveryAttempt(t *testing.T) {
+	assert.Equal(t, 0, deliveryAttempt(amqp.Delivery{}))
+	assert.Equal(t, 3, deliveryAttempt(amqp.Delivery{Headers: amqp.Table{attemptHeader: int32(3)}}))
+	assert.Equal(t, 4, deliveryAttempt(amqp.Delivery{Headers: amqp.Table{attemptHeader: int64(4)}}))
+}
+
+func Test_Retry_IsPermanent(t *testing.T) {
+	err := errors.New("boom")
+	assert.False(t, isPermanent(err))
+	assert.True(t, isPermanent(permanent(err)))
+	assert.True(t, isPermanent(fmt.Errorf("wrapped: %w", permanent(err))))
+}
+
+func Test_Retry_WillDeadLetter(t *testing.T) {
+	policy := RetryPolicy{MaxRetries: 2}
+	err := errors.New("boom")
+	assert.False(t, willDeadLetter(amqp.Delivery{}, policy, err))
+	assert.True(t, willDeadLetter(amqp.Delivery{}, policy, permanent(err)))
+	assert.False(t, willDeadLetter(amqp.Delivery{Headers: amqp.Table{attemptHeader: int32(1)}}, policy, err))
+	assert.True(t, willDeadLetter(amqp.Delivery{Headers: amqp.Table{attemptHeader: int32(2)}}, policy, err))
+}
+
+func Test_Retry_QueueNames(t *testing.T) {
+	assert.Equal(t, "QueueService1.retry.5000ms", retryQueueName("QueueService1", 5*time.Second))
+	assert.Equal(t, "QueueService1.retry.600000ms", retryQueueName("QueueService1", 10*time.Minute))
+	assert.Equal(t, "QueueService1.dlq", deadLetterQueueName("QueueService1"))
+}
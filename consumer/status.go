@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+// Processing states reported to the API, see GET /product/{id}/status.
+const (
+	statusQueued          = "queued"
+	statusProcessing      = "processing"
+	statusSucceeded       = "succeeded"
+	statusPartiallyFailed = "partially_failed"
+	statusFailed          = "failed"
+)
+
+// imageStatus is the outcome of processing one source image.
+type imageStatus struct {
+	URL   string `json:"url"`
+	State string `json:"state"`
+	Error string `json:"error,omitempty"`
+}
+
+type statusReport struct {
+	State  string        `json:"state"`
+	Worker string        `json:"worker"`
+	Error  string        `json:"error,omitempty"`
+	Images []imageStatus `json:"images,omitempty"`
+}
+
+// outcomeState is the final state of a job whose images ended as given.
+func outcomeState(images []imageStatus) string {
+	failed := 0
+	for _, img := range images {
+		if img.State == statusFailed {
+			failed++
+		}
+	}
+	switch {
+	case failed == 0:
+		return statusSucceeded
+	case failed == len(images):
+		return statusFailed
+	}
+	return statusPartiallyFailed
+}
+
+// reportStatus posts a status transition of a product to the API. The status
+// is informational, so a failed report is logged and does not fail the job.
+func reportStatus(baseUrl, productId string, report statusReport) {
+	if err := postStatus(baseUrl, productId, report); err != nil {
+		log.Printf("ProductID:%s could not report status %s: %s", productId, report.State, err)
+	}
+}
+
+func postStatus(baseUrl, productId string, report statusReport) error {
+	report.Worker = workerID
+	payload, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%s/%s/status", baseUrl, productId)
+	r, err := http.NewRequest("POST", url, bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+	r.Header.Add("Content-Type", "application/json")
+	authorize(r)
+	res, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, _ := io.ReadAll(res.Body)
+	return checkResponse(res, body)
+}
@@ -0,0 +1,3 @@
+-- rewinding the sequence would hand out the ids of existing users again, so
+-- it is only kept past them
+SELECT setval('users_id_seq', COALESCE((SELECT MAX(id) FROM users), 0) + 1, false);
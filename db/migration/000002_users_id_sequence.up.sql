@@ -0,0 +1,3 @@
+-- the seed rows in 000001 insert explicit ids, so move the sequence past them
+-- before users are created through the API
+SELECT setval('users_id_seq', COALESCE((SELECT MAX(id) FROM users), 0) + 1, false);
@@ -0,0 +1,2 @@
+ALTER TABLE "products" DROP COLUMN IF EXISTS "compressed_at";
+ALTER TABLE "products" DROP COLUMN IF EXISTS "compressed_by";
@@ -0,0 +1,2 @@
+ALTER TABLE "products" ADD COLUMN "compressed_by" varchar;
+ALTER TABLE "products" ADD COLUMN "compressed_at" timestamptz;
@@ -0,0 +1,13 @@
+CREATE TABLE "outbox" (
+  "id" bigserial PRIMARY KEY,
+  "topic" varchar NOT NULL,
+  "payload" text NOT NULL,
+  "attempts" int NOT NULL DEFAULT 0,
+  "last_error" text,
+  "created_at" timestamptz NOT NULL DEFAULT (now()),
+  "published_at" timestamptz,
+  -- a relay publishing the message hides it from the others until then
+  "claimed_until" timestamptz
+);
+
+CREATE INDEX "outbox_pending_idx" ON "outbox" ("id") WHERE "published_at" IS NULL;
@@ -0,0 +1,2 @@
+-- rendition name -> paths of that rendition, in the order of "images"
+ALTER TABLE "products" ADD COLUMN "renditions" jsonb;
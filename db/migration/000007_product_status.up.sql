@@ -0,0 +1,20 @@
+CREATE TABLE "product_status" (
+  "product_id" bigint PRIMARY KEY REFERENCES "products" ("id") ON DELETE CASCADE,
+  "state" varchar NOT NULL,
+  "attempts" int NOT NULL DEFAULT 0,
+  "error" text,
+  "worker" varchar,
+  "images" jsonb NOT NULL DEFAULT '[]',
+  "queued_at" timestamptz,
+  "started_at" timestamptz,
+  "finished_at" timestamptz,
+  "updated_at" timestamptz NOT NULL DEFAULT (now())
+);
+
+INSERT INTO "product_status" ("product_id", "state", "queued_at", "finished_at")
+SELECT "id",
+  CASE WHEN "compressed_images" IS NULL THEN 'queued' ELSE 'succeeded' END,
+  "created_at",
+  "compressed_at"
+FROM "products"
+WHERE cardinality("images") > 0;
@@ -0,0 +1,12 @@
+CREATE TABLE "product_events" (
+  "id" bigserial PRIMARY KEY,
+  "product_id" bigint NOT NULL,
+  "user_id" bigint NOT NULL,
+  "type" varchar NOT NULL,
+  "data" jsonb NOT NULL,
+  "created_at" timestamptz NOT NULL DEFAULT (now())
+);
+
+-- no foreign key, the events of a deleted product stay readable until pruned
+CREATE INDEX "product_events_product_idx" ON "product_events" ("product_id", "id");
+CREATE INDEX "product_events_user_idx" ON "product_events" ("user_id", "id");
@@ -0,0 +1,28 @@
+CREATE TABLE "webhooks" (
+  "id" bigserial PRIMARY KEY,
+  -- NULL subscribes to the events of every product
+  "user_id" bigint REFERENCES "users" ("id") ON DELETE CASCADE,
+  "url" varchar NOT NULL,
+  "secret" varchar NOT NULL,
+  "events" text[] NOT NULL,
+  "active" boolean NOT NULL DEFAULT true,
+  "created_at" timestamptz NOT NULL DEFAULT (now()),
+  "updated_at" timestamptz NOT NULL DEFAULT (now())
+);
+
+CREATE TABLE "webhook_deliveries" (
+  "id" bigserial PRIMARY KEY,
+  "webhook_id" bigint NOT NULL REFERENCES "webhooks" ("id") ON DELETE CASCADE,
+  "event" varchar NOT NULL,
+  "payload" text NOT NULL,
+  "status" varchar NOT NULL DEFAULT 'pending',
+  "attempts" int NOT NULL DEFAULT 0,
+  "next_attempt_at" timestamptz NOT NULL DEFAULT (now()),
+  "last_status_code" int,
+  "last_error" text,
+  "created_at" timestamptz NOT NULL DEFAULT (now()),
+  "delivered_at" timestamptz
+);
+
+CREATE INDEX "webhook_deliveries_due_idx" ON "webhook_deliveries" ("next_attempt_at") WHERE "status" = 'pending';
+CREATE INDEX "webhook_deliveries_webhook_idx" ON "webhook_deliveries" ("webhook_id", "id");
@@ -0,0 +1,16 @@
+CREATE TABLE "idempotency_keys" (
+  -- method and route the key was used on
+  "scope" varchar NOT NULL,
+  "key" varchar NOT NULL,
+  -- sha256 of the request body
+  "fingerprint" varchar NOT NULL,
+  -- NULL while the first request is still being handled
+  "status_code" int,
+  "header" jsonb,
+  "body" bytea,
+  "created_at" timestamptz NOT NULL DEFAULT (now()),
+  "completed_at" timestamptz,
+  PRIMARY KEY ("scope", "key")
+);
+
+CREATE INDEX "idempotency_keys_created_idx" ON "idempotency_keys" ("created_at");
@@ -0,0 +1,16 @@
+CREATE TABLE "api_keys" (
+  "id" bigserial PRIMARY KEY,
+  "name" varchar NOT NULL,
+  -- public part of the key, to look it up by
+  "prefix" varchar NOT NULL UNIQUE,
+  -- sha256 of the whole key, which is never stored
+  "hash" varchar NOT NULL,
+  "scopes" text[] NOT NULL,
+  -- user a key acts for; NULL keys act for every user within their scopes
+  "user_id" bigint REFERENCES "users" ("id") ON DELETE CASCADE,
+  "created_at" timestamptz NOT NULL DEFAULT (now()),
+  "expires_at" timestamptz,
+  "last_used_at" timestamptz,
+  -- set in the future while a rotated key is still accepted
+  "revoked_at" timestamptz
+);
@@ -0,0 +1,15 @@
+-- daily limits of a user, in place of the defaults of the server; 0 is unlimited
+CREATE TABLE "user_quotas" (
+  "user_id" bigint PRIMARY KEY REFERENCES "users" ("id") ON DELETE CASCADE,
+  "daily_products" int NOT NULL,
+  "daily_images" int NOT NULL
+);
+
+-- products and images submitted by a user per UTC day
+CREATE TABLE "daily_usage" (
+  "user_id" bigint NOT NULL REFERENCES "users" ("id") ON DELETE CASCADE,
+  "day" date NOT NULL,
+  "products" int NOT NULL DEFAULT 0,
+  "images" int NOT NULL DEFAULT 0,
+  PRIMARY KEY ("user_id", "day")
+);
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// ProducerConfig is the configuration of the producer, see the config
+// package for where it is loaded from.
+type ProducerConfig struct {
+	APIURL   string        `yaml:"api_url" env:"API_URL" flag:"api-url" usage:"base URL of the API"`
+	Token    string        `yaml:"token" env:"API_TOKEN" flag:"token" secret:"true" usage:"API key with the product:write scope, or an admin token"`
+	Products string        `yaml:"products" env:"PRODUCTS_FILE" flag:"products" usage:"JSON file with the products to create"`
+	Timeout  time.Duration `yaml:"timeout" env:"REQUEST_TIMEOUT" flag:"timeout" usage:"timeout of a create request"`
+	Batch    int           `yaml:"batch" env:"BATCH_SIZE" flag:"batch" usage:"products per bulk request, each created or not as a whole"`
+}
+
+var defaultProducerConfig = ProducerConfig{
+	APIURL:   "http://localhost:3000",
+	Products: "./products.json",
+	Timeout:  10 * time.Second,
+	Batch:    500,
+}
+
+func (c *ProducerConfig) Validate() error {
+	var errs []error
+	check := func(ok bool, msg string) {
+		if !ok {
+			errs = append(errs, errors.New(msg))
+		}
+	}
+	check(c.APIURL != "", "api_url is required")
+	check(c.Products != "", "products is required")
+	check(c.Timeout > 0, "timeout must be positive")
+	check(c.Batch > 0, "batch must be positive")
+	return errors.Join(errs...)
+}
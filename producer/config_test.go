@@ -0,0 +1,20 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Producer_ConfigValidate(t *testing.T) {
+	cfg := defaultProducerConfig
+	assert.NoError(t, cfg.Validate())
+
+	cfg.Products = ""
+	cfg.Timeout = 0
+	cfg.Batch = 0
+	err := cfg.Validate()
+	assert.ErrorContains(t, err, "products")
+	assert.ErrorContains(t, err, "timeout")
+	assert.ErrorContains(t, err, "batch")
+}